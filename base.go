@@ -0,0 +1,236 @@
+package fsync
+
+import (
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// BaseStore keeps the base snapshot of the last synced tree.
+	// With a base the provider compares the base, local and remote trees (three-way sync)
+	// and the CommitedFlag reported by the LocalFS is ignored.
+	// It must be safe for concurrent use
+	BaseStore interface {
+		// GetChildren returns the base items of a dir
+		GetChildren(itemPath string) ([]BaseItem, error)
+		// Set records the item as synced
+		Set(item BaseItem) error
+		// Remove forgets the item and its sub-items.
+		// It must not fail if the item does not exist
+		Remove(itemPath string) error
+		// Move renames the item and its sub-items
+		Move(fromPath, toPath string) error
+	}
+
+	// BaseItem is an item as it was when it was last synced
+	BaseItem struct {
+		RelativePath string `json:"relative_path"`
+		Dir          bool   `json:"dir"`
+		// Etag is the remote etag
+		Etag string `json:"etag"`
+		// Size and ModTime are the local ones, used to detect local changes
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"mod_time"`
+		// ContentHash is the local one. With CompareContentHash a file with the same hash is unchanged
+		ContentHash   string `json:"content_hash,omitempty"`
+		HashAlgorithm string `json:"hash_algorithm,omitempty"`
+		// FileID is the local one, used by Options.DetectMoves to pair the items renamed locally
+		FileID string `json:"file_id,omitempty"`
+	}
+
+	// BaseSnapshot is an in-memory BaseStore which can be persisted
+	BaseSnapshot interface {
+		BaseStore
+		Save(w io.Writer) error
+	}
+
+	baseSnapshot struct {
+		mu       sync.RWMutex
+		items    map[string]BaseItem
+		children map[string]map[string]bool
+	}
+)
+
+// NewBaseSnapshot creates an empty base snapshot
+func NewBaseSnapshot() BaseSnapshot {
+	return &baseSnapshot{
+		items:    map[string]BaseItem{},
+		children: map[string]map[string]bool{},
+	}
+}
+
+// LoadBaseSnapshot reads a base snapshot written by BaseSnapshot.Save
+func LoadBaseSnapshot(r io.Reader) (BaseSnapshot, error) {
+	items := []BaseItem{}
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, err
+	}
+
+	b := NewBaseSnapshot().(*baseSnapshot)
+	for _, bi := range items {
+		b.set(bi)
+	}
+	return b, nil
+}
+
+// Save writes the items sorted by path
+func (b *baseSnapshot) Save(w io.Writer) error {
+	b.mu.RLock()
+	items := make([]BaseItem, 0, len(b.items))
+	for _, bi := range b.items {
+		items = append(items, bi)
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool { return comparePaths(items[i].RelativePath, items[j].RelativePath) < 0 })
+	return json.NewEncoder(w).Encode(items)
+}
+
+func (b *baseSnapshot) GetChildren(itemPath string) ([]BaseItem, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	children := b.children[path.Clean("/"+itemPath)]
+	ret := make([]BaseItem, 0, len(children))
+	for c := range children {
+		ret = append(ret, b.items[c])
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+	return ret, nil
+}
+
+func (b *baseSnapshot) Set(item BaseItem) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.set(item)
+	return nil
+}
+
+func (b *baseSnapshot) Remove(itemPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(path.Clean("/" + itemPath))
+	return nil
+}
+
+func (b *baseSnapshot) Move(fromPath, toPath string) error {
+	fromPath = path.Clean("/" + fromPath)
+	toPath = path.Clean("/" + toPath)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	moved := []BaseItem{}
+	for p, bi := range b.items {
+		if isChildPath(p, fromPath) {
+			bi.RelativePath = toPath + p[len(fromPath):]
+			moved = append(moved, bi)
+		}
+	}
+
+	b.remove(fromPath)
+	b.remove(toPath)
+	for _, bi := range moved {
+		b.set(bi)
+	}
+	return nil
+}
+
+func (b *baseSnapshot) set(item BaseItem) {
+	item.RelativePath = path.Clean("/" + item.RelativePath)
+	if item.RelativePath == "/" {
+		return
+	}
+
+	b.items[item.RelativePath] = item
+	parent := path.Dir(item.RelativePath)
+	if b.children[parent] == nil {
+		b.children[parent] = map[string]bool{}
+	}
+	b.children[parent][item.RelativePath] = true
+}
+
+func (b *baseSnapshot) remove(itemPath string) {
+	if _, ok := b.items[itemPath]; !ok {
+		return
+	}
+
+	for c := range b.children[itemPath] {
+		b.remove(c)
+	}
+	delete(b.children, itemPath)
+	delete(b.items, itemPath)
+
+	parent := path.Dir(itemPath)
+	delete(b.children[parent], itemPath)
+	if len(b.children[parent]) == 0 {
+		delete(b.children, parent)
+	}
+}
+
+// applyBase derives the commit status of the local items from the base.
+// The base items missing locally are returned as awaiting remote deletion
+func (p *provider) applyBase(relativePath string, lis LocalItems, keepOnlyChildRPaths map[string]bool) (LocalItems, error) {
+	bis, err := p.base.GetChildren(relativePath)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]BaseItem, len(bis))
+	for _, bi := range bis {
+		byPath[bi.RelativePath] = bi
+	}
+
+	ret := make(LocalItems, 0, len(lis)+len(bis))
+	for _, li := range lis {
+		if li.Commited == CommitedAwaitingRemoteDeletion {
+			// Not present on the local file system
+			continue
+		}
+
+		li.TreeHash = ""
+		bi, ok := byPath[li.RelativePath]
+		delete(byPath, li.RelativePath)
+		if !ok || bi.Dir != li.Dir {
+			li.Etag = ""
+			li.Commited = CommitedNo
+		} else {
+			li.Etag = bi.Etag
+			if li.Dir || (li.Size == bi.Size && li.ModTime.Equal(bi.ModTime)) ||
+				(p.comparison == CompareContentHash && sameHash(li.HashAlgorithm, li.ContentHash, bi.HashAlgorithm, bi.ContentHash)) {
+				li.Commited = CommitedYes
+			} else {
+				li.Commited = CommitedNo
+			}
+		}
+		ret = append(ret, li)
+	}
+
+	for _, bi := range bis {
+		if _, ok := byPath[bi.RelativePath]; !ok {
+			continue
+		}
+		if keepOnlyChildRPaths != nil && !keepOnlyChildRPaths[bi.RelativePath] {
+			continue
+		}
+		ret = append(ret, LocalItem{
+			RelativePath:  bi.RelativePath,
+			Dir:           bi.Dir,
+			Etag:          bi.Etag,
+			Commited:      CommitedAwaitingRemoteDeletion,
+			ModTime:       bi.ModTime,
+			Size:          bi.Size,
+			ContentHash:   bi.ContentHash,
+			HashAlgorithm: bi.HashAlgorithm,
+			FileID:        bi.FileID,
+		})
+	}
+
+	return ret, nil
+}
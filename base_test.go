@@ -0,0 +1,174 @@
+package fsync_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestBaseSync(t *testing.T) {
+	t1 := time.Unix(1, 0)
+	t2 := time.Unix(2, 0)
+
+	base := fsync.NewBaseSnapshot()
+	for _, bi := range []fsync.BaseItem{
+		{RelativePath: "/a", Etag: "v1", Size: 1, ModTime: t1},
+		{RelativePath: "/c", Etag: "v1", Size: 1, ModTime: t1},
+		{RelativePath: "/d", Etag: "v1", Size: 1, ModTime: t1},
+		{RelativePath: "/e", Etag: "v1", Size: 1, ModTime: t1},
+		{RelativePath: "/f", Dir: true},
+		{RelativePath: "/f/g", Etag: "v1", Size: 1, ModTime: t1},
+	} {
+		require.NoError(t, base.Set(bi))
+	}
+
+	// The CommitedFlag of the local file system is ignored
+	localStatus := fsync.LocalItems{
+		{RelativePath: "/a", Dir: false, Size: 1, ModTime: t1},
+		{RelativePath: "/b", Dir: false, Size: 1, ModTime: t1, Commited: fsync.CommitedYes},
+		{RelativePath: "/d", Dir: false, Size: 2, ModTime: t2},
+		{RelativePath: "/e", Dir: false, Size: 1, ModTime: t1},
+		{RelativePath: "/f", Dir: true},
+		{RelativePath: "/f/g", Dir: false, Size: 1, ModTime: t1},
+	}
+
+	remoteStatus := fsync.RemoteItems{
+		{RelativePath: "/c", Dir: false, Etag: "v1"},
+		{RelativePath: "/d", Dir: false, Etag: "v2"},
+		{RelativePath: "/e", Dir: false, Etag: "v2"},
+		{RelativePath: "/f", Dir: true},
+		{RelativePath: "/f/g", Dir: false, Etag: "v1"},
+	}
+
+	expectedDecisions := []fsync.Decision{
+		{RelativePath: "/a", Flag: fsync.DecisionDeleteLocal},
+		{RelativePath: "/b", Flag: fsync.DecisionUploadLocal},
+		{RelativePath: "/c", Flag: fsync.DecisionDeleteRemote},
+		{RelativePath: "/d", Flag: fsync.DecisionConflict},
+		{RelativePath: "/e", Flag: fsync.DecisionDownloadRemote},
+	}
+
+	testScenarioWithOptions(t, localStatus, remoteStatus, expectedDecisions, &fsync.Options{Base: base})
+}
+
+func TestExecutorBaseSync(t *testing.T) {
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	base := fsync.NewBaseSnapshot()
+
+	runSync := func(t *testing.T) int {
+		applied := 0
+		e := fsync.NewExecutor(lFS, rFS, func(ctx context.Context, r fsync.ExecutionResult) error {
+			require.NoError(t, r.Err)
+			applied++
+			return nil
+		}, &fsync.ExecutorOptions{Base: base})
+		p := fsync.NewProvider(lFS, rFS, e.Execute, &fsync.Options{Base: base})
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		return applied
+	}
+
+	require.NoError(t, lFS.Mkdir("/a"))
+	lFS.Write("/a/b", "local b")
+	rFS.Write("/c", "remote c")
+	assert.Equal(t, 3, runSync(t))
+	assert.Equal(t, 0, runSync(t))
+
+	t.Run("Local changes", func(t *testing.T) {
+		lFS.Write("/a/b", "local b2")
+		require.NoError(t, lFS.Remove("/c"))
+		assert.Equal(t, 2, runSync(t))
+
+		assert.Equal(t, "local b2", content(rFS, "/a/b"))
+		_, ok := rFS.Data("/c")
+		assert.Equal(t, false, ok)
+		assert.Equal(t, 0, runSync(t))
+	})
+
+	t.Run("Remote changes", func(t *testing.T) {
+		require.NoError(t, rFS.Remove("/a"))
+		rFS.Write("/d", "remote d")
+		assert.Equal(t, 3, runSync(t))
+
+		_, err := lFS.Stat("/a")
+		ok := err == nil
+		assert.Equal(t, false, ok)
+		assert.Equal(t, "remote d", content(lFS, "/d"))
+		assert.Equal(t, 0, runSync(t))
+	})
+
+	t.Run("Save and load", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		require.NoError(t, base.Save(&buf))
+
+		loaded, err := fsync.LoadBaseSnapshot(&buf)
+		require.NoError(t, err)
+		bis, err := loaded.GetChildren("/")
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(bis))
+		assert.Equal(t, "/d", bis[0].RelativePath)
+		ri, err := rFS.Stat("/d")
+		require.NoError(t, err)
+		assert.Equal(t, ri.Etag, bis[0].Etag)
+		li, err := lFS.Stat("/d")
+		require.NoError(t, err)
+		assert.Equal(t, true, li.ModTime.Equal(bis[0].ModTime))
+
+		base = loaded
+		assert.Equal(t, 0, runSync(t))
+	})
+}
+
+func TestExecutorBaseMoves(t *testing.T) {
+	base := fsync.NewBaseSnapshot()
+	opts := &fsync.Options{Base: base, DetectMoves: true}
+
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	rFS.Write("/a/b", "b")
+	rFS.Write("/c", "c")
+
+	runSync := func(t *testing.T) []fsync.Decision {
+		decisions := []fsync.Decision{}
+		e := fsync.NewExecutor(lFS, rFS, func(ctx context.Context, r fsync.ExecutionResult) error {
+			require.NoError(t, r.Err)
+			decisions = append(decisions, r.Decision)
+			return nil
+		}, &fsync.ExecutorOptions{Base: base})
+		p := fsync.NewProvider(lFS, rFS, e.Execute, opts)
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		return decisions
+	}
+	runSync(t)
+
+	t.Run("Renamed remotely", func(t *testing.T) {
+		require.NoError(t, rFS.Move("/a", "/d"))
+		require.NoError(t, rFS.Move("/c", "/e"))
+
+		decisions := runSync(t)
+		require.Equal(t, 2, len(decisions))
+		for _, d := range decisions {
+			assert.Equal(t, fsync.DecisionMoveLocal, d.Flag)
+		}
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+	})
+
+	t.Run("Renamed locally", func(t *testing.T) {
+		lFS.Rename("/d", "/f")
+		lFS.Rename("/e", "/g")
+
+		decisions := runSync(t)
+		require.Equal(t, 2, len(decisions))
+		for _, d := range decisions {
+			assert.Equal(t, fsync.DecisionMoveRemote, d.Flag)
+		}
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+	})
+}
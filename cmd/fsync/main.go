@@ -0,0 +1,323 @@
+// Command fsync syncs two directory trees with the fsync provider.
+// The first directory is the local side and keeps the state journal,
+// the second one is the remote side.
+//
+// Usage:
+//
+//	fsync plan [flags] <local-dir> <remote-dir>
+//	fsync sync [flags] <local-dir> <remote-dir>
+//	fsync status [flags] <local-dir> <remote-dir>
+//	fsync check-decision [flags] <local-dir> <remote-dir> <decision-json|->
+//
+// plan prints the decisions without applying them, sync applies them
+// and lists the conflicts left unresolved (exit code 4), status lists
+// the local items which are not commited and check-decision tells if
+// a decision printed by plan -json is still valid.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/localfs"
+)
+
+type (
+	command struct {
+		flags *flag.FlagSet
+
+		journal     string
+		trash       bool
+		detectMoves bool
+		conflict    string
+		json        bool
+		force       bool
+
+		local  localfs.FS
+		remote *dirRemoteFS
+
+		stdin  io.Reader
+		stdout io.Writer
+	}
+)
+
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitObsolete  = 3
+	exitConflicts = 4
+
+	// The checks deleting more than half of the items of a side fail without -force
+	maxDeletionPercent = 50
+	minItemsForPercent = 10
+)
+
+var (
+	conflictPolicies = map[string]fsync.ConflictPolicy{
+		"manual":      fsync.ConflictPolicyManual,
+		"remote-wins": fsync.ConflictPolicyRemoteWins,
+		"local-wins":  fsync.ConflictPolicyLocalWins,
+		"newest-wins": fsync.ConflictPolicyNewestWins,
+		"keep-both":   fsync.ConflictPolicyKeepBoth,
+	}
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, `Usage:
+  fsync plan [flags] <local-dir> <remote-dir>
+  fsync sync [flags] <local-dir> <remote-dir>
+  fsync status [flags] <local-dir> <remote-dir>
+  fsync check-decision [flags] <local-dir> <remote-dir> <decision-json|->
+
+Run "fsync <command> -h" for the flags`)
+}
+
+// run executes the command line and returns the exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+
+	var exec func(ctx context.Context, c *command) (int, error)
+	nArgs := 2
+	switch args[0] {
+	case "plan":
+		exec = plan
+	case "sync":
+		exec = syncDirs
+	case "status":
+		exec = status
+	case "check-decision":
+		exec = checkDecision
+		nArgs = 3
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return exitOK
+	default:
+		fmt.Fprintf(stderr, "fsync: unknown command %q\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+
+	c := &command{
+		flags:  flag.NewFlagSet("fsync "+args[0], flag.ContinueOnError),
+		stdin:  stdin,
+		stdout: stdout,
+	}
+	c.flags.SetOutput(stderr)
+	c.flags.StringVar(&c.journal, "journal", "", "OS path of the journal (default <local-dir>/.fsync/journal)")
+	c.flags.BoolVar(&c.trash, "trash", false, "move the deleted local items to <local-dir>/.fsync/trash")
+	c.flags.BoolVar(&c.detectMoves, "detect-moves", false, "detect the items renamed in the same dir")
+	c.flags.StringVar(&c.conflict, "conflict", "manual", "conflict policy: manual, remote-wins, local-wins, newest-wins or keep-both")
+	c.flags.BoolVar(&c.json, "json", false, "print JSON instead of a table")
+	c.flags.BoolVar(&c.force, "force", false, "apply the checks deleting more than half of the items of a side")
+
+	if err := c.flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if c.flags.NArg() != nArgs {
+		fmt.Fprintf(stderr, "fsync %s: expecting %d arguments, got %d\n", args[0], nArgs, c.flags.NArg())
+		c.flags.Usage()
+		return exitUsage
+	}
+	if _, ok := conflictPolicies[c.conflict]; !ok {
+		fmt.Fprintf(stderr, "fsync %s: unknown conflict policy %q\n", args[0], c.conflict)
+		return exitUsage
+	}
+
+	code, err := c.open(ctx, exec)
+	if err != nil {
+		fmt.Fprintf(stderr, "fsync %s: %s\n", args[0], err)
+		return exitError
+	}
+	return code
+}
+
+// open opens the file systems around the execution of the command
+func (c *command) open(ctx context.Context, exec func(ctx context.Context, c *command) (int, error)) (code int, err error) {
+	c.local, err = localfs.New(c.flags.Arg(0), &localfs.Options{JournalPath: c.journal, UseTrash: c.trash})
+	if err != nil {
+		return exitError, err
+	}
+	defer func() {
+		if cErr := c.local.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}()
+
+	if c.remote, err = newDirRemoteFS(c.flags.Arg(1)); err != nil {
+		return exitError, err
+	}
+
+	return exec(ctx, c)
+}
+
+func (c *command) newProvider(takeDecision fsync.DecisionCallback) fsync.Provider {
+	opts := &fsync.Options{
+		DetectMoves:    c.detectMoves,
+		ConflictPolicy: conflictPolicies[c.conflict],
+	}
+	if !c.force {
+		opts.MassDeletionGuard = &fsync.MassDeletionGuard{
+			MaxDeletionPercent: maxDeletionPercent,
+			MinItemsForPercent: minItemsForPercent,
+		}
+	}
+	return fsync.NewProvider(c.local, c.remote, takeDecision, opts)
+}
+
+// plan prints the decisions needed to sync the directories
+func plan(ctx context.Context, c *command) (int, error) {
+	p := c.newProvider(func(ctx context.Context, d fsync.Decision) error { return ctx.Err() })
+	pl, err := p.Plan(ctx, "/")
+	if err != nil {
+		return exitError, err
+	}
+
+	if c.json {
+		fmt.Fprintln(c.stdout, pl.ToJSONString())
+		return exitOK, nil
+	}
+	return exitOK, pl.Report().WriteTable(c.stdout)
+}
+
+// syncDirs applies the decisions and prints the applied ones with the conflicts left unresolved.
+// The exit code is exitConflicts when there are such conflicts
+func syncDirs(ctx context.Context, c *command) (int, error) {
+	r := fsync.NewReport("/")
+	conflicts := 0
+	e := fsync.NewExecutor(c.local, c.remote, func(ctx context.Context, res fsync.ExecutionResult) error {
+		if !res.Applied {
+			if res.Decision.Flag != fsync.DecisionConflict {
+				return nil
+			}
+			conflicts++
+		}
+		return r.Add(ctx, res.Decision)
+	}, nil)
+
+	if err := c.newProvider(e.Execute).DoInitialSync(ctx); err != nil {
+		return exitError, err
+	}
+
+	code := exitOK
+	if conflicts > 0 {
+		code = exitConflicts
+	}
+
+	if c.json {
+		fmt.Fprintln(c.stdout, r.ToJSONString())
+		return code, nil
+	}
+	if err := r.WriteTable(c.stdout); err != nil {
+		return exitError, err
+	}
+	if conflicts > 0 {
+		fmt.Fprintf(c.stdout, "%d conflicts not resolved, see -conflict\n", conflicts)
+	}
+	return code, nil
+}
+
+// status lists the local items which are not commited
+func status(ctx context.Context, c *command) (int, error) {
+	pending := fsync.LocalItems{}
+	var walk func(itemPath string) error
+	walk = func(itemPath string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		lis, err := c.local.GetChildren(itemPath)
+		if err != nil {
+			return err
+		}
+		for _, li := range lis {
+			if li.Commited != fsync.CommitedYes {
+				pending = append(pending, li)
+			}
+			if li.Dir {
+				if err := walk(li.RelativePath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return exitError, err
+	}
+
+	if c.json {
+		type statusItem struct {
+			RelativePath string `json:"relative_path"`
+			Dir          bool   `json:"dir"`
+			Commited     string `json:"commited"`
+		}
+		items := make([]statusItem, 0, len(pending))
+		for _, li := range pending {
+			items = append(items, statusItem{RelativePath: li.RelativePath, Dir: li.Dir, Commited: li.Commited.ToString()})
+		}
+		return exitOK, json.NewEncoder(c.stdout).Encode(items)
+	}
+
+	for _, li := range pending {
+		fmt.Fprintf(c.stdout, "%-30s %s\n", li.Commited.ToString(), li.RelativePath)
+	}
+	fmt.Fprintf(c.stdout, "%d local items not commited\n", len(pending))
+	return exitOK, nil
+}
+
+// checkDecision tells if a decision is still valid. The exit code is exitObsolete when it is not
+func checkDecision(ctx context.Context, c *command) (int, error) {
+	data := c.flags.Arg(2)
+	if data == "-" {
+		b, err := io.ReadAll(c.stdin)
+		if err != nil {
+			return exitError, err
+		}
+		data = string(b)
+	}
+
+	d, err := parseDecision(data)
+	if err != nil {
+		return exitError, err
+	}
+
+	err, ok := c.newProvider(func(ctx context.Context, d fsync.Decision) error { return ctx.Err() }).CheckDecision(ctx, d)
+	if err != nil {
+		return exitError, err
+	}
+	if !ok {
+		fmt.Fprintf(c.stdout, "obsolete %s %s\n", d.Flag.ToString(), d.RelativePath)
+		return exitObsolete, nil
+	}
+	fmt.Fprintf(c.stdout, "valid %s %s\n", d.Flag.ToString(), d.RelativePath)
+	return exitOK, nil
+}
+
+// parseDecision reads a decision of the JSON output of plan
+func parseDecision(data string) (fsync.Decision, error) {
+	d := fsync.Decision{}
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		return d, fmt.Errorf("parsing the decision: %w", err)
+	}
+	return d, nil
+}
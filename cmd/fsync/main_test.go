@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func runCommand(t *testing.T, stdin string, args ...string) (int, string) {
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	t.Logf("fsync %s: %d\n%s%s", strings.Join(args, " "), code, stdout.String(), stderr.String())
+	return code, stdout.String()
+}
+
+func TestCommand(t *testing.T) {
+	local := t.TempDir()
+	remote := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "a"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(local, "a", "b"), []byte("b"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(remote, "c"), []byte("c"), 0o644))
+
+	t.Run("Usage", func(t *testing.T) {
+		code, _ := runCommand(t, "", "unknown")
+		assert.Equal(t, exitUsage, code)
+		code, _ = runCommand(t, "", "plan", local)
+		assert.Equal(t, exitUsage, code)
+		code, _ = runCommand(t, "", "plan", "-conflict", "unknown", local, remote)
+		assert.Equal(t, exitUsage, code)
+	})
+
+	var planned fsync.Plan
+	t.Run("Plan", func(t *testing.T) {
+		code, out := runCommand(t, "", "plan", "-json", local, remote)
+		assert.Equal(t, exitOK, code)
+
+		var err error
+		planned, err = fsync.ParsePlan(out)
+		require.NoError(t, err)
+		assert.Equal(t, 3, len(planned.Decisions))
+
+		code, out = runCommand(t, "", "plan", local, remote)
+		assert.Equal(t, exitOK, code)
+		assert.Equal(t, true, strings.Contains(out, "Total                    3"))
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		code, out := runCommand(t, "", "status", local, remote)
+		assert.Equal(t, exitOK, code)
+		assert.Equal(t, true, strings.Contains(out, "2 local items not commited"))
+	})
+
+	t.Run("Check decision", func(t *testing.T) {
+		data, err := json.Marshal(planned.Decisions[0])
+		require.NoError(t, err)
+		code, out := runCommand(t, string(data), "check-decision", local, remote, "-")
+		assert.Equal(t, exitOK, code)
+		assert.Equal(t, true, strings.HasPrefix(out, "valid"))
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		code, _ := runCommand(t, "", "sync", local, remote)
+		assert.Equal(t, exitOK, code)
+
+		data, err := os.ReadFile(filepath.Join(remote, "a", "b"))
+		require.NoError(t, err)
+		assert.Equal(t, "b", string(data))
+		data, err = os.ReadFile(filepath.Join(local, "c"))
+		require.NoError(t, err)
+		assert.Equal(t, "c", string(data))
+
+		code, out := runCommand(t, "", "status", "-json", local, remote)
+		assert.Equal(t, exitOK, code)
+		assert.Equal(t, "[]\n", out)
+
+		code, out = runCommand(t, "", "sync", "-json", local, remote)
+		assert.Equal(t, exitOK, code)
+		r := fsync.Report{}
+		require.NoError(t, json.Unmarshal([]byte(out), &r))
+		assert.Equal(t, 0, r.Total)
+	})
+
+	t.Run("Missing remote", func(t *testing.T) {
+		code, _ := runCommand(t, "", "sync", local, filepath.Join(remote, "typo"))
+		assert.Equal(t, exitError, code)
+		_, err := os.Stat(filepath.Join(remote, "typo"))
+		assert.Equal(t, true, os.IsNotExist(err))
+	})
+
+	t.Run("Obsolete decision", func(t *testing.T) {
+		data, err := json.Marshal(planned.Decisions[0])
+		require.NoError(t, err)
+		code, out := runCommand(t, "", "check-decision", local, remote, string(data))
+		assert.Equal(t, exitObsolete, code)
+		assert.Equal(t, true, strings.HasPrefix(out, "obsolete"))
+	})
+}
+
+func TestDirRemoteFSAbort(t *testing.T) {
+	root := t.TempDir()
+	r, err := newDirRemoteFS(root)
+	require.NoError(t, err)
+
+	w, err := r.Create("/a")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("partial"))
+	require.NoError(t, err)
+	require.NoError(t, w.(fsync.WriteAborter).Abort())
+
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestCommandMassDeletion(t *testing.T) {
+	local := t.TempDir()
+	remote := t.TempDir()
+
+	for k := 0; k < 20; k++ {
+		require.NoError(t, os.WriteFile(filepath.Join(local, fmt.Sprintf("f%d", k)), []byte("f"), 0o644))
+	}
+	code, _ := runCommand(t, "", "sync", local, remote)
+	require.Equal(t, exitOK, code)
+
+	// The remote is emptied
+	require.NoError(t, os.RemoveAll(remote))
+	require.NoError(t, os.Mkdir(remote, 0o755))
+
+	code, _ = runCommand(t, "", "sync", local, remote)
+	assert.Equal(t, exitError, code)
+	_, err := os.Stat(filepath.Join(local, "f0"))
+	require.NoError(t, err)
+
+	code, _ = runCommand(t, "", "sync", "-force", local, remote)
+	assert.Equal(t, exitOK, code)
+	_, err = os.Stat(filepath.Join(local, "f0"))
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestCommandConflicts(t *testing.T) {
+	local := t.TempDir()
+	remote := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(local, "a"), []byte("local"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(remote, "a"), []byte("remote"), 0o644))
+
+	code, out := runCommand(t, "", "sync", local, remote)
+	assert.Equal(t, exitConflicts, code)
+	assert.Equal(t, true, strings.Contains(out, "DecisionConflict"))
+	assert.Equal(t, true, strings.Contains(out, "1 conflicts not resolved"))
+
+	code, out = runCommand(t, "", "sync", "-json", local, remote)
+	assert.Equal(t, exitConflicts, code)
+	r := fsync.Report{}
+	require.NoError(t, json.Unmarshal([]byte(out), &r))
+	require.Equal(t, 1, len(r.Groups))
+	assert.Equal(t, fsync.DecisionConflict, r.Groups[0].Flag)
+	assert.Equal(t, "/a", r.Groups[0].Entries[0].RelativePath)
+
+	code, _ = runCommand(t, "", "sync", "-conflict", "remote-wins", local, remote)
+	assert.Equal(t, exitOK, code)
+	data, err := os.ReadFile(filepath.Join(local, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "remote", string(data))
+}
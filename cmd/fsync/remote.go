@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// dirRemoteFS serves an OS directory as the remote side.
+	// The etag of a file is derived from its size and modification time
+	dirRemoteFS struct {
+		root string
+	}
+
+	atomicFile struct {
+		*os.File
+		target string
+	}
+)
+
+const (
+	tmpSuffix = ".fsync.tmp"
+)
+
+// newDirRemoteFS opens the remote dir, which must exist
+func newDirRemoteFS(root string) (*dirRemoteFS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	return &dirRemoteFS{root: root}, nil
+}
+
+func (r *dirRemoteFS) osPath(itemPath string) string {
+	return filepath.Join(r.root, filepath.FromSlash(path.Clean("/"+itemPath)))
+}
+
+func toRemoteItem(itemPath string, fi os.FileInfo) fsync.RemoteItem {
+	ri := fsync.RemoteItem{
+		RelativePath: itemPath,
+		Dir:          fi.IsDir(),
+		ModTime:      fi.ModTime(),
+	}
+	if !ri.Dir {
+		ri.Size = fi.Size()
+		ri.Etag = fmt.Sprintf("%x-%x", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return ri
+}
+
+func (r *dirRemoteFS) GetChildren(itemPath string) (fsync.RemoteItems, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	des, err := os.ReadDir(r.osPath(itemPath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ret := fsync.RemoteItems{}
+	for _, de := range des {
+		if strings.HasSuffix(de.Name(), tmpSuffix) {
+			continue
+		}
+		if !de.IsDir() && !de.Type().IsRegular() {
+			// Skipping symlinks, sockets, devices...
+			continue
+		}
+
+		fi, err := de.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ret = append(ret, toRemoteItem(path.Join(itemPath, de.Name()), fi))
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+
+	return ret, nil
+}
+
+func (r *dirRemoteFS) Stat(itemPath string) (fsync.RemoteItem, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	fi, err := os.Stat(r.osPath(itemPath))
+	if err != nil {
+		return fsync.RemoteItem{}, err
+	}
+	return toRemoteItem(itemPath, fi), nil
+}
+
+func (r *dirRemoteFS) Open(itemPath string) (io.ReadCloser, error) {
+	return os.Open(r.osPath(itemPath))
+}
+
+// Create returns a writer on a temporary file which is renamed to the item path on Close
+func (r *dirRemoteFS) Create(itemPath string) (io.WriteCloser, error) {
+	osPath := r.osPath(itemPath)
+	if err := os.MkdirAll(filepath.Dir(osPath), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(osPath), "."+filepath.Base(osPath)+".*"+tmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{File: f, target: osPath}, nil
+}
+
+func (r *dirRemoteFS) Mkdir(itemPath string) error {
+	return os.MkdirAll(r.osPath(itemPath), 0o755)
+}
+
+func (r *dirRemoteFS) Remove(itemPath string) error {
+	if path.Clean("/"+itemPath) == "/" {
+		return fmt.Errorf("cannot remove the remote root")
+	}
+	return os.RemoveAll(r.osPath(itemPath))
+}
+
+func (r *dirRemoteFS) Move(fromPath, toPath string) error {
+	if err := os.MkdirAll(filepath.Dir(r.osPath(toPath)), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(r.osPath(fromPath), r.osPath(toPath))
+}
+
+func (f *atomicFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	// Replacing a dir by a file
+	if fi, err := os.Stat(f.target); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(f.target); err != nil {
+			os.Remove(f.File.Name())
+			return err
+		}
+	}
+
+	if err := os.Rename(f.File.Name(), f.target); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Abort removes the temporary file without replacing the target
+func (f *atomicFile) Abort() error {
+	defer os.Remove(f.File.Name())
+	return f.File.Close()
+}
@@ -2,52 +2,83 @@ package fsync
 
 import "strings"
 
+// Less orders the decisions so that a dir is created before its sub-items and deleted after them.
+// It sorts the decisions by the key returned by sortKey: the ordering is a strict weak ordering
+// whatever the order of the input
 func Less(i, j Decision) bool {
-	jChildOfI := false
-	if strings.HasPrefix(j.RelativePath, i.RelativePath) {
-		jChildOfI = true
-	} else if !strings.HasPrefix(i.RelativePath, j.RelativePath) {
-		return strings.Compare(i.RelativePath, j.RelativePath) <= 0
+	iPath, iRank := sortKey(i)
+	jPath, jRank := sortKey(j)
+	is, js := pathElements(iPath), pathElements(jPath)
+
+	for k := 0; k < len(is) && k < len(js); k++ {
+		if is[k] != js[k] {
+			return is[k] < js[k]
+		}
 	}
 
-	var d Decision
-	if jChildOfI {
-		d = i
-	} else {
-		d = j
+	switch {
+	case len(is) == len(js):
+		return iRank < jRank
+	case len(is) < len(js):
+		// j is a sub-item of i
+		return iRank < 0
 	}
+	// i is a sub-item of j
+	return jRank > 0
+}
 
-	var parentAfter bool
+// sortKey returns the path by which the decision is ordered and its rank on this path.
+// A negative rank orders the decision before the decisions on the sub-items of the path
+// and a positive one after them. The ranks order the decisions on the same path
+func sortKey(d Decision) (string, int) {
 	switch d.Flag {
-	case DecisionConflict:
-		fallthrough
-	case DecisionCreateDirLocal:
-		fallthrough
-	case DecisionCreateDirRemote:
-		fallthrough
-	case DecisionUploadLocal:
-		fallthrough
-	case DecisionDownloadRemote:
-		fallthrough
-	case DecisionDeleteLocalAndDownloadRemote:
-		parentAfter = false
-	case DecisionDeleteLocal:
-		fallthrough
+	case DecisionRenameLocal:
+		// The local item is renamed before its path is reused
+		return d.FromRelativePath, -4
 	case DecisionDeleteRemote:
-		fallthrough
-	case DecisionDeleteLocalAndCreateDirLocal:
-		parentAfter = true
+		if !d.RemoteIsDir {
+			// A deleted remote file is replaced by the other decisions on its path
+			return d.RelativePath, -3
+		}
+		return d.RelativePath, 1
+	case DecisionDeleteLocal:
+		return d.RelativePath, 1
+	case DecisionDeleteLocalAndCreateDirLocal, DecisionDeleteLocalAndDownloadRemote:
+		return d.RelativePath, -2
+	case DecisionUploadLocal, DecisionDownloadRemote:
+		// A file replaces the deleted dir on its path
+		return d.RelativePath, 2
 	}
+	return d.RelativePath, -1
+}
 
-	if jChildOfI {
-		if parentAfter {
-			return false
-		}
-		return true
+func pathElements(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
 	}
+	return strings.Split(p, "/")
+}
 
-	if parentAfter {
+// isChildPath returns true if child is parent or is located under parent
+func isChildPath(child, parent string) bool {
+	if child == parent || parent == "/" {
 		return true
 	}
-	return false
+	return strings.HasPrefix(child, parent+"/")
+}
+
+// comparePaths compares the paths element by element so that a sub-tree is never split
+// by a sibling sharing the same prefix (e.g. "/a/b" < "/a-b")
+func comparePaths(a, b string) int {
+	as := strings.Split(strings.Trim(a, "/"), "/")
+	bs := strings.Split(strings.Trim(b, "/"), "/")
+
+	for k := 0; k < len(as) && k < len(bs); k++ {
+		if c := strings.Compare(as[k], bs[k]); c != 0 {
+			return c
+		}
+	}
+
+	return len(as) - len(bs)
 }
@@ -0,0 +1,48 @@
+package fsync
+
+import "fmt"
+
+type (
+	// ComparisonStrategy tells how the remote files without etag are compared.
+	// Their etag is derived from other fields and is commited locally like a regular etag
+	ComparisonStrategy int
+)
+
+const (
+	// CompareEtag only syncs the remote files with an etag
+	CompareEtag = ComparisonStrategy(iota)
+	// CompareContentHash derives the etag from the ContentHash and the HashAlgorithm.
+	// A new local file with the same content as the remote file is not a conflict
+	CompareContentHash
+	// CompareSizeModTime derives the etag from the Size and the ModTime
+	CompareSizeModTime
+)
+
+// Etag returns the etag of the remote item, or the etag derived by the strategy when it has none.
+// An empty etag means that the remote file cannot be compared
+func (s ComparisonStrategy) Etag(ri RemoteItem) string {
+	if ri.Etag != "" || ri.Dir {
+		return ri.Etag
+	}
+
+	switch s {
+	case CompareContentHash:
+		if ri.ContentHash != "" {
+			return ri.HashAlgorithm + ":" + ri.ContentHash
+		}
+	case CompareSizeModTime:
+		if !ri.ModTime.IsZero() {
+			return fmt.Sprintf("%x-%x", ri.Size, ri.ModTime.UnixNano())
+		}
+	}
+	return ""
+}
+
+// sameContent returns true when the strategy compares the hashes and both files have the same one
+func (s ComparisonStrategy) sameContent(li LocalItem, ri RemoteItem) bool {
+	return s == CompareContentHash && sameHash(li.HashAlgorithm, li.ContentHash, ri.HashAlgorithm, ri.ContentHash)
+}
+
+func sameHash(algorithm1, hash1, algorithm2, hash2 string) bool {
+	return hash1 != "" && hash1 == hash2 && algorithm1 == algorithm2
+}
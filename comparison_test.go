@@ -0,0 +1,194 @@
+package fsync_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+type (
+	// etaglessRemoteFS is a remote without etags giving the sha256 of the files
+	etaglessRemoteFS struct {
+		fsynctest.RemoteFS
+	}
+
+	// hashedLocalFS gives the sha256 of the local files
+	hashedLocalFS struct {
+		fsynctest.LocalFS
+	}
+)
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func (r etaglessRemoteFS) withoutEtag(ri fsync.RemoteItem) fsync.RemoteItem {
+	ri.Etag = ""
+	if data, ok := r.Data(ri.RelativePath); ok {
+		ri.ContentHash = sha256Hex(data)
+		ri.HashAlgorithm = "sha256"
+	}
+	return ri
+}
+
+func (r etaglessRemoteFS) GetChildren(itemPath string) (fsync.RemoteItems, error) {
+	ris, err := r.RemoteFS.GetChildren(itemPath)
+	for k := range ris {
+		ris[k] = r.withoutEtag(ris[k])
+	}
+	return ris, err
+}
+
+func (r etaglessRemoteFS) Stat(itemPath string) (fsync.RemoteItem, error) {
+	ri, err := r.RemoteFS.Stat(itemPath)
+	return r.withoutEtag(ri), err
+}
+
+func (l hashedLocalFS) withHash(li fsync.LocalItem) fsync.LocalItem {
+	if data, ok := l.Data(li.RelativePath); ok && li.Commited != fsync.CommitedAwaitingRemoteDeletion {
+		li.ContentHash = sha256Hex(data)
+		li.HashAlgorithm = "sha256"
+	}
+	return li
+}
+
+func (l hashedLocalFS) GetChildren(itemPath string) (fsync.LocalItems, error) {
+	lis, err := l.LocalFS.GetChildren(itemPath)
+	for k := range lis {
+		lis[k] = l.withHash(lis[k])
+	}
+	return lis, err
+}
+
+func (l hashedLocalFS) Stat(itemPath string) (fsync.LocalItem, error) {
+	li, err := l.LocalFS.Stat(itemPath)
+	return l.withHash(li), err
+}
+
+func TestComparisonStrategy(t *testing.T) {
+	modTime := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	remoteStatus := fsync.RemoteItems{
+		{RelativePath: "/a", Dir: true},
+		{RelativePath: "/a/b", Size: 3, ModTime: modTime, ContentHash: "ab12", HashAlgorithm: "sha256"},
+		{RelativePath: "/c", Size: 5, ModTime: modTime},
+	}
+
+	t.Run("Files without etag are skipped", func(t *testing.T) {
+		testScenario(t, fsync.LocalItems{}, remoteStatus, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirLocal},
+		})
+	})
+
+	t.Run("Content hash", func(t *testing.T) {
+		testScenarioWithOptions(t, fsync.LocalItems{}, remoteStatus, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirLocal},
+			{RelativePath: "/a/b", Flag: fsync.DecisionDownloadRemote},
+		}, &fsync.Options{Comparison: fsync.CompareContentHash})
+	})
+
+	t.Run("New local files do not replace files without etag", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/c", Commited: fsync.CommitedNo},
+		}
+		testScenario(t, localStatus, remoteStatus, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirLocal},
+			{RelativePath: "/c", Flag: fsync.DecisionConflict},
+		})
+	})
+
+	t.Run("Size and modification time", func(t *testing.T) {
+		testScenarioWithOptions(t, fsync.LocalItems{}, remoteStatus, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirLocal},
+			{RelativePath: "/a/b", Flag: fsync.DecisionDownloadRemote},
+			{RelativePath: "/c", Flag: fsync.DecisionDownloadRemote},
+		}, &fsync.Options{Comparison: fsync.CompareSizeModTime})
+	})
+
+	t.Run("Derived etags are commited", func(t *testing.T) {
+		hashEtag := fsync.CompareContentHash.Etag(remoteStatus[1])
+		assert.Equal(t, "sha256:ab12", hashEtag)
+		assert.Equal(t, "", fsync.CompareContentHash.Etag(remoteStatus[2]))
+		assert.Equal(t, "", fsync.CompareEtag.Etag(remoteStatus[1]))
+
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+			{RelativePath: "/a/b", Etag: hashEtag, Commited: fsync.CommitedYes},
+			{RelativePath: "/c", Etag: "old", Commited: fsync.CommitedYes},
+		}
+		testScenarioWithOptions(t, localStatus, remoteStatus, []fsync.Decision{}, &fsync.Options{Comparison: fsync.CompareContentHash})
+		testScenarioWithOptions(t, localStatus, remoteStatus, []fsync.Decision{
+			{RelativePath: "/a/b", Flag: fsync.DecisionDownloadRemote},
+			{RelativePath: "/c", Flag: fsync.DecisionDownloadRemote},
+		}, &fsync.Options{Comparison: fsync.CompareSizeModTime})
+	})
+}
+
+func TestComparisonSameContent(t *testing.T) {
+	l := hashedLocalFS{fsynctest.NewLocalFS()}
+	r := etaglessRemoteFS{fsynctest.NewRemoteFS()}
+	l.Write("/same", "data")
+	r.Write("/same", "data")
+	l.Write("/different", "local data")
+	r.Write("/different", "remote data")
+
+	decisions := fsynctest.Decisions(t, l, r, &fsync.Options{Comparison: fsync.CompareContentHash})
+	require.Equal(t, 2, len(decisions))
+	assert.Equal(t, "/different", decisions[0].RelativePath)
+	assert.Equal(t, fsync.DecisionConflict, decisions[0].Flag)
+	assert.Equal(t, "/same", decisions[1].RelativePath)
+	assert.Equal(t, fsync.DecisionDownloadRemote, decisions[1].Flag)
+
+	decisions = fsynctest.Decisions(t, l, r, &fsync.Options{Comparison: fsync.CompareSizeModTime})
+	require.Equal(t, 2, len(decisions))
+	assert.Equal(t, fsync.DecisionConflict, decisions[1].Flag)
+}
+
+func TestComparisonExecutor(t *testing.T) {
+	for _, comparison := range []fsync.ComparisonStrategy{fsync.CompareContentHash, fsync.CompareSizeModTime} {
+		for _, base := range []bool{false, true} {
+			l := hashedLocalFS{fsynctest.NewLocalFS()}
+			r := etaglessRemoteFS{fsynctest.NewRemoteFS()}
+			opts := &fsync.Options{Comparison: comparison}
+			execOpts := &fsync.ExecutorOptions{Comparison: comparison}
+			if base {
+				opts.Base = fsync.NewBaseSnapshot()
+				execOpts.Base = opts.Base
+			}
+
+			runSync := func() int {
+				applied := 0
+				e := fsync.NewExecutor(l, r, func(ctx context.Context, res fsync.ExecutionResult) error {
+					require.NoError(t, res.Err)
+					applied++
+					return nil
+				}, execOpts)
+				require.NoError(t, fsync.NewProvider(l, r, e.Execute, opts).DoInitialSync(context.Background()))
+				return applied
+			}
+
+			l.Write("/a", "local a")
+			r.Write("/b", "remote b")
+			require.NoError(t, r.Mkdir("/c"))
+			assert.Equal(t, 3, runSync())
+			assert.Equal(t, 0, runSync())
+
+			r.Write("/a", "remote a")
+			l.Write("/b", "local b")
+			assert.Equal(t, 2, runSync())
+			assert.Equal(t, 0, runSync())
+
+			data, _ := l.Data("/a")
+			assert.Equal(t, "remote a", data)
+			data, _ = r.Data("/b")
+			assert.Equal(t, "local b", data)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package fsync_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+// slowRemoteFS simulates the listing latency of a remote and records the parallel listings
+type slowRemoteFS struct {
+	remoteFS
+	latency time.Duration
+
+	mu          sync.Mutex
+	running     int
+	maxRunning  int
+	listedPaths map[string]int
+}
+
+func (r *slowRemoteFS) GetChildren(relativePath string) (fsync.RemoteItems, error) {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.maxRunning {
+		r.maxRunning = r.running
+	}
+	r.listedPaths[relativePath]++
+	r.mu.Unlock()
+
+	time.Sleep(r.latency)
+
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+
+	return r.remoteFS.GetChildren(relativePath)
+}
+
+func newTree(dirs, files int) (fsync.LocalItems, fsync.RemoteItems) {
+	lst := fsync.LocalItems{}
+	rst := fsync.RemoteItems{}
+	for d := 0; d < dirs; d++ {
+		dir := fmt.Sprintf("/d%02d", d)
+		lst = append(lst, fsync.LocalItem{RelativePath: dir, Dir: true, Commited: fsync.CommitedYes})
+		rst = append(rst, fsync.RemoteItem{RelativePath: dir, Dir: true})
+		for s := 0; s < 2; s++ {
+			sub := fmt.Sprintf("%s/s%d", dir, s)
+			rst = append(rst, fsync.RemoteItem{RelativePath: sub, Dir: true})
+			for f := 0; f < files; f++ {
+				rst = append(rst, fsync.RemoteItem{RelativePath: fmt.Sprintf("%s/f%d", sub, f), Etag: "v1"})
+			}
+		}
+	}
+	return lst, rst
+}
+
+func TestConcurrency(t *testing.T) {
+	lst, rst := newTree(10, 3)
+
+	runSync := func(t *testing.T, concurrency int) ([]fsync.Decision, *slowRemoteFS) {
+		lFS := localFS{status: lst}
+		rFS := slowRemoteFS{remoteFS: remoteFS{status: rst}, latency: 5 * time.Millisecond, listedPaths: map[string]int{}}
+
+		decisions := []fsync.Decision{}
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			decisions = append(decisions, d)
+			return nil
+		}, &fsync.Options{Concurrency: concurrency})
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		return decisions, &rFS
+	}
+
+	sequential, rFS := runSync(t, 0)
+	assert.Equal(t, 1, rFS.maxRunning)
+	assert.Equal(t, 10*2*4, len(sequential))
+
+	t.Run("Decisions are taken in the sequential order", func(t *testing.T) {
+		for k := 0; k < 5; k++ {
+			decisions, rFS := runSync(t, 4)
+			assert.DeepEqual(t, sequential, decisions)
+
+			assert.Equal(t, true, rFS.maxRunning > 1)
+			assert.Equal(t, true, rFS.maxRunning <= 4)
+			for p, n := range rFS.listedPaths {
+				assert.Equal(t, 1, n, p)
+			}
+		}
+	})
+
+	t.Run("Look-ahead is bounded", func(t *testing.T) {
+		rst := fsync.RemoteItems{}
+		for d := 0; d < 200; d++ {
+			rst = append(rst, fsync.RemoteItem{RelativePath: fmt.Sprintf("/d%03d", d), Dir: true})
+		}
+		rFS := slowRemoteFS{remoteFS: remoteFS{status: rst}, latency: time.Millisecond, listedPaths: map[string]int{}}
+
+		listed := -1
+		p := fsync.NewProvider(&localFS{}, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			if listed < 0 {
+				// The traversal is paused on its first decision
+				time.Sleep(100 * time.Millisecond)
+				rFS.mu.Lock()
+				listed = len(rFS.listedPaths)
+				rFS.mu.Unlock()
+			}
+			return nil
+		}, &fsync.Options{Concurrency: 2})
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		assert.Equal(t, true, listed <= 1+4*2, listed)
+	})
+
+	t.Run("Skipped subtrees are not listed", func(t *testing.T) {
+		rst := fsync.RemoteItems{}
+		for d := 0; d < 200; d++ {
+			rst = append(rst, fsync.RemoteItem{RelativePath: fmt.Sprintf("/d%03d", d), Dir: true})
+		}
+		rFS := slowRemoteFS{remoteFS: remoteFS{status: rst}, latency: time.Millisecond, listedPaths: map[string]int{}}
+
+		p := fsync.NewProvider(&localFS{}, &rFS, nil, &fsync.Options{
+			Concurrency: 2,
+			Ignore:      &fsync.IgnoreRules{Patterns: []string{"d*"}},
+		})
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		assert.Equal(t, true, len(rFS.listedPaths) <= 1+4*2, len(rFS.listedPaths))
+	})
+
+	t.Run("Unchanged subtrees are not listed", func(t *testing.T) {
+		lst := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes, TreeHash: "t1"},
+			{RelativePath: "/a/b", Etag: "b", Commited: fsync.CommitedYes},
+			{RelativePath: "/c", Dir: true, Commited: fsync.CommitedYes, TreeHash: "t1"},
+			{RelativePath: "/c/d", Etag: "d", Commited: fsync.CommitedYes},
+		}
+		rst := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: true, TreeHash: "t1"},
+			{RelativePath: "/a/b", Etag: "b"},
+			{RelativePath: "/c", Dir: true, TreeHash: "t2"},
+			{RelativePath: "/c/d", Etag: "d"},
+		}
+		rFS := slowRemoteFS{remoteFS: remoteFS{status: rst}, latency: time.Millisecond, listedPaths: map[string]int{}}
+
+		p := fsync.NewProvider(&localFS{status: lst}, &rFS, nil, &fsync.Options{Concurrency: 2})
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		assert.DeepEqual(t, map[string]int{"/": 1, "/c": 1}, rFS.listedPaths)
+	})
+
+	t.Run("Cancelling stops the traversal", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		lFS := localFS{status: lst}
+		rFS := slowRemoteFS{remoteFS: remoteFS{status: rst}, latency: 5 * time.Millisecond, listedPaths: map[string]int{}}
+
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			cancel()
+			return nil
+		}, &fsync.Options{Concurrency: 4})
+		require.ErrorIs(t, p.DoInitialSync(ctx), context.Canceled)
+
+		// No listing runs once the traversal returned
+		rFS.mu.Lock()
+		defer rFS.mu.Unlock()
+		assert.Equal(t, 0, rFS.running)
+	})
+}
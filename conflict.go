@@ -0,0 +1,266 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ConflictPolicy transforms a DecisionConflict into follow-up decisions.
+	// Returning the conflict itself leaves it unresolved
+	ConflictPolicy interface {
+		Resolve(ctx context.Context, conflict Decision) ([]Decision, error)
+	}
+
+	ConflictPolicyFunc func(ctx context.Context, conflict Decision) ([]Decision, error)
+
+	// itemExistsFunc tells if a path is used on the local or the remote file system
+	itemExistsFunc func(ctx context.Context, relativePath string) (bool, error)
+
+	itemExistsKey struct{}
+
+	localStater interface {
+		Stat(itemPath string) (LocalItem, error)
+	}
+
+	remoteStater interface {
+		Stat(itemPath string) (RemoteItem, error)
+	}
+)
+
+const (
+	// maxConflictCopies bounds the numbered names tried for a conflict copy
+	maxConflictCopies = 100
+)
+
+var (
+	// ConflictPolicyManual leaves the conflicts to the DecisionCallback
+	ConflictPolicyManual = ConflictPolicyFunc(func(ctx context.Context, c Decision) ([]Decision, error) {
+		return []Decision{c}, nil
+	})
+
+	// ConflictPolicyRemoteWins replaces the local item by the remote one
+	ConflictPolicyRemoteWins = ConflictPolicyFunc(func(ctx context.Context, c Decision) ([]Decision, error) {
+		return remoteWins(c), nil
+	})
+
+	// ConflictPolicyLocalWins replaces the remote item by the local one.
+	// When a local dir replaces a remote file, its sub-items are uploaded by the next sync
+	ConflictPolicyLocalWins = ConflictPolicyFunc(func(ctx context.Context, c Decision) ([]Decision, error) {
+		return localWins(c), nil
+	})
+
+	// ConflictPolicyNewestWins keeps the item with the newest ModTime.
+	// The conflict is left unresolved when a ModTime is missing or both are equal
+	ConflictPolicyNewestWins = ConflictPolicyFunc(func(ctx context.Context, c Decision) ([]Decision, error) {
+		lt, rt := c.Why.LocalItemModTime, c.Why.RemoteItemModTime
+		switch {
+		case lt.IsZero() || rt.IsZero() || lt.Equal(rt):
+			return []Decision{c}, nil
+		case lt.After(rt):
+			return localWins(c), nil
+		}
+		return remoteWins(c), nil
+	})
+
+	// ConflictPolicyKeepBoth renames the local item to a conflict copy and takes the remote item
+	ConflictPolicyKeepBoth = NewConflictPolicyKeepBoth(ConflictCopyPath)
+)
+
+func (f ConflictPolicyFunc) Resolve(ctx context.Context, conflict Decision) ([]Decision, error) {
+	return f(ctx, conflict)
+}
+
+// NewConflictPolicyKeepBoth renames the local item with rename and takes the remote item.
+// rename must be deterministic for CheckDecision to validate the decisions.
+// When the new path is used on either side, a number is added to it (e.g. "name (conflict copy 2).ext").
+// The conflict is left unresolved when no free path is found
+func NewConflictPolicyKeepBoth(rename func(relativePath string) string) ConflictPolicy {
+	return ConflictPolicyFunc(func(ctx context.Context, c Decision) ([]Decision, error) {
+		if !c.RemoteIsDir && c.RemoteValidEtag == "" {
+			return []Decision{c}, nil
+		}
+
+		copyPath, err := freeCopyPath(ctx, rename(c.RelativePath))
+		if err != nil {
+			return nil, err
+		} else if copyPath == "" {
+			return []Decision{c}, nil
+		}
+
+		take := c
+		take.FromRelativePath = ""
+		if c.RemoteIsDir {
+			take.Flag = DecisionCreateDirLocal
+		} else {
+			take.Flag = DecisionDownloadRemote
+		}
+
+		return []Decision{
+			{
+				Flag:             DecisionRenameLocal,
+				RelativePath:     copyPath,
+				FromRelativePath: c.RelativePath,
+				RemoteValidEtag:  c.RemoteValidEtag,
+				RemoteIsDir:      c.RemoteIsDir,
+				Why:              c.Why,
+			},
+			take,
+		}, nil
+	})
+}
+
+// ConflictCopyPath returns "/dir/name (conflict copy).ext" for "/dir/name.ext"
+func ConflictCopyPath(relativePath string) string {
+	dir, name := path.Split(relativePath)
+	base, ext := splitExt(name)
+	return dir + base + " (conflict copy)" + ext
+}
+
+// splitExt splits the extension of a file name. Hidden files like ".profile" have no extension
+func splitExt(name string) (base, ext string) {
+	ext = path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext), ext
+}
+
+// numberedPath returns the n-th candidate for a conflict copy: the path itself,
+// then "/dir/name (conflict copy 2).ext" or "/dir/name (2).ext" when the name does not end with a parenthesis
+func numberedPath(relativePath string, n int) string {
+	if n == 1 {
+		return relativePath
+	}
+	dir, name := path.Split(relativePath)
+	base, ext := splitExt(name)
+	if strings.HasSuffix(base, ")") {
+		return dir + strings.TrimSuffix(base, ")") + " " + strconv.Itoa(n) + ")" + ext
+	}
+	return dir + base + " (" + strconv.Itoa(n) + ")" + ext
+}
+
+// freeCopyPath returns the first numbered path which is used on neither side, or "" when there is none.
+// The paths are not checked when the policy is not called by a provider
+func freeCopyPath(ctx context.Context, copyPath string) (string, error) {
+	exists, _ := ctx.Value(itemExistsKey{}).(itemExistsFunc)
+	if exists == nil {
+		return copyPath, nil
+	}
+
+	for n := 1; n <= maxConflictCopies; n++ {
+		candidate := numberedPath(copyPath, n)
+		used, err := exists(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return candidate, nil
+		}
+	}
+	return "", nil
+}
+
+// itemExists returns true when the path is used on the local or the remote file system.
+// The parent dir is listed when the file system cannot stat its items
+func (p *provider) itemExists(ctx context.Context, relativePath string) (bool, error) {
+	var err error
+	if s, ok := p.local.(localStater); ok {
+		_, err = s.Stat(relativePath)
+	} else {
+		var lis LocalItems
+		lis, _, err = p.listLocal(ctx, path.Dir(relativePath), map[string]bool{relativePath: true})
+		if err == nil && len(lis) == 0 {
+			err = fs.ErrNotExist
+		}
+	}
+	if err == nil {
+		return true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	if s, ok := p.remote.(remoteStater); ok {
+		_, err = s.Stat(relativePath)
+	} else {
+		var ris RemoteItems
+		ris, _, err = p.listRemote(ctx, path.Dir(relativePath), map[string]bool{relativePath: true})
+		if err == nil && len(ris) == 0 {
+			err = fs.ErrNotExist
+		}
+	}
+	if err == nil {
+		return true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return false, nil
+}
+
+func remoteWins(c Decision) []Decision {
+	d := c
+	switch {
+	case c.RemoteIsDir && c.Why.LocalItemDir:
+		return []Decision{c}
+	case c.RemoteIsDir:
+		d.Flag = DecisionDeleteLocalAndCreateDirLocal
+	case c.RemoteValidEtag == "":
+		// Nothing to download
+		return []Decision{c}
+	case c.Why.LocalItemDir:
+		d.Flag = DecisionDeleteLocalAndDownloadRemote
+	default:
+		d.Flag = DecisionDownloadRemote
+	}
+	return []Decision{d}
+}
+
+func localWins(c Decision) []Decision {
+	d := c
+	switch {
+	case c.RemoteIsDir && c.Why.LocalItemDir:
+		return []Decision{c}
+	case c.RemoteIsDir || c.Why.LocalItemDir:
+		// The remote item must be deleted before being replaced
+		del := c
+		del.Flag = DecisionDeleteRemote
+		if c.Why.LocalItemDir {
+			d.Flag = DecisionCreateDirRemote
+		} else {
+			d.Flag = DecisionUploadLocal
+		}
+		return []Decision{del, d}
+	default:
+		d.Flag = DecisionUploadLocal
+	}
+	return []Decision{d}
+}
+
+// resolveConflicts wraps the callback so that the conflicts are sent through the conflict policy
+func (p *provider) resolveConflicts(takeDecision DecisionCallback) DecisionCallback {
+	if p.conflictPolicy == nil {
+		return takeDecision
+	}
+
+	return func(ctx context.Context, d Decision) error {
+		if d.Flag != DecisionConflict {
+			return takeDecision(ctx, d)
+		}
+
+		ds, err := p.conflictPolicy.Resolve(context.WithValue(ctx, itemExistsKey{}, itemExistsFunc(p.itemExists)), d)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range ds {
+			if err := takeDecision(ctx, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
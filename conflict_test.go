@@ -0,0 +1,238 @@
+package fsync_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func testScenarioPolicy(t *testing.T, lst fsync.LocalItems, rst fsync.RemoteItems, expectedDecisions []fsync.Decision, policy fsync.ConflictPolicy) {
+	testScenarioWithOptions(t, lst, rst, expectedDecisions, &fsync.Options{
+		ConflictPolicy: policy,
+	})
+}
+
+func TestConflictPolicies(t *testing.T) {
+	now := time.Now()
+
+	// Both files were modified since the last sync
+	filesLocal := fsync.LocalItems{
+		{RelativePath: "/a.txt", Dir: false, Etag: "v1", Commited: fsync.CommitedNo, ModTime: now},
+	}
+	filesRemote := fsync.RemoteItems{
+		{RelativePath: "/a.txt", Dir: false, Etag: "v2", ModTime: now.Add(-time.Minute)},
+	}
+
+	// A new local dir and a new remote file
+	dirFileLocal := fsync.LocalItems{
+		{RelativePath: "/a", Dir: true, Commited: fsync.CommitedNo},
+		{RelativePath: "/a/b", Dir: false, Commited: fsync.CommitedNo},
+	}
+	dirFileRemote := fsync.RemoteItems{
+		{RelativePath: "/a", Dir: false, Etag: "v1"},
+	}
+
+	t.Run("Manual", func(t *testing.T) {
+		testScenarioPolicy(t, filesLocal, filesRemote, []fsync.Decision{
+			{RelativePath: "/a.txt", Flag: fsync.DecisionConflict},
+		}, fsync.ConflictPolicyManual)
+	})
+
+	t.Run("Remote wins", func(t *testing.T) {
+		testScenarioPolicy(t, filesLocal, filesRemote, []fsync.Decision{
+			{RelativePath: "/a.txt", Flag: fsync.DecisionDownloadRemote},
+		}, fsync.ConflictPolicyRemoteWins)
+
+		testScenarioPolicy(t, dirFileLocal, dirFileRemote, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionDeleteLocalAndDownloadRemote},
+		}, fsync.ConflictPolicyRemoteWins)
+	})
+
+	t.Run("Local wins", func(t *testing.T) {
+		testScenarioPolicy(t, filesLocal, filesRemote, []fsync.Decision{
+			{RelativePath: "/a.txt", Flag: fsync.DecisionUploadLocal},
+		}, fsync.ConflictPolicyLocalWins)
+
+		testScenarioPolicy(t, dirFileLocal, dirFileRemote, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionDeleteRemote},
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirRemote},
+		}, fsync.ConflictPolicyLocalWins)
+	})
+
+	t.Run("Keep both", func(t *testing.T) {
+		testScenarioPolicy(t, filesLocal, filesRemote, []fsync.Decision{
+			{RelativePath: "/a (conflict copy).txt", Flag: fsync.DecisionRenameLocal},
+			{RelativePath: "/a.txt", Flag: fsync.DecisionDownloadRemote},
+		}, fsync.ConflictPolicyKeepBoth)
+
+		testScenarioPolicy(t, dirFileLocal, dirFileRemote, []fsync.Decision{
+			{RelativePath: "/a (conflict copy)", Flag: fsync.DecisionRenameLocal},
+			{RelativePath: "/a", Flag: fsync.DecisionDownloadRemote},
+		}, fsync.ConflictPolicyKeepBoth)
+	})
+
+	t.Run("Newest wins", func(t *testing.T) {
+		testScenarioPolicy(t, filesLocal, filesRemote, []fsync.Decision{
+			{RelativePath: "/a.txt", Flag: fsync.DecisionUploadLocal},
+		}, fsync.ConflictPolicyNewestWins)
+
+		// Without modification times the conflict is left unresolved
+		testScenarioPolicy(t, dirFileLocal, dirFileRemote, []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionConflict},
+		}, fsync.ConflictPolicyNewestWins)
+	})
+
+	t.Run("Policy errors are returned", func(t *testing.T) {
+		errPolicy := errors.New("policy error")
+		lFS := localFS{status: filesLocal}
+		rFS := remoteFS{status: filesRemote}
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			return nil
+		}, &fsync.Options{
+			ConflictPolicy: fsync.ConflictPolicyFunc(func(ctx context.Context, c fsync.Decision) ([]fsync.Decision, error) {
+				return nil, errPolicy
+			}),
+		})
+		require.ErrorIs(t, p.DoInitialSync(context.Background()), errPolicy)
+	})
+
+	t.Run("Resolutions are ordered in plans", func(t *testing.T) {
+		// "/a" sorts before "/a (conflict copy)" but must be downloaded after the rename
+		lFS := localFS{status: dirFileLocal}
+		rFS := remoteFS{status: dirFileRemote}
+		p := fsync.NewProvider(&lFS, &rFS, nil, &fsync.Options{ConflictPolicy: fsync.ConflictPolicyKeepBoth})
+
+		pl, err := p.Plan(context.Background(), "/")
+		require.NoError(t, err)
+		require.Equal(t, 2, len(pl.Decisions))
+		assert.Equal(t, fsync.DecisionRenameLocal, pl.Decisions[0].Flag)
+		assert.Equal(t, fsync.DecisionDownloadRemote, pl.Decisions[1].Flag)
+		assert.Equal(t, "/a", pl.Decisions[1].RelativePath)
+	})
+}
+
+func TestConflictCopyPath(t *testing.T) {
+	assert.Equal(t, "/a/b (conflict copy).txt", fsync.ConflictCopyPath("/a/b.txt"))
+	assert.Equal(t, "/a/b (conflict copy)", fsync.ConflictCopyPath("/a/b"))
+	assert.Equal(t, "/.profile (conflict copy)", fsync.ConflictCopyPath("/.profile"))
+}
+
+func TestConflictCopyCollision(t *testing.T) {
+	l := fsynctest.NewLocalFS()
+	r := fsynctest.NewRemoteFS()
+	l.Write("/a", "local")
+	r.Write("/a", "remote")
+	l.Write("/a (conflict copy)", "precious")
+	l.Write("/a (conflict copy 2)", "precious 2")
+	r.Write("/a (conflict copy 3)", "precious 3")
+
+	decisions := []fsync.Decision{}
+	p := fsync.NewProvider(l, r, func(ctx context.Context, d fsync.Decision) error {
+		if d.RelativePath == "/a" || d.FromRelativePath == "/a" {
+			decisions = append(decisions, d)
+		}
+		return nil
+	}, &fsync.Options{ConflictPolicy: fsync.ConflictPolicyKeepBoth})
+	require.NoError(t, p.DoInitialSync(context.Background()))
+
+	// The first name used on neither side is taken
+	require.Equal(t, 2, len(decisions))
+	assert.Equal(t, fsync.DecisionRenameLocal, decisions[0].Flag)
+	assert.Equal(t, "/a (conflict copy 4)", decisions[0].RelativePath)
+	for _, d := range decisions {
+		err, ok := p.CheckDecision(context.Background(), d)
+		require.NoError(t, err)
+		assert.Equal(t, true, ok)
+	}
+
+	// Custom names are numbered too
+	policy := fsync.NewConflictPolicyKeepBoth(func(relativePath string) string { return relativePath + ".bak" })
+	l.Write("/a.bak", "backup")
+	decisions = decisions[:0]
+	p = fsync.NewProvider(l, r, func(ctx context.Context, d fsync.Decision) error {
+		if d.FromRelativePath == "/a" {
+			decisions = append(decisions, d)
+		}
+		return nil
+	}, &fsync.Options{ConflictPolicy: policy})
+	require.NoError(t, p.DoInitialSync(context.Background()))
+	require.Equal(t, 1, len(decisions))
+	assert.Equal(t, "/a (2).bak", decisions[0].RelativePath)
+}
+
+func TestExecutorConflicts(t *testing.T) {
+	newConflicts := func(t *testing.T) (fsynctest.LocalFS, fsynctest.RemoteFS) {
+		lFS := fsynctest.NewLocalFS()
+		lFS.Write("/a.txt", "local a")
+		require.NoError(t, lFS.Mkdir("/b"))
+		lFS.Write("/b/c", "local c")
+
+		rFS := fsynctest.NewRemoteFS()
+		rFS.Write("/a.txt", "remote a")
+		rFS.Write("/b", "remote b")
+		return lFS, rFS
+	}
+
+	// syncUntilStable syncs until no decision is taken
+	syncUntilStable := func(t *testing.T, lFS fsynctest.LocalFS, rFS fsynctest.RemoteFS, opts *fsync.Options) {
+		for k := 0; k < 3; k++ {
+			if len(syncWithExecutor(t, lFS, rFS, opts)) == 0 {
+				return
+			}
+		}
+		t.Fatal("sync is not stable")
+	}
+
+	t.Run("Remote wins", func(t *testing.T) {
+		opts := &fsync.Options{ConflictPolicy: fsync.ConflictPolicyRemoteWins}
+		lFS, rFS := newConflicts(t)
+		syncUntilStable(t, lFS, rFS, opts)
+
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+		assert.Equal(t, "remote a", content(lFS, "/a.txt"))
+		assert.Equal(t, "remote b", content(lFS, "/b"))
+	})
+
+	t.Run("Local wins", func(t *testing.T) {
+		opts := &fsync.Options{ConflictPolicy: fsync.ConflictPolicyLocalWins}
+		lFS, rFS := newConflicts(t)
+		syncUntilStable(t, lFS, rFS, opts)
+
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+		assert.Equal(t, "local a", content(rFS, "/a.txt"))
+		assert.Equal(t, "local c", content(rFS, "/b/c"))
+	})
+
+	t.Run("Keep both", func(t *testing.T) {
+		opts := &fsync.Options{ConflictPolicy: fsync.ConflictPolicyKeepBoth}
+		lFS, rFS := newConflicts(t)
+		syncUntilStable(t, lFS, rFS, opts)
+
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+		assert.Equal(t, "remote a", content(rFS, "/a.txt"))
+		assert.Equal(t, "local a", content(rFS, "/a (conflict copy).txt"))
+		assert.Equal(t, "remote b", content(rFS, "/b"))
+		assert.Equal(t, "local c", content(rFS, "/b (conflict copy)/c"))
+	})
+
+	t.Run("Keep both with an existing copy", func(t *testing.T) {
+		opts := &fsync.Options{ConflictPolicy: fsync.ConflictPolicyKeepBoth}
+		lFS, rFS := newConflicts(t)
+		lFS.Write("/a (conflict copy).txt", "precious local")
+		rFS.Write("/b (conflict copy)", "precious remote")
+		syncUntilStable(t, lFS, rFS, opts)
+
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+		assert.Equal(t, "remote a", content(lFS, "/a.txt"))
+		assert.Equal(t, "precious local", content(rFS, "/a (conflict copy).txt"))
+		assert.Equal(t, "local a", content(rFS, "/a (conflict copy 2).txt"))
+		assert.Equal(t, "precious remote", content(lFS, "/b (conflict copy)"))
+		assert.Equal(t, "local c", content(rFS, "/b (conflict copy 2)/c"))
+	})
+}
@@ -3,6 +3,9 @@ package fsync
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
 )
 
 type (
@@ -10,6 +13,11 @@ type (
 		CheckChanges(ctx context.Context, rPath string) error
 		DoInitialSync(ctx context.Context) error
 		CheckDecision(ctx context.Context, d Decision) (err error, ok bool)
+		Plan(ctx context.Context, rPath string) (Plan, error)
+		LocalChange(item LocalItem)
+		RemoteChange(item RemoteItem)
+		Run(ctx context.Context) error
+		SetExcludedPaths(excludedPaths []string)
 	}
 
 	provider struct {
@@ -19,9 +27,25 @@ type (
 		takeDecision DecisionCallback
 		localChange  chan (LocalItem)
 		remoteChange chan (RemoteItem)
+		changeDelay  time.Duration
+		retryDelay   time.Duration
+		onRunError   func(ctx context.Context, err error)
 
 		remoteFSDeleteNonEmptyFolder bool
 		localFSDeleteNonEmptyFolder  bool
+		detectMoves                  bool
+		conflictPolicy               ConflictPolicy
+		concurrency                  int
+		ignore                       *ignoreMatcher
+		ignoreFileName               string
+
+		excludedMu    sync.RWMutex
+		excludedPaths []string
+
+		massDeletionGuard *MassDeletionGuard
+		base              BaseStore
+		comparison        ComparisonStrategy
+		continueOnError   bool
 	}
 
 	Options struct {
@@ -29,18 +53,73 @@ type (
 		RemoteFSDeleteNonEmptyFolder bool
 		// LocalFSDeleteNonEmptyFolder allows to delete the folder instead of all items + folder to avoid huge calls
 		LocalFSDeleteNonEmptyFolder bool
+		// ChangeDelay is the time Run waits for other changes before checking them
+		ChangeDelay time.Duration
+		// RetryDelay is the time Run waits before checking the changes of a failed check again.
+		// It is doubled at each consecutive failure. Defaults to one second
+		RetryDelay time.Duration
+		// OnRunError is called with the errors of the checks of Run
+		OnRunError func(ctx context.Context, err error)
+		// DetectMoves emits DecisionMoveLocal and DecisionMoveRemote for items renamed in the same dir
+		DetectMoves bool
+		// ConflictPolicy transforms every DecisionConflict into follow-up decisions
+		ConflictPolicy ConflictPolicy
+		// Concurrency is the number of dirs listed in parallel during a traversal.
+		// Decisions are still taken in the sequential order
+		Concurrency int
+		// Ignore excludes items from the synchronization
+		Ignore *IgnoreRules
+		// ExcludedPaths are the remote subtrees which are not synced locally (selective sync).
+		// They can be changed with Provider.SetExcludedPaths
+		ExcludedPaths []string
+		// MassDeletionGuard holds back the checks deleting too many items
+		MassDeletionGuard *MassDeletionGuard
+		// Base enables the three-way sync: the local changes are detected against the base snapshot
+		// instead of the CommitedFlag. The executor must be given the same base
+		Base BaseStore
+		// Comparison tells how the remote files without etag are compared.
+		// The executor must be given the same strategy
+		Comparison ComparisonStrategy
+		// ContinueOnError skips the subtrees whose listing or decision fails and keeps checking the rest.
+		// The check then returns a *SyncError with every failure
+		ContinueOnError bool
 	}
 
 	LocalFS interface {
 		GetChildren(itemPath string) (LocalItems, error)
 	}
 
+	// LocalFSPager is an optional extension of LocalFS listing the children page by page.
+	// The listing is cancelled with the context. An empty nextPageToken ends the listing
+	LocalFSPager interface {
+		GetChildrenPage(ctx context.Context, itemPath string, pageToken string) (items LocalItems, nextPageToken string, err error)
+	}
+
 	LocalItem struct {
 		RelativePath string
 		Dir          bool
 		// Etag is the Etag of the last commited item (empty for folders)
 		Etag     string
 		Commited CommitedFlag
+		// FileID optionally identifies the local item across renames (e.g. inode).
+		// Items awaiting remote deletion keep the FileID, the ModTime and the Size they had:
+		// a file renamed and modified is not detected as a move
+		FileID string
+		// ModTime is the optional last modification time
+		ModTime time.Time
+		// Size is the optional size of a file
+		Size int64
+		// ContentHash is the optional hash of the content of a file, computed with HashAlgorithm (e.g. "sha256")
+		ContentHash   string
+		HashAlgorithm string
+		// TreeHash is the optional remote TreeHash of a dir whose subtree is unchanged since it was found in sync
+		TreeHash string
+	}
+
+	// LocalFSTreeHashCommitter is an optional extension of LocalFS.
+	// CommitTreeHash is called with the remote TreeHash of a dir when its subtree is in sync
+	LocalFSTreeHashCommitter interface {
+		CommitTreeHash(itemPath string, treeHash string) error
 	}
 
 	CommitedFlag int
@@ -51,31 +130,51 @@ type (
 		GetChildren(itemPath string) (RemoteItems, error)
 	}
 
+	// RemoteFSPager is an optional extension of RemoteFS listing the children page by page.
+	// The listing is cancelled with the context. An empty nextPageToken ends the listing
+	RemoteFSPager interface {
+		GetChildrenPage(ctx context.Context, itemPath string, pageToken string) (items RemoteItems, nextPageToken string, err error)
+	}
+
 	RemoteItem struct {
 		RelativePath string
 		Dir          bool
 		Etag         string
+		// ModTime is the optional last modification time
+		ModTime time.Time
+		// Size is the optional size of a file
+		Size int64
+		// ContentHash is the optional hash of the content of a file, computed with HashAlgorithm (e.g. "sha256")
+		ContentHash   string
+		HashAlgorithm string
+		// TreeHash optionally identifies the content of a dir subtree (e.g. a folder ctag).
+		// It must change whenever an item of the subtree changes
+		TreeHash string
 	}
 
 	RemoteItems []RemoteItem
 
 	Decision struct {
-		RelativePath    string
-		Flag            DecisionFlag
-		RemoteValidEtag string
-		RemoteIsDir     bool
-		Why             DecisionWhy
+		RelativePath    string       `json:"relative_path"`
+		Flag            DecisionFlag `json:"flag"`
+		RemoteValidEtag string       `json:"remote_valid_etag"`
+		RemoteIsDir     bool         `json:"remote_is_dir"`
+		Why             DecisionWhy  `json:"why"`
+		// FromRelativePath is the source of DecisionMoveLocal, DecisionMoveRemote and DecisionRenameLocal
+		FromRelativePath string `json:"from_relative_path,omitempty"`
 	}
 
 	DecisionWhy struct {
-		LocalItemPresent  bool   `json:"local_item_present"`
-		LocalItemDir      bool   `json:"local_item_dir"`
-		LocalItemEtag     string `json:"local_item_etag"`
-		LocalItemCommited string `json:"local_item_commited"`
+		LocalItemPresent  bool      `json:"local_item_present"`
+		LocalItemDir      bool      `json:"local_item_dir"`
+		LocalItemEtag     string    `json:"local_item_etag"`
+		LocalItemCommited string    `json:"local_item_commited"`
+		LocalItemModTime  time.Time `json:"local_item_mod_time"`
 
-		RemoteItemPresent bool   `json:"remote_item_present"`
-		RemoteItemDir     bool   `json:"remote_item_dir"`
-		RemoteItemEtag    string `json:"remote_item_etag"`
+		RemoteItemPresent bool      `json:"remote_item_present"`
+		RemoteItemDir     bool      `json:"remote_item_dir"`
+		RemoteItemEtag    string    `json:"remote_item_etag"`
+		RemoteItemModTime time.Time `json:"remote_item_mod_time"`
 	}
 
 	DecisionCallback func(context.Context, Decision) error
@@ -88,6 +187,19 @@ type (
 	}
 
 	Conflicts []Conflict
+
+	// Move is an item renamed on one side
+	Move struct {
+		flag DecisionFlag
+		// li is the local item at the source path
+		li LocalItem
+		// ri is the remote item at the destination path for DecisionMoveLocal
+		// and at the source path for DecisionMoveRemote
+		ri RemoteItem
+		to string
+	}
+
+	Moves []Move
 )
 
 const (
@@ -100,6 +212,9 @@ const (
 	DecisionConflict
 	DecisionDeleteLocalAndCreateDirLocal
 	DecisionDeleteLocalAndDownloadRemote
+	DecisionMoveLocal
+	DecisionMoveRemote
+	DecisionRenameLocal
 )
 
 const (
@@ -108,12 +223,14 @@ const (
 	CommitedAwaitingRemoteDeletion
 )
 
+// LocalChange notifies Run that a local item has changed
 func (p *provider) LocalChange(item LocalItem) {
 	p.localChange <- item
 }
 
+// RemoteChange notifies Run that a remote item has changed
 func (p *provider) RemoteChange(item RemoteItem) {
-	p.remoteChange <- <-p.remoteChange
+	p.remoteChange <- item
 }
 
 func (f CommitedFlag) ToString() string {
@@ -148,10 +265,43 @@ func (d DecisionFlag) ToString() string {
 		return "DecisionDeleteLocalAndCreateDirLocal"
 	case DecisionDeleteLocalAndDownloadRemote:
 		return "DecisionDeleteLocalAndDownloadRemote"
+	case DecisionMoveLocal:
+		return "DecisionMoveLocal"
+	case DecisionMoveRemote:
+		return "DecisionMoveRemote"
+	case DecisionRenameLocal:
+		return "DecisionRenameLocal"
 	}
 	return ""
 }
 
+// ParseDecisionFlag returns the flag matching the output of DecisionFlag.ToString
+func ParseDecisionFlag(s string) (DecisionFlag, error) {
+	for d := DecisionUploadLocal; d <= DecisionRenameLocal; d++ {
+		if d.ToString() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("fsync: unknown decision flag %q", s)
+}
+
+func (d DecisionFlag) MarshalText() ([]byte, error) {
+	s := d.ToString()
+	if s == "" {
+		return nil, fmt.Errorf("fsync: unknown decision flag %d", int(d))
+	}
+	return []byte(s), nil
+}
+
+func (d *DecisionFlag) UnmarshalText(data []byte) error {
+	f, err := ParseDecisionFlag(string(data))
+	if err != nil {
+		return err
+	}
+	*d = f
+	return nil
+}
+
 func newDecisionWhy(li *LocalItem, ri *RemoteItem) DecisionWhy {
 	d := DecisionWhy{}
 
@@ -159,12 +309,14 @@ func newDecisionWhy(li *LocalItem, ri *RemoteItem) DecisionWhy {
 		d.LocalItemCommited = li.Commited.ToString()
 		d.LocalItemDir = li.Dir
 		d.LocalItemEtag = li.Etag
+		d.LocalItemModTime = li.ModTime
 		d.LocalItemPresent = true
 	}
 
 	if ri != nil {
 		d.RemoteItemDir = ri.Dir
 		d.RemoteItemEtag = ri.Etag
+		d.RemoteItemModTime = ri.ModTime
 		d.RemoteItemPresent = true
 	}
 
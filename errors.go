@@ -0,0 +1,214 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type (
+	// Side is the file system of an item
+	Side int
+
+	// ListError is returned when the children of a dir cannot be listed
+	ListError struct {
+		RelativePath string
+		Side         Side
+		Err          error
+	}
+
+	// DecisionError is returned when the DecisionCallback fails.
+	// Side is the file system changed by the decision
+	DecisionError struct {
+		RelativePath string
+		Side         Side
+		Decision     Decision
+		Err          error
+	}
+
+	// SyncError is returned by CheckChanges with Options.ContinueOnError when subtrees were skipped.
+	// Failures holds the *ListError and *DecisionError in the order of the traversal
+	SyncError struct {
+		RelativePath string
+		Failures     []error
+	}
+
+	// failures records the failed paths of a check with ContinueOnError
+	failures struct {
+		errs    []error
+		skipped []string
+	}
+
+	failuresKey struct{}
+)
+
+const (
+	SideLocal = Side(iota)
+	SideRemote
+)
+
+func (s Side) ToString() string {
+	switch s {
+	case SideLocal:
+		return "local"
+	case SideRemote:
+		return "remote"
+	}
+	return ""
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("fsync: listing %s %s: %v", e.Side.ToString(), e.RelativePath, e.Err)
+}
+
+func (e *ListError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecisionError) Error() string {
+	return fmt.Sprintf("fsync: %s on %s: %v", e.Decision.Flag.ToString(), e.RelativePath, e.Err)
+}
+
+func (e *DecisionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SyncError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, err := range e.Failures {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("fsync: checking %s: %d failures: %s", e.RelativePath, len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// Is matches the failures for errors.Is
+func (e *SyncError) Is(target error) bool {
+	for _, err := range e.Failures {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first failure matching target for errors.As
+func (e *SyncError) As(target interface{}) bool {
+	for _, err := range e.Failures {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// failedPaths returns the paths of the failures, to check them again
+func (e *SyncError) failedPaths() []string {
+	paths := []string{}
+	for _, err := range e.Failures {
+		var lErr *ListError
+		var dErr *DecisionError
+		switch {
+		case errors.As(err, &lErr):
+			paths = append(paths, lErr.RelativePath)
+		case errors.As(err, &dErr):
+			paths = append(paths, dErr.RelativePath)
+			if dErr.Decision.FromRelativePath != "" {
+				paths = append(paths, dErr.Decision.FromRelativePath)
+			}
+		}
+	}
+	return paths
+}
+
+// decisionSide returns the file system changed by the decision
+func decisionSide(f DecisionFlag) Side {
+	switch f {
+	case DecisionUploadLocal, DecisionCreateDirRemote, DecisionDeleteRemote, DecisionMoveRemote:
+		return SideRemote
+	}
+	return SideLocal
+}
+
+func failuresFrom(ctx context.Context) *failures {
+	f, _ := ctx.Value(failuresKey{}).(*failures)
+	return f
+}
+
+// add records the error and skips the subtree of relativePath
+func (f *failures) add(relativePath string, err error) {
+	f.errs = append(f.errs, err)
+	f.skipped = append(f.skipped, relativePath)
+}
+
+// count returns the number of recorded failures
+func (f *failures) count() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.errs)
+}
+
+// skips returns true when the decision is on a skipped subtree or on one of its parent dirs.
+// A parent dir is neither deleted nor recreated while the content of its skipped sub-dir is unknown
+func (f *failures) skips(d Decision) bool {
+	for _, s := range f.skipped {
+		if isChildPath(d.RelativePath, s) || isChildPath(s, d.RelativePath) {
+			return true
+		}
+		if d.FromRelativePath != "" && (isChildPath(d.FromRelativePath, s) || isChildPath(s, d.FromRelativePath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipSubtree records the failure of a check of relativePath with ContinueOnError and returns nil.
+// Otherwise, or when the context is done, the error is returned
+func skipSubtree(ctx context.Context, relativePath string, err error) error {
+	f := failuresFrom(ctx)
+	if f == nil || ctx.Err() != nil {
+		return err
+	}
+	f.add(relativePath, err)
+	return nil
+}
+
+// withFailures wraps the errors of the DecisionCallback in *DecisionError.
+// With ContinueOnError the failures are recorded in the returned context instead of stopping the check,
+// and the decisions of the failed subtrees are skipped
+func (p *provider) withFailures(ctx context.Context, takeDecision DecisionCallback) (context.Context, DecisionCallback) {
+	var f *failures
+	if p.continueOnError {
+		f = &failures{}
+		ctx = context.WithValue(ctx, failuresKey{}, f)
+	}
+
+	return ctx, func(ctx context.Context, d Decision) error {
+		if f != nil && f.skips(d) {
+			return nil
+		}
+		err := takeDecision(ctx, d)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		dErr := &DecisionError{RelativePath: d.RelativePath, Side: decisionSide(d.Flag), Decision: d, Err: err}
+		if f == nil {
+			return dErr
+		}
+		f.add(d.RelativePath, dErr)
+		if d.FromRelativePath != "" {
+			// e.g. the remote item must not replace a local item which failed to be renamed
+			f.skipped = append(f.skipped, d.FromRelativePath)
+		}
+		return nil
+	}
+}
+
+// failed returns the recorded failures of the check as a *SyncError, or nil
+func (f *failures) failed(relativePath string) error {
+	if f == nil || len(f.errs) == 0 {
+		return nil
+	}
+	return &SyncError{RelativePath: relativePath, Failures: f.errs}
+}
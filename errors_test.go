@@ -0,0 +1,161 @@
+package fsync_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+var errBroken = errors.New("broken")
+
+// syncRecording runs an initial sync recording the decisions of the callback
+func syncRecording(l fsync.LocalFS, r fsync.RemoteFS, opts *fsync.Options, failOn string) ([]fsync.Decision, error) {
+	decisions := []fsync.Decision{}
+	p := fsync.NewProvider(l, r, func(ctx context.Context, d fsync.Decision) error {
+		if d.RelativePath == failOn {
+			return errBroken
+		}
+		decisions = append(decisions, d)
+		return nil
+	}, opts)
+	return decisions, p.DoInitialSync(context.Background())
+}
+
+func TestTypedErrors(t *testing.T) {
+	t.Run("List error", func(t *testing.T) {
+		l := fsynctest.NewLocalFS()
+		r := fsynctest.NewRemoteFS(fsync.RemoteItem{RelativePath: "/a", Dir: true})
+		r.InjectError(fsynctest.OpGetChildren, "/a", errBroken)
+
+		_, err := syncRecording(l, r, nil, "")
+		require.ErrorIs(t, err, errBroken)
+		lErr := &fsync.ListError{}
+		require.True(t, errors.As(err, &lErr))
+		assert.Equal(t, "/a", lErr.RelativePath)
+		assert.Equal(t, fsync.SideRemote, lErr.Side)
+	})
+
+	t.Run("Decision error", func(t *testing.T) {
+		l := fsynctest.NewLocalFS()
+		r := fsynctest.NewRemoteFS()
+		l.Write("/a", "a")
+
+		_, err := syncRecording(l, r, nil, "/a")
+		require.ErrorIs(t, err, errBroken)
+		dErr := &fsync.DecisionError{}
+		require.True(t, errors.As(err, &dErr))
+		assert.Equal(t, "/a", dErr.RelativePath)
+		assert.Equal(t, fsync.SideRemote, dErr.Side)
+		assert.Equal(t, fsync.DecisionUploadLocal, dErr.Decision.Flag)
+	})
+}
+
+func TestContinueOnError(t *testing.T) {
+	opts := &fsync.Options{ContinueOnError: true}
+
+	t.Run("Failed listing is skipped", func(t *testing.T) {
+		l := fsynctest.NewLocalFS()
+		r := fsynctest.NewRemoteFS(
+			fsync.RemoteItem{RelativePath: "/a", Dir: true},
+			fsync.RemoteItem{RelativePath: "/a/b", Dir: true},
+			fsync.RemoteItem{RelativePath: "/a/b/c", Etag: "c"},
+			fsync.RemoteItem{RelativePath: "/a/d", Etag: "d"},
+			fsync.RemoteItem{RelativePath: "/e", Etag: "e"},
+		)
+		l.InjectError(fsynctest.OpGetChildren, "/a/b", errBroken)
+
+		decisions, err := syncRecording(l, r, opts, "")
+		sErr := &fsync.SyncError{}
+		require.True(t, errors.As(err, &sErr))
+		require.Equal(t, 1, len(sErr.Failures))
+		require.ErrorIs(t, err, errBroken)
+		lErr := &fsync.ListError{}
+		require.True(t, errors.As(err, &lErr))
+		assert.Equal(t, "/a/b", lErr.RelativePath)
+		assert.Equal(t, fsync.SideLocal, lErr.Side)
+
+		// The dir was created before the failure
+		require.Equal(t, 4, len(decisions))
+		require.True(t, IsDecisionPresent(fsync.Decision{RelativePath: "/a", Flag: fsync.DecisionCreateDirLocal}, decisions))
+		require.True(t, IsDecisionPresent(fsync.Decision{RelativePath: "/a/b", Flag: fsync.DecisionCreateDirLocal}, decisions))
+		require.True(t, IsDecisionPresent(fsync.Decision{RelativePath: "/a/d", Flag: fsync.DecisionDownloadRemote}, decisions))
+		require.True(t, IsDecisionPresent(fsync.Decision{RelativePath: "/e", Flag: fsync.DecisionDownloadRemote}, decisions))
+	})
+
+	t.Run("Parent of a failed listing is not deleted", func(t *testing.T) {
+		l := fsynctest.NewLocalFS(
+			fsync.LocalItem{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+			fsync.LocalItem{RelativePath: "/a/b", Dir: true, Commited: fsync.CommitedYes},
+			fsync.LocalItem{RelativePath: "/a/b/c", Etag: "c", Commited: fsync.CommitedYes},
+			fsync.LocalItem{RelativePath: "/d", Etag: "d", Commited: fsync.CommitedYes},
+		)
+		r := fsynctest.NewRemoteFS()
+		l.InjectError(fsynctest.OpGetChildren, "/a/b", errBroken)
+
+		decisions, err := syncRecording(l, r, opts, "")
+		require.ErrorIs(t, err, errBroken)
+		require.Equal(t, 1, len(decisions))
+		assert.Equal(t, "/d", decisions[0].RelativePath)
+		assert.Equal(t, fsync.DecisionDeleteLocal, decisions[0].Flag)
+	})
+
+	t.Run("Failed decision skips the subtree", func(t *testing.T) {
+		l := fsynctest.NewLocalFS()
+		r := fsynctest.NewRemoteFS(
+			fsync.RemoteItem{RelativePath: "/a", Dir: true},
+			fsync.RemoteItem{RelativePath: "/a/b", Etag: "b"},
+			fsync.RemoteItem{RelativePath: "/c", Etag: "c"},
+		)
+
+		decisions, err := syncRecording(l, r, opts, "/a")
+		dErr := &fsync.DecisionError{}
+		require.True(t, errors.As(err, &dErr))
+		assert.Equal(t, "/a", dErr.RelativePath)
+		assert.Equal(t, fsync.DecisionCreateDirLocal, dErr.Decision.Flag)
+
+		require.Equal(t, 1, len(decisions))
+		assert.Equal(t, "/c", decisions[0].RelativePath)
+	})
+
+	t.Run("Executed sync converges once the failure is gone", func(t *testing.T) {
+		l := fsynctest.NewLocalFS()
+		r := fsynctest.NewRemoteFS()
+		r.Write("/a/b", "b")
+		r.Write("/c", "c")
+		l.Write("/d", "d")
+		require.NoError(t, r.Mkdir("/a"))
+		r.InjectError(fsynctest.OpGetChildren, "/a", errBroken)
+
+		e := fsync.NewExecutor(l, r, nil, nil)
+		p := fsync.NewProvider(l, r, e.Execute, opts)
+		require.ErrorIs(t, p.DoInitialSync(context.Background()), errBroken)
+		data, _ := r.Data("/d")
+		assert.Equal(t, "d", data)
+		data, _ = l.Data("/c")
+		assert.Equal(t, "c", data)
+
+		r.ClearErrors()
+		require.NoError(t, p.DoInitialSync(context.Background()))
+		fsynctest.AssertConverged(t, l, r, opts)
+	})
+
+	t.Run("Cancellation is not skipped", func(t *testing.T) {
+		l := fsynctest.NewLocalFS()
+		r := fsynctest.NewRemoteFS(fsync.RemoteItem{RelativePath: "/a", Etag: "a"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		p := fsync.NewProvider(l, r, func(ctx context.Context, d fsync.Decision) error {
+			cancel()
+			return ctx.Err()
+		}, opts)
+		err := p.DoInitialSync(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+		sErr := &fsync.SyncError{}
+		require.False(t, errors.As(err, &sErr))
+	})
+}
@@ -0,0 +1,365 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type (
+	// Executor applies decisions against the local and remote file systems
+	Executor interface {
+		Execute(ctx context.Context, d Decision) error
+	}
+
+	executor struct {
+		local  LocalWriteFS
+		remote RemoteWriteFS
+
+		report          ExecutionCallback
+		continueOnError bool
+		base            BaseStore
+		comparison      ComparisonStrategy
+	}
+
+	ExecutorOptions struct {
+		// ContinueOnError reports the failed decision and keeps executing the next ones
+		ContinueOnError bool
+		// Base is updated with the applied decisions. It must be the base of the provider
+		Base BaseStore
+		// Comparison derives the etags of the remote files without one. It must be the strategy of the provider
+		Comparison ComparisonStrategy
+	}
+
+	LocalWriteFS interface {
+		LocalFS
+		Open(itemPath string) (io.ReadCloser, error)
+		Create(itemPath string) (io.WriteCloser, error)
+		// Mkdir must not fail if the directory already exists
+		Mkdir(itemPath string) error
+		// Remove deletes the item, its sub-items and their commit status.
+		// It must not fail if the item does not exist
+		Remove(itemPath string) error
+		Stat(itemPath string) (LocalItem, error)
+		// Commit marks the item as CommitedYes with the given remote etag
+		Commit(itemPath string, etag string) error
+		// Move renames the item and moves the commit status of its sub-items.
+		// When the item was already renamed (e.g. by the user) only the commit status is moved.
+		// It must fail rather than replace an existing item
+		Move(fromPath, toPath string) error
+		// Uncommit forgets the commit status of the item and its sub-items
+		// so that they are uploaded as new items
+		Uncommit(itemPath string) error
+	}
+
+	// LocalTrashFS is an optional extension of LocalWriteFS keeping the deleted local items recoverable
+	LocalTrashFS interface {
+		// MoveToTrash moves the item deleted by the decision to a trash and forgets its commit status.
+		// It must not fail if the item does not exist
+		MoveToTrash(itemPath string, d Decision) error
+	}
+
+	RemoteWriteFS interface {
+		RemoteFS
+		Open(itemPath string) (io.ReadCloser, error)
+		Create(itemPath string) (io.WriteCloser, error)
+		// Mkdir must not fail if the directory already exists
+		Mkdir(itemPath string) error
+		// Remove deletes the item and its sub-items.
+		// It must not fail if the item does not exist
+		Remove(itemPath string) error
+		Stat(itemPath string) (RemoteItem, error)
+		// Move renames the item on the server side
+		Move(fromPath, toPath string) error
+	}
+
+	// WriteAborter is an optional extension of the writers returned by Create.
+	// Abort discards the written data instead of publishing it like Close.
+	// The executor aborts the writer when the copy of the content fails
+	WriteAborter interface {
+		Abort() error
+	}
+
+	ExecutionResult struct {
+		Decision Decision
+		// Applied is false when the decision was skipped (e.g. DecisionConflict)
+		Applied bool
+		Err     error
+	}
+
+	ExecutionCallback func(context.Context, ExecutionResult) error
+)
+
+var (
+	ErrUnknownDecision = errors.New("fsync: unknown decision flag")
+)
+
+// NewExecutor creates an executor that can be used as the DecisionCallback of a provider:
+//
+//	e := fsync.NewExecutor(l, r, report, nil)
+//	p := fsync.NewProvider(l, r, e.Execute, nil)
+func NewExecutor(l LocalWriteFS, r RemoteWriteFS, report ExecutionCallback, opts *ExecutorOptions) Executor {
+	e := &executor{
+		local:  l,
+		remote: r,
+
+		report: report,
+	}
+
+	if opts != nil {
+		e.continueOnError = opts.ContinueOnError
+		e.base = opts.Base
+		e.comparison = opts.Comparison
+	}
+
+	return e
+}
+
+// Execute applies the decision and reports the result
+func (e *executor) Execute(ctx context.Context, d Decision) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	applied, err := e.apply(d)
+	if err != nil {
+		err = fmt.Errorf("executing %s on %s: %w", d.Flag.ToString(), d.RelativePath, err)
+	}
+
+	if e.report != nil {
+		if rErr := e.report(ctx, ExecutionResult{Decision: d, Applied: applied, Err: err}); rErr != nil {
+			return rErr
+		}
+	}
+
+	if err != nil && !e.continueOnError {
+		return err
+	}
+
+	return nil
+}
+
+func (e *executor) apply(d Decision) (applied bool, err error) {
+	switch d.Flag {
+	case DecisionUploadLocal:
+		return true, e.upload(d)
+	case DecisionCreateDirLocal:
+		return true, e.createDirLocal(d)
+	case DecisionCreateDirRemote:
+		return true, e.createDirRemote(d)
+	case DecisionDownloadRemote:
+		// The local item may be a dir awaiting remote deletion
+		if d.Why.LocalItemPresent && d.Why.LocalItemDir {
+			if err := e.removeLocal(d); err != nil {
+				return false, err
+			}
+		}
+		return true, e.download(d)
+	case DecisionDeleteLocal:
+		return true, e.removeLocal(d)
+	case DecisionDeleteRemote:
+		if err := e.remote.Remove(d.RelativePath); err != nil {
+			return false, err
+		}
+		if err := e.forget(d.RelativePath); err != nil {
+			return false, err
+		}
+		// Forgetting the item awaiting remote deletion.
+		// A local item replacing the remote one (resolved conflict) is kept
+		if d.Why.LocalItemCommited != CommitedAwaitingRemoteDeletion.ToString() {
+			return true, nil
+		}
+		return true, e.local.Remove(d.RelativePath)
+	case DecisionConflict:
+		// Conflicts need an external resolution
+		return false, nil
+	case DecisionDeleteLocalAndCreateDirLocal:
+		if err := e.removeLocal(d); err != nil {
+			return false, err
+		}
+		return true, e.createDirLocal(d)
+	case DecisionDeleteLocalAndDownloadRemote:
+		if err := e.removeLocal(d); err != nil {
+			return false, err
+		}
+		return true, e.download(d)
+	case DecisionMoveLocal:
+		if err := e.local.Move(d.FromRelativePath, d.RelativePath); err != nil {
+			return false, err
+		}
+		if err := e.moveBase(d.FromRelativePath, d.RelativePath); err != nil {
+			return false, err
+		}
+		return true, e.commit(d.RelativePath, d.RemoteValidEtag)
+	case DecisionMoveRemote:
+		return true, e.moveRemote(d)
+	case DecisionRenameLocal:
+		if err := e.local.Move(d.FromRelativePath, d.RelativePath); err != nil {
+			return false, err
+		}
+		if err := e.forget(d.RelativePath); err != nil {
+			return false, err
+		}
+		return true, e.local.Uncommit(d.RelativePath)
+	}
+
+	return false, ErrUnknownDecision
+}
+
+// removeLocal moves the local item to the trash when the local file system has one
+func (e *executor) removeLocal(d Decision) error {
+	if err := e.forget(d.RelativePath); err != nil {
+		return err
+	}
+
+	if t, ok := e.local.(LocalTrashFS); ok {
+		return t.MoveToTrash(d.RelativePath, d)
+	}
+
+	return e.local.Remove(d.RelativePath)
+}
+
+// commit marks the local item as synced with the remote etag and records it in the base
+func (e *executor) commit(itemPath string, etag string) error {
+	if err := e.local.Commit(itemPath, etag); err != nil {
+		return err
+	}
+	if e.base == nil {
+		return nil
+	}
+
+	li, err := e.local.Stat(itemPath)
+	if err != nil {
+		return err
+	}
+
+	return e.base.Set(BaseItem{
+		RelativePath:  itemPath,
+		Dir:           li.Dir,
+		Etag:          etag,
+		Size:          li.Size,
+		ModTime:       li.ModTime,
+		ContentHash:   li.ContentHash,
+		HashAlgorithm: li.HashAlgorithm,
+		FileID:        li.FileID,
+	})
+}
+
+// forget removes the item and its sub-items from the base
+func (e *executor) forget(itemPath string) error {
+	if e.base == nil {
+		return nil
+	}
+	return e.base.Remove(itemPath)
+}
+
+func (e *executor) moveBase(fromPath, toPath string) error {
+	if e.base == nil {
+		return nil
+	}
+	return e.base.Move(fromPath, toPath)
+}
+
+// copyAndClose copies the content and publishes it by closing the writer.
+// A failed copy aborts the writer so that a truncated content is never published.
+// The error of the abort is reported with the error of the copy
+func copyAndClose(w io.WriteCloser, r io.Reader) error {
+	if _, err := io.Copy(w, r); err != nil {
+		var abortErr error
+		if a, ok := w.(WriteAborter); ok {
+			abortErr = a.Abort()
+		} else {
+			abortErr = w.Close()
+		}
+		if abortErr != nil {
+			return fmt.Errorf("%w (aborting the write: %v)", err, abortErr)
+		}
+		return err
+	}
+	return w.Close()
+}
+
+func (e *executor) upload(d Decision) error {
+	r, err := e.local.Open(d.RelativePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := e.remote.Create(d.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if err := copyAndClose(w, r); err != nil {
+		return err
+	}
+
+	ri, err := e.remote.Stat(d.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	return e.commit(d.RelativePath, e.comparison.Etag(ri))
+}
+
+func (e *executor) download(d Decision) error {
+	r, err := e.remote.Open(d.RelativePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := e.local.Create(d.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if err := copyAndClose(w, r); err != nil {
+		return err
+	}
+
+	return e.commit(d.RelativePath, d.RemoteValidEtag)
+}
+
+func (e *executor) createDirLocal(d Decision) error {
+	if err := e.local.Mkdir(d.RelativePath); err != nil {
+		return err
+	}
+
+	return e.commit(d.RelativePath, d.RemoteValidEtag)
+}
+
+func (e *executor) createDirRemote(d Decision) error {
+	if err := e.remote.Mkdir(d.RelativePath); err != nil {
+		return err
+	}
+
+	ri, err := e.remote.Stat(d.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	return e.commit(d.RelativePath, e.comparison.Etag(ri))
+}
+
+func (e *executor) moveRemote(d Decision) error {
+	if err := e.remote.Move(d.FromRelativePath, d.RelativePath); err != nil {
+		return err
+	}
+
+	ri, err := e.remote.Stat(d.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if err := e.local.Move(d.FromRelativePath, d.RelativePath); err != nil {
+		return err
+	}
+	if err := e.moveBase(d.FromRelativePath, d.RelativePath); err != nil {
+		return err
+	}
+
+	return e.commit(d.RelativePath, e.comparison.Etag(ri))
+}
@@ -0,0 +1,265 @@
+package fsync_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+// dataFS is implemented by fsynctest.LocalFS and fsynctest.RemoteFS
+type dataFS interface {
+	Data(itemPath string) (string, bool)
+}
+
+// content returns the content of a file, or an empty string if it does not exist
+func content(fs dataFS, itemPath string) string {
+	data, _ := fs.Data(itemPath)
+	return data
+}
+
+// syncWithExecutor runs an initial sync applying the decisions and returns the execution results
+func syncWithExecutor(t *testing.T, lFS fsync.LocalWriteFS, rFS fsync.RemoteWriteFS, opts *fsync.Options) []fsync.ExecutionResult {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := []fsync.ExecutionResult{}
+	e := fsync.NewExecutor(lFS, rFS, func(ctx context.Context, r fsync.ExecutionResult) error {
+		results = append(results, r)
+		return nil
+	}, nil)
+
+	p := fsync.NewProvider(lFS, rFS, e.Execute, opts)
+	require.NoError(t, p.DoInitialSync(ctx))
+
+	for _, r := range results {
+		t.Logf("Executed flag %s, relativePath: %s, applied: %v", r.Decision.Flag.ToString(), r.Decision.RelativePath, r.Applied)
+		require.NoError(t, r.Err)
+	}
+
+	return results
+}
+
+func TestExecutor(t *testing.T) {
+	for _, opts := range []*fsync.Options{nil, {RemoteFSDeleteNonEmptyFolder: true, LocalFSDeleteNonEmptyFolder: true}} {
+		t.Run(fmt.Sprintf("Initial merge with opts %+v", opts), func(t *testing.T) {
+			lFS := fsynctest.NewLocalFS()
+			require.NoError(t, lFS.Mkdir("/a"))
+			lFS.Write("/a/b", "local b")
+			lFS.Write("/c", "local c")
+
+			rFS := fsynctest.NewRemoteFS()
+			require.NoError(t, rFS.Mkdir("/d"))
+			rFS.Write("/d/e", "remote e")
+			rFS.Write("/f", "remote f")
+
+			results := syncWithExecutor(t, lFS, rFS, opts)
+			assert.Equal(t, 6, len(results))
+
+			fsynctest.AssertConverged(t, lFS, rFS, opts)
+		})
+
+		t.Run(fmt.Sprintf("Deletions on both side with opts %+v", opts), func(t *testing.T) {
+			lFS := fsynctest.NewLocalFS()
+			rFS := fsynctest.NewRemoteFS()
+			require.NoError(t, rFS.Mkdir("/a"))
+			rFS.Write("/a/b", "b")
+			require.NoError(t, rFS.Mkdir("/c"))
+			rFS.Write("/c/d", "d")
+			syncWithExecutor(t, lFS, rFS, opts)
+
+			// Local deletion of /a
+			lFS.Delete("/a")
+			// Remote deletion of /c
+			require.NoError(t, rFS.Remove("/c"))
+
+			results := syncWithExecutor(t, lFS, rFS, opts)
+			for _, r := range results {
+				assert.Equal(t, true, r.Applied)
+			}
+
+			fsynctest.AssertConverged(t, lFS, rFS, opts)
+			assert.Equal(t, 0, len(rFS.Items()))
+		})
+	}
+
+	t.Run("Local dir replaced by a remote file", func(t *testing.T) {
+		lFS := fsynctest.NewLocalFS()
+		rFS := fsynctest.NewRemoteFS()
+		require.NoError(t, rFS.Mkdir("/a"))
+		rFS.Write("/a/b", "b")
+		syncWithExecutor(t, lFS, rFS, nil)
+
+		require.NoError(t, rFS.Remove("/a"))
+		rFS.Write("/a", "a")
+
+		results := syncWithExecutor(t, lFS, rFS, nil)
+		require.Equal(t, 1, len(results))
+		assert.Equal(t, fsync.DecisionDeleteLocalAndDownloadRemote, results[0].Decision.Flag)
+
+		fsynctest.AssertConverged(t, lFS, rFS, nil)
+	})
+
+	t.Run("Local file replaced by a remote dir", func(t *testing.T) {
+		lFS := fsynctest.NewLocalFS()
+		rFS := fsynctest.NewRemoteFS()
+		rFS.Write("/a", "a")
+		syncWithExecutor(t, lFS, rFS, nil)
+
+		require.NoError(t, rFS.Remove("/a"))
+		require.NoError(t, rFS.Mkdir("/a"))
+		rFS.Write("/a/b", "b")
+
+		results := syncWithExecutor(t, lFS, rFS, nil)
+		require.Equal(t, 2, len(results))
+		assert.Equal(t, fsync.DecisionDeleteLocalAndCreateDirLocal, results[0].Decision.Flag)
+
+		fsynctest.AssertConverged(t, lFS, rFS, nil)
+	})
+
+	t.Run("Conflicts are reported but not applied", func(t *testing.T) {
+		lFS := fsynctest.NewLocalFS()
+		lFS.Write("/a", "local")
+		rFS := fsynctest.NewRemoteFS()
+		rFS.Write("/a", "remote")
+
+		results := syncWithExecutor(t, lFS, rFS, nil)
+		require.Equal(t, 1, len(results))
+		assert.Equal(t, fsync.DecisionConflict, results[0].Decision.Flag)
+		assert.Equal(t, false, results[0].Applied)
+		assert.Equal(t, "local", content(lFS, "/a"))
+		assert.Equal(t, "remote", content(rFS, "/a"))
+	})
+}
+
+// trashLocalFS records the items moved to the trash
+type trashLocalFS struct {
+	fsynctest.LocalFS
+	trashed []fsync.Decision
+}
+
+func (l *trashLocalFS) MoveToTrash(itemPath string, d fsync.Decision) error {
+	l.trashed = append(l.trashed, d)
+	return l.Remove(itemPath)
+}
+
+func TestExecutorTrash(t *testing.T) {
+	lFS := &trashLocalFS{LocalFS: fsynctest.NewLocalFS()}
+	rFS := fsynctest.NewRemoteFS()
+	rFS.Write("/a", "a")
+	require.NoError(t, rFS.Mkdir("/b"))
+	rFS.Write("/b/c", "c")
+
+	e := fsync.NewExecutor(lFS, rFS, nil, nil)
+	require.NoError(t, fsync.NewProvider(lFS, rFS, e.Execute, nil).DoInitialSync(context.Background()))
+
+	require.NoError(t, rFS.Remove("/a"))
+	require.NoError(t, rFS.Remove("/b"))
+	rFS.Write("/b", "b")
+	require.NoError(t, fsync.NewProvider(lFS, rFS, e.Execute, nil).DoInitialSync(context.Background()))
+
+	// Deletions are taken after the other decisions
+	require.Equal(t, 2, len(lFS.trashed))
+	assert.Equal(t, fsync.DecisionDeleteLocalAndDownloadRemote, lFS.trashed[0].Flag)
+	assert.Equal(t, "/b", lFS.trashed[0].RelativePath)
+	assert.Equal(t, fsync.DecisionDeleteLocal, lFS.trashed[1].Flag)
+	assert.Equal(t, "/a", lFS.trashed[1].RelativePath)
+	assert.Equal(t, "b", content(lFS, "/b"))
+}
+
+type (
+	// failingReadLocalFS fails the reads of the files after their first byte
+	failingReadLocalFS struct {
+		fsynctest.LocalFS
+	}
+
+	// failingReadRemoteFS fails the reads of the files after their first byte
+	failingReadRemoteFS struct {
+		fsynctest.RemoteFS
+	}
+
+	// failingAbortRemoteFS creates writers whose Abort fails
+	failingAbortRemoteFS struct {
+		fsynctest.RemoteFS
+	}
+
+	failingAbortWriter struct {
+		io.WriteCloser
+	}
+)
+
+var (
+	errRead  = fmt.Errorf("read failed")
+	errAbort = fmt.Errorf("abort failed")
+)
+
+func (r failingAbortRemoteFS) Create(itemPath string) (io.WriteCloser, error) {
+	w, err := r.RemoteFS.Create(itemPath)
+	if err != nil {
+		return nil, err
+	}
+	return failingAbortWriter{w}, nil
+}
+
+func (w failingAbortWriter) Abort() error {
+	return errAbort
+}
+
+func failingReader(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(rc, 1), iotest.ErrReader(errRead)), rc}
+}
+
+func (l failingReadLocalFS) Open(itemPath string) (io.ReadCloser, error) {
+	rc, err := l.LocalFS.Open(itemPath)
+	if err != nil {
+		return nil, err
+	}
+	return failingReader(rc), nil
+}
+
+func (r failingReadRemoteFS) Open(itemPath string) (io.ReadCloser, error) {
+	rc, err := r.RemoteFS.Open(itemPath)
+	if err != nil {
+		return nil, err
+	}
+	return failingReader(rc), nil
+}
+
+func TestExecutorAbort(t *testing.T) {
+	ctx := context.Background()
+	l := failingReadLocalFS{fsynctest.NewLocalFS()}
+	r := failingReadRemoteFS{fsynctest.NewRemoteFS()}
+	l.Write("/a", "local")
+	r.Write("/b", "remote")
+
+	e := fsync.NewExecutor(l, r, nil, nil)
+	require.ErrorIs(t, e.Execute(ctx, fsync.Decision{RelativePath: "/a", Flag: fsync.DecisionUploadLocal}), errRead)
+	require.ErrorIs(t, e.Execute(ctx, fsync.Decision{RelativePath: "/b", Flag: fsync.DecisionDownloadRemote, RemoteValidEtag: "b"}), errRead)
+
+	// The truncated contents are not published
+	_, ok := r.Data("/a")
+	assert.Equal(t, false, ok)
+	_, ok = l.Data("/b")
+	assert.Equal(t, false, ok)
+}
+
+func TestExecutorAbortError(t *testing.T) {
+	l := failingReadLocalFS{fsynctest.NewLocalFS()}
+	r := failingAbortRemoteFS{fsynctest.NewRemoteFS()}
+	l.Write("/a", "local")
+
+	e := fsync.NewExecutor(l, r, nil, nil)
+	err := e.Execute(context.Background(), fsync.Decision{RelativePath: "/a", Flag: fsync.DecisionUploadLocal})
+	require.ErrorIs(t, err, errRead)
+	assert.Equal(t, true, strings.Contains(err.Error(), errAbort.Error()))
+}
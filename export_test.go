@@ -0,0 +1,9 @@
+package fsync
+
+// SetMaxBufferedChildren sets the number of children of a side read before the check of a dir is streamed.
+// The returned function restores the previous value
+func SetMaxBufferedChildren(n int) (restore func()) {
+	previous := maxBufferedChildren
+	maxBufferedChildren = n
+	return func() { maxBufferedChildren = previous }
+}
@@ -19,6 +19,21 @@ func NewProvider(l LocalFS, r RemoteFS, d DecisionCallback, opts *Options) Provi
 	if opts != nil {
 		p.localFSDeleteNonEmptyFolder = opts.LocalFSDeleteNonEmptyFolder
 		p.remoteFSDeleteNonEmptyFolder = opts.RemoteFSDeleteNonEmptyFolder
+		p.changeDelay = opts.ChangeDelay
+		p.retryDelay = opts.RetryDelay
+		p.onRunError = opts.OnRunError
+		p.detectMoves = opts.DetectMoves
+		p.conflictPolicy = opts.ConflictPolicy
+		p.concurrency = opts.Concurrency
+		p.ignore = newIgnoreMatcher(opts.Ignore)
+		p.SetExcludedPaths(opts.ExcludedPaths)
+		p.massDeletionGuard = opts.MassDeletionGuard
+		p.base = opts.Base
+		p.comparison = opts.Comparison
+		p.continueOnError = opts.ContinueOnError
+		if opts.Ignore != nil {
+			p.ignoreFileName = opts.Ignore.FileName
+		}
 	}
 
 	return p
@@ -31,8 +46,15 @@ func (p *provider) DoInitialSync(ctx context.Context) error {
 
 // Checks the changes from the requested relative path
 func (p *provider) CheckChanges(ctx context.Context, rPath string) error {
-	_, _, err := p.checkChanges(ctx, rPath, false, false, "", p.takeDecision)
-	return err
+	ctx, takeDecision := p.withFailures(ctx, p.takeDecision)
+	err := p.guardDeletions(ctx, rPath, takeDecision, func(ctx context.Context, takeDecision DecisionCallback) error {
+		_, _, err := p.checkChanges(ctx, rPath, false, false, nil, p.resolveConflicts(takeDecision))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return failuresFrom(ctx).failed(rPath)
 }
 
 func (p *provider) checkChanges(
@@ -40,7 +62,7 @@ func (p *provider) checkChanges(
 	relativePath string,
 	tryLocalDeletion,
 	tryRemoteDeletion bool,
-	keepOnlyChildRPath string,
+	keepOnlyChildRPaths map[string]bool,
 	takeDecision DecisionCallback) (deletedLocally, deletedRemotely bool, err error) {
 	select {
 	case <-ctx.Done():
@@ -49,48 +71,58 @@ func (p *provider) checkChanges(
 		// Continue
 	}
 
-	lis, err := p.local.GetChildren(relativePath)
-	if err != nil {
-		return false, false, err
+	// Nothing is synced below an ignored dir. The ignore files are read once per traversal
+	if p.ignore != nil && ignoreFilesFrom(ctx) == nil {
+		ctx = withIgnoreFiles(ctx)
+		ignored, err := p.isIgnored(ctx, relativePath)
+		if err != nil {
+			return false, false, skipSubtree(ctx, relativePath, err)
+		} else if ignored {
+			return false, false, nil
+		}
 	}
 
-	ris, err := p.remote.GetChildren(relativePath)
-	if err != nil {
-		return false, false, err
+	// Listing the sub-dirs in parallel from the first unfiltered dir of the traversal
+	if p.concurrency > 1 && keepOnlyChildRPaths == nil && prefetcherFrom(ctx) == nil {
+		var stop func()
+		ctx, stop = p.withPrefetcher(ctx)
+		defer stop()
 	}
 
 	// Reducing the dataset to limit cpu and depth for CheckDecision
-	if keepOnlyChildRPath != "" {
-		for i := len(lis) - 1; i >= 0; i-- {
-			if lis[i].RelativePath != keepOnlyChildRPath {
-				lis[i] = lis[len(lis)-1]
-				lis = lis[:len(lis)-1]
-			}
-		}
+	// With ContinueOnError a failed subtree is skipped: it is neither deleted locally nor remotely
+	lis, ris, cont, err := p.list(ctx, relativePath, keepOnlyChildRPaths)
+	if err != nil {
+		return false, false, skipSubtree(ctx, relativePath, err)
+	}
+	if pf := prefetcherFrom(ctx); pf != nil {
+		defer pf.drop(relativePath)
+	}
 
-		for i := len(ris) - 1; i >= 0; i-- {
-			if ris[i].RelativePath != keepOnlyChildRPath {
-				ris[i] = ris[len(ris)-1]
-				ris = ris[:len(ris)-1]
-			}
-		}
+	ign, err := p.ignoreMatcherFor(ctx, relativePath)
+	if err != nil {
+		return false, false, skipSubtree(ctx, relativePath, err)
 	}
 
-	exp, imp, con := p.classifyGroups(lis, ris)
+	// Huge dirs are checked while they are listed
+	if cont != nil {
+		return p.checkChangesStreamed(ctx, relativePath, tryLocalDeletion, tryRemoteDeletion, lis, ris, *cont, ign, takeDecision)
+	}
 
-	// Exporting
-	deleteLocals, err := p.checkChangesExport(ctx, exp, takeDecision)
+	// Selective sync: the excluded subtrees are only cleaned up locally
+	lis, ris, excludedKept, cleanups, err := p.excludeChildren(ctx, lis, ris, ign)
 	if err != nil {
-		return false, false, err
+		return false, false, skipSubtree(ctx, relativePath, err)
 	}
-
-	// Importing
-	if err := p.checkChangesImport(ctx, imp, takeDecision); err != nil {
-		return false, false, err
+	for _, d := range cleanups {
+		if err := takeDecision(ctx, d); err != nil {
+			return false, false, err
+		}
 	}
 
-	// Managing conflicts (both side present)
-	deleteRemotes, err := p.checkChangesConflict(ctx, con, takeDecision)
+	exp, imp, con, mov := p.classifyGroups(lis, ris, ign)
+
+	deleteLocals, deleteRemotes, err := p.checkGroups(ctx, exp, imp, con, mov, takeDecision)
 	if err != nil {
 		return false, false, err
 	}
@@ -98,15 +130,62 @@ func (p *provider) checkChanges(
 	// If nothing to import and nothing to export
 	// And there is no conflict
 	// it means we can delete the folder
-	if len(exp) == len(deleteLocals) && len(imp) == 0 && len(con) == len(deleteRemotes) {
+	if len(exp) == len(deleteLocals) && len(imp) == 0 && len(con) == len(deleteRemotes) && len(mov) == 0 && !excludedKept {
 		deletedLocally = tryLocalDeletion
 		deletedRemotely = tryRemoteDeletion
 	}
 
+	if err := p.takeDeletions(ctx, deletedLocally, deletedRemotely, deleteLocals, deleteRemotes, takeDecision); err != nil {
+		return false, false, err
+	}
+	return
+}
+
+// excludeChildren drops the children of the excluded subtrees and returns the cleanup of their local items.
+// kept is true when some of these local items are kept
+func (p *provider) excludeChildren(ctx context.Context, lis LocalItems, ris RemoteItems, ign *ignoreMatcher) (LocalItems, RemoteItems, bool, []Decision, error) {
+	lis, ris, excluded := p.excludeSubtrees(lis, ris)
+	notIgnored, _ := ign.filter(excluded, nil)
+	kept, cleanups, err := p.cleanupExcluded(ctx, notIgnored)
+	if err != nil {
+		return nil, nil, false, nil, err
+	}
+	return lis, ris, kept || len(notIgnored) < len(excluded), cleanups, nil
+}
+
+// checkGroups takes the decisions on the classified children.
+// The deletions are returned to be taken once every child is checked
+func (p *provider) checkGroups(ctx context.Context, exp LocalItems, imp RemoteItems, con Conflicts, mov Moves, takeDecision DecisionCallback) (deleteLocals, deleteRemotes []Decision, err error) {
+	// Moving
+	if err := p.checkChangesMove(ctx, mov, takeDecision); err != nil {
+		return nil, nil, err
+	}
+
+	// Exporting
+	deleteLocals, err = p.checkChangesExport(ctx, exp, takeDecision)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Importing
+	if err := p.checkChangesImport(ctx, imp, takeDecision); err != nil {
+		return nil, nil, err
+	}
+
+	// Managing conflicts (both side present)
+	deleteRemotes, err = p.checkChangesConflict(ctx, con, takeDecision)
+	if err != nil {
+		return nil, nil, err
+	}
+	return deleteLocals, deleteRemotes, nil
+}
+
+// takeDeletions takes the deletions of the children, unless the dir is deleted at once with them
+func (p *provider) takeDeletions(ctx context.Context, deletedLocally, deletedRemotely bool, deleteLocals, deleteRemotes []Decision, takeDecision DecisionCallback) error {
 	if !p.localFSDeleteNonEmptyFolder || !deletedLocally {
 		for _, deleteLocal := range deleteLocals {
 			if err := takeDecision(ctx, deleteLocal); err != nil {
-				return false, false, err
+				return err
 			}
 		}
 	}
@@ -114,12 +193,11 @@ func (p *provider) checkChanges(
 	if !p.remoteFSDeleteNonEmptyFolder || !deletedRemotely {
 		for _, deleteRemote := range deleteRemotes {
 			if err := takeDecision(ctx, deleteRemote); err != nil {
-				return false, false, err
+				return err
 			}
 		}
 	}
-
-	return
+	return nil
 }
 
 func (p *provider) checkChangesExport(ctx context.Context, exp LocalItems, takeDecision DecisionCallback) (deleteLocals []Decision, err error) {
@@ -131,7 +209,7 @@ func (p *provider) checkChangesExport(ctx context.Context, exp LocalItems, takeD
 					tmpDecisions = append(tmpDecisions, d)
 					return nil
 				}
-				deletedLocally, _, err := p.checkChanges(ctx, e.RelativePath, true, false, "", partialTakeDecision)
+				deletedLocally, _, err := p.checkChanges(ctx, e.RelativePath, true, false, nil, partialTakeDecision)
 				if err != nil {
 					return nil, err
 				}
@@ -179,7 +257,7 @@ func (p *provider) checkChangesExport(ctx context.Context, exp LocalItems, takeD
 				}); err != nil {
 					return nil, err
 				}
-				if _, _, err := p.checkChanges(ctx, e.RelativePath, false, false, "", takeDecision); err != nil {
+				if _, _, err := p.checkChanges(ctx, e.RelativePath, false, false, nil, takeDecision); err != nil {
 					return nil, err
 				}
 			} else {
@@ -220,7 +298,7 @@ func (p *provider) checkChangesImport(ctx context.Context, imp RemoteItems, take
 			}); err != nil {
 				return err
 			}
-			if _, _, err := p.checkChanges(ctx, i.RelativePath, false, false, "", takeDecision); err != nil {
+			if _, _, err := p.checkChanges(ctx, i.RelativePath, false, false, nil, takeDecision); err != nil {
 				return err
 			}
 		} else {
@@ -251,7 +329,7 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 			if c.li.Dir && !c.ri.Dir {
 				// We have a file instead of a dir on the server
 				// Check if we can delete the local dir and dowload the file locally
-				deletedLocally, _, err := p.checkChanges(ctx, c.li.RelativePath, true, false, "", func(ctx context.Context, d Decision) error { return ctx.Err() })
+				deletedLocally, _, err := p.checkChanges(ctx, c.li.RelativePath, true, false, nil, func(ctx context.Context, d Decision) error { return ctx.Err() })
 				if err != nil {
 					return nil, err
 				}
@@ -273,7 +351,7 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 				if err := takeDecision(ctx, d); err != nil {
 					return nil, err
 				}
-			} else if !c.li.Dir && c.li.Dir {
+			} else if !c.li.Dir && c.ri.Dir {
 				// We have a dir instead of a file on the server
 				// Delete the local file and create a dir locally
 				if err := takeDecision(ctx, Decision{
@@ -285,7 +363,7 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 				}); err != nil {
 					return nil, err
 				}
-				if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, "", takeDecision); err != nil {
+				if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, nil, takeDecision); err != nil {
 					return nil, err
 				}
 			} else if !c.li.Dir {
@@ -308,7 +386,7 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 			} else {
 				// If it is a dir continue the inspection
 				if c.li.Dir {
-					if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, "", takeDecision); err != nil {
+					if err := p.checkChangesSubtree(ctx, c, takeDecision); err != nil {
 						return nil, err
 					}
 				}
@@ -336,14 +414,14 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 				}); err != nil {
 					return nil, err
 				}
-				if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, "", takeDecision); err != nil {
+				if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, nil, takeDecision); err != nil {
 					return nil, err
 				}
 			} else {
 				// Both are files
-				if c.li.Etag == c.ri.Etag {
+				if c.ri.Etag != "" && c.li.Etag == c.ri.Etag {
 					// Assuming that li.Etag is containing the old etag
-					// So we upload
+					// So we upload. A remote file without etag cannot be compared and is never overwritten
 					if err := takeDecision(ctx, Decision{
 						Flag:            DecisionUploadLocal,
 						RelativePath:    c.li.RelativePath,
@@ -353,6 +431,17 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 					}); err != nil {
 						return nil, err
 					}
+				} else if c.ri.Etag != "" && p.comparison.sameContent(c.li, c.ri) {
+					// Same content on both sides: taking the remote version is harmless
+					if err := takeDecision(ctx, Decision{
+						Flag:            DecisionDownloadRemote,
+						RelativePath:    c.li.RelativePath,
+						RemoteValidEtag: c.ri.Etag,
+						RemoteIsDir:     c.ri.Dir,
+						Why:             newDecisionWhy(&c.li, &c.ri),
+					}); err != nil {
+						return nil, err
+					}
 				} else {
 					// Files were not in sync before local change commit
 					if err := takeDecision(ctx, Decision{
@@ -380,7 +469,7 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 				}); err != nil {
 					return nil, err
 				}
-				if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, "", takeDecision); err != nil {
+				if _, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, nil, takeDecision); err != nil {
 					return nil, err
 				}
 			} else if c.li.Dir && !c.ri.Dir {
@@ -405,7 +494,7 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 					tmpDecisions = append(tmpDecisions, d)
 					return nil
 				}
-				_, deletedRemotely, err := p.checkChanges(ctx, c.li.RelativePath, false, true, "", partialTakeDecision)
+				_, deletedRemotely, err := p.checkChanges(ctx, c.li.RelativePath, false, true, nil, partialTakeDecision)
 				if err != nil {
 					return nil, err
 				}
@@ -472,61 +561,231 @@ func (p *provider) checkChangesConflict(ctx context.Context, con Conflicts, take
 	return
 }
 
-func (p *provider) classifyGroups(lis LocalItems, ris RemoteItems) (exp LocalItems, imp RemoteItems, con Conflicts) {
+// checkChangesSubtree inspects a dir commited on both sides.
+// The inspection is skipped when both sides report the same TreeHash
+// and the remote TreeHash is commited locally when the subtree is in sync
+func (p *provider) checkChangesSubtree(ctx context.Context, c Conflict, takeDecision DecisionCallback) error {
+	if c.li.TreeHash != "" && c.li.TreeHash == c.ri.TreeHash {
+		return nil
+	}
+
+	committer, ok := p.local.(LocalFSTreeHashCommitter)
+	if !ok || c.ri.TreeHash == "" {
+		_, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, nil, takeDecision)
+		return err
+	}
+
+	// A subtree with a skipped failure is not in sync either
+	failed := failuresFrom(ctx).count()
+	decisions := 0
+	_, _, err := p.checkChanges(ctx, c.li.RelativePath, false, false, nil, func(ctx context.Context, d Decision) error {
+		decisions++
+		return takeDecision(ctx, d)
+	})
+	if err != nil || decisions > 0 || failuresFrom(ctx).count() > failed {
+		return err
+	}
+
+	return committer.CommitTreeHash(c.li.RelativePath, c.ri.TreeHash)
+}
+
+func (p *provider) checkChangesMove(ctx context.Context, mov Moves, takeDecision DecisionCallback) error {
+	for _, m := range mov {
+		if err := takeDecision(ctx, Decision{
+			Flag:             m.flag,
+			RelativePath:     m.to,
+			FromRelativePath: m.li.RelativePath,
+			RemoteValidEtag:  m.ri.Etag,
+			RemoteIsDir:      m.ri.Dir,
+			Why:              newDecisionWhy(&m.li, &m.ri),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// classifyGroups splits the children in items to export, to import, present on both sides and moved
+func (p *provider) classifyGroups(lis LocalItems, ris RemoteItems, ign *ignoreMatcher) (exp LocalItems, imp RemoteItems, con Conflicts, mov Moves) {
+	exp, imp, con = groupChildren(lis, ris, ign)
+	if p.detectMoves {
+		return classifyMoves(exp, imp, con)
+	}
+	return exp, imp, con, Moves{}
+}
+
+// groupChildren splits the children in items to export, to import and present on both sides.
+// The items are indexed by path so that the classification is linear
+func groupChildren(lis LocalItems, ris RemoteItems, ign *ignoreMatcher) (exp LocalItems, imp RemoteItems, con Conflicts) {
+	// Ignored items never produce decisions
+	lis, ris = ign.filter(lis, ris)
+
 	exp = LocalItems{}
 	imp = RemoteItems{}
 	con = Conflicts{}
 
-	// Export
+	risByPath := make(map[string]int, len(ris))
+	for k := len(ris) - 1; k >= 0; k-- {
+		risByPath[ris[k].RelativePath] = k
+	}
+
+	lisByPath := make(map[string]bool, len(lis))
 	for _, li := range lis {
-		presentRemotely := false
-		for _, ri := range ris {
-			if li.RelativePath == ri.RelativePath {
-				presentRemotely = true
-				break
-			}
-		}
-		if !presentRemotely {
+		lisByPath[li.RelativePath] = true
+	}
+
+	// Export and conflict
+	for _, li := range lis {
+		if k, ok := risByPath[li.RelativePath]; ok {
+			con = append(con, Conflict{li: li, ri: ris[k]})
+		} else {
 			exp = append(exp, li)
 		}
 	}
 
 	// Import
 	for _, ri := range ris {
-		presentLocaly := false
-		for _, li := range lis {
-			if li.RelativePath == ri.RelativePath {
-				presentLocaly = true
-				break
-			}
-		}
-		if !presentLocaly {
+		if !lisByPath[ri.RelativePath] {
 			imp = append(imp, ri)
 		}
 	}
 
-	// Conflict
-	for _, li := range lis {
-		for _, ri := range ris {
-			if li.RelativePath == ri.RelativePath {
-				con = append(con, Conflict{li: li, ri: ri})
-				break
+	return
+}
+
+type moveKey struct {
+	dir bool
+	id  string
+}
+
+// classifyMoves pairs the items renamed in the same dir.
+// Ambiguous candidates (e.g. copies with the same etag) are left untouched
+func classifyMoves(exp LocalItems, imp RemoteItems, con Conflicts) (LocalItems, RemoteItems, Conflicts, Moves) {
+	mov := Moves{}
+	movedExp := map[int]bool{}
+	movedImp := map[int]bool{}
+	movedCon := map[int]bool{}
+
+	// Renamed remotely: a commited local item is missing remotely
+	// and a remote item with the same etag is missing locally
+	impByEtag := map[moveKey][]int{}
+	for l, i := range imp {
+		if i.Etag != "" {
+			key := moveKey{dir: i.Dir, id: i.Etag}
+			impByEtag[key] = append(impByEtag[key], l)
+		}
+	}
+	for k, e := range exp {
+		if e.Commited != CommitedYes || e.Etag == "" {
+			continue
+		}
+		candidates := impByEtag[moveKey{dir: e.Dir, id: e.Etag}]
+		if len(candidates) != 1 || movedImp[candidates[0]] {
+			continue
+		}
+		ri := imp[candidates[0]]
+		mov = append(mov, Move{flag: DecisionMoveLocal, li: e, ri: ri, to: ri.RelativePath})
+		movedExp[k] = true
+		movedImp[candidates[0]] = true
+	}
+
+	// Renamed locally: a local item awaiting remote deletion is unchanged remotely
+	// and a new local item has the same identity
+	expByFileID := map[moveKey][]int{}
+	expByEtag := map[moveKey][]int{}
+	for l, e := range exp {
+		if e.Commited != CommitedNo || movedExp[l] {
+			continue
+		}
+		if e.FileID != "" {
+			key := moveKey{dir: e.Dir, id: e.FileID}
+			expByFileID[key] = append(expByFileID[key], l)
+		}
+		if !e.Dir && e.Etag != "" {
+			key := moveKey{id: e.Etag}
+			expByEtag[key] = append(expByEtag[key], l)
+		}
+	}
+	for k, c := range con {
+		if c.li.Commited != CommitedAwaitingRemoteDeletion || c.li.Dir != c.ri.Dir {
+			continue
+		}
+		if !c.li.Dir && (c.li.Etag == "" || c.li.Etag != c.ri.Etag) {
+			continue
+		}
+		candidates := []int{}
+		if c.li.FileID != "" {
+			for _, l := range expByFileID[moveKey{dir: c.li.Dir, id: c.li.FileID}] {
+				if unchangedSince(c.li, exp[l]) {
+					candidates = append(candidates, l)
+				}
+			}
+		}
+		if !c.li.Dir {
+			for _, l := range expByEtag[moveKey{id: c.li.Etag}] {
+				if exp[l].FileID != c.li.FileID || c.li.FileID == "" {
+					candidates = append(candidates, l)
+				}
 			}
 		}
+		if len(candidates) != 1 || movedExp[candidates[0]] {
+			continue
+		}
+		mov = append(mov, Move{flag: DecisionMoveRemote, li: c.li, ri: c.ri, to: exp[candidates[0]].RelativePath})
+		movedCon[k] = true
+		movedExp[candidates[0]] = true
 	}
 
-	return
+	if len(mov) == 0 {
+		return exp, imp, con, mov
+	}
+
+	newExp := LocalItems{}
+	for k, e := range exp {
+		if !movedExp[k] {
+			newExp = append(newExp, e)
+		}
+	}
+	newImp := RemoteItems{}
+	for k, i := range imp {
+		if !movedImp[k] {
+			newImp = append(newImp, i)
+		}
+	}
+	newCon := Conflicts{}
+	for k, c := range con {
+		if !movedCon[k] {
+			newCon = append(newCon, c)
+		}
+	}
+
+	return newExp, newImp, newCon, mov
+}
+
+// unchangedSince returns true when the file renamed locally kept the ModTime and the Size
+// it had when it was commited. They are not compared when the commited ModTime is unknown
+func unchangedSince(commited, renamed LocalItem) bool {
+	if commited.Dir || commited.ModTime.IsZero() {
+		return true
+	}
+	return commited.Size == renamed.Size && commited.ModTime.Equal(renamed.ModTime)
 }
 
 // CheckDecision verifies if the decision is still ok after a certain amount of time
 func (p *provider) CheckDecision(ctx context.Context, d Decision) (err error, ok bool) {
 	var newDecision *Decision
-	_, _, err = p.checkChanges(ctx, path.Dir(d.RelativePath), false, false, d.RelativePath, func(ctx context.Context, d2 Decision) error {
-		if d.RelativePath == d2.RelativePath {
+	keepOnlyChildRPaths := map[string]bool{d.RelativePath: true}
+	if d.FromRelativePath != "" {
+		keepOnlyChildRPaths[d.FromRelativePath] = true
+	}
+	_, _, err = p.checkChanges(ctx, path.Dir(d.RelativePath), false, false, keepOnlyChildRPaths, p.resolveConflicts(func(ctx context.Context, d2 Decision) error {
+		// A resolved conflict may lead to several decisions on the same path
+		if d.RelativePath == d2.RelativePath && (newDecision == nil || d2.Flag == d.Flag) {
 			newDecision = &d2
 		}
 		return nil
-	})
+	}))
 	if err != nil {
 		return err, false
 	}
@@ -534,6 +793,7 @@ func (p *provider) CheckDecision(ctx context.Context, d Decision) (err error, ok
 	if newDecision != nil &&
 		newDecision.RelativePath == d.RelativePath &&
 		newDecision.Flag == d.Flag &&
+		newDecision.FromRelativePath == d.FromRelativePath &&
 		newDecision.RemoteValidEtag == d.RemoteValidEtag &&
 		newDecision.RemoteIsDir == d.RemoteIsDir {
 		return nil, true
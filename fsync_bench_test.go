@@ -0,0 +1,65 @@
+package fsync_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+)
+
+// newLargeDir returns a flat dir of n files where one file out of ten differs
+// and one out of ten exists only on one side
+func newLargeDir(n int) (fsync.LocalItems, fsync.RemoteItems) {
+	lst := make(fsync.LocalItems, 0, n)
+	rst := make(fsync.RemoteItems, 0, n)
+	for k := 0; k < n; k++ {
+		p := fmt.Sprintf("/f%07d", k)
+		switch k % 10 {
+		case 0:
+			lst = append(lst, fsync.LocalItem{RelativePath: p, Etag: "v1", Commited: fsync.CommitedNo})
+		case 1:
+			rst = append(rst, fsync.RemoteItem{RelativePath: p, Etag: "v1"})
+		case 2:
+			lst = append(lst, fsync.LocalItem{RelativePath: p, Etag: "v1", Commited: fsync.CommitedYes})
+			rst = append(rst, fsync.RemoteItem{RelativePath: p, Etag: "v2"})
+		default:
+			lst = append(lst, fsync.LocalItem{RelativePath: p, Etag: "v1", Commited: fsync.CommitedYes})
+			rst = append(rst, fsync.RemoteItem{RelativePath: p, Etag: "v1"})
+		}
+	}
+	// Listings are not sorted by all file systems
+	for k := 0; k < len(rst)/2; k += 2 {
+		rst[k], rst[len(rst)-1-k] = rst[len(rst)-1-k], rst[k]
+	}
+	return lst, rst
+}
+
+func BenchmarkLargeDir(b *testing.B) {
+	for _, n := range []int{1000, 10000, 50000} {
+		b.Run(fmt.Sprintf("%d entries", n), func(b *testing.B) {
+			lst, rst := newLargeDir(n)
+			lFS := localFS{status: lst}
+			rFS := remoteFS{status: rst}
+
+			count := 0
+			p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+				count++
+				return nil
+			}, nil)
+
+			b.ResetTimer()
+			for k := 0; k < b.N; k++ {
+				count = 0
+				if err := p.DoInitialSync(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			if count != 3*n/10 {
+				b.Fatalf("%d decisions instead of %d", count, 3*n/10)
+			}
+		})
+	}
+}
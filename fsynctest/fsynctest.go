@@ -0,0 +1,137 @@
+// Package fsynctest provides in-memory LocalFS and RemoteFS implementations
+// and a scenario runner to test the code built on fsync.
+//
+// The file systems are safe for concurrent use. Their methods called by the engine
+// can be slowed down, made to fail and counted, while the methods simulating the users
+// (Write, Rename, Delete, Set) are never delayed nor failed.
+package fsynctest
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Op is a method of the file systems called by the engine
+	Op string
+
+	// Faults injects latency and errors in the calls of the engine and counts them
+	Faults interface {
+		// SetLatency delays every call
+		SetLatency(d time.Duration)
+		// InjectError makes the calls of op on itemPath fail with err. An empty itemPath matches every path
+		InjectError(op Op, itemPath string, err error)
+		// ClearErrors removes the injected errors
+		ClearErrors()
+		// Calls returns the number of calls of op
+		Calls(op Op) int
+		// ResetCalls sets the call counters to zero
+		ResetCalls()
+	}
+
+	faults struct {
+		mu      sync.Mutex
+		latency time.Duration
+		errs    map[Op]map[string]error
+		calls   map[Op]int
+	}
+
+	memWriter struct {
+		bytes.Buffer
+		onClose func([]byte)
+	}
+)
+
+const (
+	OpGetChildren = Op("GetChildren")
+	OpOpen        = Op("Open")
+	OpCreate      = Op("Create")
+	OpMkdir       = Op("Mkdir")
+	OpRemove      = Op("Remove")
+	OpStat        = Op("Stat")
+	OpMove        = Op("Move")
+	OpCommit      = Op("Commit")
+	OpUncommit    = Op("Uncommit")
+)
+
+func newFaults() *faults {
+	return &faults{
+		errs:  map[Op]map[string]error{},
+		calls: map[Op]int{},
+	}
+}
+
+func (f *faults) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+func (f *faults) InjectError(op Op, itemPath string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.errs[op] == nil {
+		f.errs[op] = map[string]error{}
+	}
+	f.errs[op][itemPath] = err
+}
+
+func (f *faults) ClearErrors() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs = map[Op]map[string]error{}
+}
+
+func (f *faults) Calls(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+func (f *faults) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = map[Op]int{}
+}
+
+// call counts the call, waits for the latency and returns the injected error
+func (f *faults) call(op Op, itemPath string) error {
+	f.mu.Lock()
+	f.calls[op]++
+	latency := f.latency
+	err, ok := f.errs[op][itemPath]
+	if !ok {
+		err = f.errs[op][""]
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return err
+}
+
+func (w *memWriter) Close() error {
+	w.onClose(w.Bytes())
+	return nil
+}
+
+// Abort drops the written data
+func (w *memWriter) Abort() error {
+	return nil
+}
+
+func isSubPath(itemPath, parent string) bool {
+	return itemPath == parent || strings.HasPrefix(itemPath, strings.TrimSuffix(parent, "/")+"/")
+}
+
+// seedData is the content of a seeded file: its etag, so that committed items match their remote version,
+// or its path when it has no etag
+func seedData(itemPath, etag string) []byte {
+	if etag == "" {
+		return []byte(itemPath)
+	}
+	return []byte(etag)
+}
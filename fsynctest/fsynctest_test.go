@@ -0,0 +1,164 @@
+package fsynctest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestRunScenario(t *testing.T) {
+	t.Run("Out of sync merge", func(t *testing.T) {
+		l, r := fsynctest.RunScenario(t, fsynctest.Scenario{
+			Local: fsync.LocalItems{
+				{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+				{RelativePath: "/a/b", Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion},
+				{RelativePath: "/a/c", Commited: fsync.CommitedNo},
+				{RelativePath: "/d", Etag: "v1", Commited: fsync.CommitedYes},
+			},
+			Remote: fsync.RemoteItems{
+				{RelativePath: "/a", Dir: true},
+				{RelativePath: "/a/b", Etag: "v1"},
+				{RelativePath: "/d", Etag: "v2"},
+				{RelativePath: "/e", Dir: true},
+			},
+			Expected: []fsync.Decision{
+				{RelativePath: "/a/b", Flag: fsync.DecisionDeleteRemote},
+				{RelativePath: "/a/c", Flag: fsync.DecisionUploadLocal},
+				{RelativePath: "/d", Flag: fsync.DecisionDownloadRemote},
+				{RelativePath: "/e", Flag: fsync.DecisionCreateDirLocal},
+			},
+		})
+
+		data, ok := r.Data("/a/c")
+		require.True(t, ok)
+		assert.Equal(t, "/a/c", data)
+		data, ok = l.Data("/d")
+		require.True(t, ok)
+		assert.Equal(t, "v2", data)
+		assert.Equal(t, 4, len(l.Items()))
+	})
+
+	t.Run("Conflicts resolved by a policy", func(t *testing.T) {
+		fsynctest.RunScenario(t, fsynctest.Scenario{
+			Local: fsync.LocalItems{
+				{RelativePath: "/a", Commited: fsync.CommitedNo},
+			},
+			Remote: fsync.RemoteItems{
+				{RelativePath: "/a", Etag: "v1"},
+			},
+			Expected: []fsync.Decision{
+				{RelativePath: "/a", Flag: fsync.DecisionUploadLocal},
+			},
+			Options: &fsync.Options{ConflictPolicy: fsync.ConflictPolicyLocalWins},
+		})
+	})
+
+	t.Run("Three-way sync", func(t *testing.T) {
+		fsynctest.RunScenario(t, fsynctest.Scenario{
+			Local: fsync.LocalItems{
+				{RelativePath: "/a", Dir: true},
+				{RelativePath: "/a/b"},
+			},
+			Remote: fsync.RemoteItems{
+				{RelativePath: "/c", Etag: "v1"},
+			},
+			Expected: []fsync.Decision{
+				{RelativePath: "/a", Flag: fsync.DecisionCreateDirRemote},
+				{RelativePath: "/a/b", Flag: fsync.DecisionUploadLocal},
+				{RelativePath: "/c", Flag: fsync.DecisionDownloadRemote},
+			},
+			Options: &fsync.Options{Base: fsync.NewBaseSnapshot(), Concurrency: 4},
+		})
+	})
+}
+
+func TestUserChanges(t *testing.T) {
+	l := fsynctest.NewLocalFS()
+	r := fsynctest.NewRemoteFS()
+
+	l.Write("/a", "a")
+	require.NoError(t, l.Mkdir("/b"))
+	l.Write("/b/c", "c")
+	r.Write("/d", "d")
+
+	syncOnce := func() {
+		e := fsync.NewExecutor(l, r, nil, nil)
+		require.NoError(t, fsync.NewProvider(l, r, e.Execute, &fsync.Options{DetectMoves: true}).DoInitialSync(context.Background()))
+	}
+	sync := func() {
+		syncOnce()
+		fsynctest.AssertConverged(t, l, r, &fsync.Options{DetectMoves: true})
+	}
+
+	sync()
+	assert.Equal(t, 4, len(r.Items()))
+
+	l.Rename("/b", "/e")
+	r.ResetCalls()
+	sync()
+	assert.Equal(t, 1, r.Calls(fsynctest.OpMove))
+	assert.Equal(t, 0, r.Calls(fsynctest.OpCreate))
+	data, ok := r.Data("/e/c")
+	require.True(t, ok)
+	assert.Equal(t, "c", data)
+
+	l.Delete("/a")
+	r.Delete("/d")
+	sync()
+	_, ok = r.Data("/a")
+	assert.Equal(t, false, ok)
+	_, ok = l.Data("/d")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 2, len(l.Items()))
+
+	// The sub-items of a moved dir are checked by the next sync
+	l.Rename("/e", "/f")
+	l.Delete("/f/c")
+	syncOnce()
+	sync()
+	_, ok = r.Data("/f/c")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 1, len(l.Items()))
+}
+
+func TestFaults(t *testing.T) {
+	errBroken := errors.New("broken")
+
+	l := fsynctest.NewLocalFS()
+	r := fsynctest.NewRemoteFS(
+		fsync.RemoteItem{RelativePath: "/a", Etag: "v1"},
+		fsync.RemoteItem{RelativePath: "/b", Etag: "v1"},
+	)
+
+	r.InjectError(fsynctest.OpOpen, "/b", errBroken)
+	results := []fsync.ExecutionResult{}
+	e := fsync.NewExecutor(l, r, func(ctx context.Context, res fsync.ExecutionResult) error {
+		results = append(results, res)
+		return nil
+	}, &fsync.ExecutorOptions{ContinueOnError: true})
+	require.NoError(t, fsync.NewProvider(l, r, e.Execute, nil).DoInitialSync(context.Background()))
+
+	require.Equal(t, 2, len(results))
+	require.NoError(t, results[0].Err)
+	require.ErrorIs(t, results[1].Err, errBroken)
+	assert.Equal(t, 2, r.Calls(fsynctest.OpOpen))
+	assert.Equal(t, 1, l.Calls(fsynctest.OpCommit))
+
+	r.InjectError(fsynctest.OpGetChildren, "", errBroken)
+	_, err := r.GetChildren("/")
+	require.ErrorIs(t, err, errBroken)
+
+	r.ClearErrors()
+	l.SetLatency(10 * time.Millisecond)
+	start := time.Now()
+	e = fsync.NewExecutor(l, r, nil, nil)
+	require.NoError(t, fsync.NewProvider(l, r, e.Execute, nil).DoInitialSync(context.Background()))
+	assert.Equal(t, true, time.Since(start) >= 10*time.Millisecond)
+	fsynctest.AssertConverged(t, l, r, nil)
+}
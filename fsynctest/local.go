@@ -0,0 +1,335 @@
+package fsynctest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// LocalFS is an in-memory fsync.LocalWriteFS keeping the commit status like a journal would do
+	LocalFS interface {
+		fsync.LocalWriteFS
+		Faults
+		// Set adds the items as they are. Files contain their etag, or their path when they have none
+		Set(items ...fsync.LocalItem)
+		// Write simulates a user writing a file
+		Write(itemPath string, data string)
+		// Rename simulates a user renaming an item.
+		// Commited items are kept as awaiting remote deletion
+		Rename(fromPath, toPath string)
+		// Delete simulates a user deleting an item.
+		// Commited items are kept as awaiting remote deletion
+		Delete(itemPath string)
+		// Data returns the content of a file
+		Data(itemPath string) (string, bool)
+		// Items returns every item sorted by path
+		Items() fsync.LocalItems
+	}
+
+	localEntry struct {
+		item fsync.LocalItem
+		data []byte
+	}
+
+	localFS struct {
+		*faults
+
+		mu      sync.Mutex
+		entries map[string]*localEntry
+		nextID  int
+		clock   int64
+	}
+)
+
+// NewLocalFS creates a local file system holding the items
+func NewLocalFS(items ...fsync.LocalItem) LocalFS {
+	l := &localFS{
+		faults:  newFaults(),
+		entries: map[string]*localEntry{},
+	}
+	l.Set(items...)
+	return l
+}
+
+func (l *localFS) newFileID() string {
+	l.nextID++
+	return fmt.Sprintf("%d", l.nextID)
+}
+
+// now returns a distinct modification time at each change
+func (l *localFS) now() time.Time {
+	l.clock++
+	return time.Unix(0, l.clock)
+}
+
+func (l *localFS) Set(items ...fsync.LocalItem) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, li := range items {
+		e := &localEntry{item: li}
+		if !li.Dir {
+			e.data = seedData(li.RelativePath, li.Etag)
+		}
+		l.entries[li.RelativePath] = e
+	}
+}
+
+func (l *localFS) Write(itemPath string, data string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(itemPath, []byte(data))
+}
+
+// write keeps the FileID and the last commited etag of the file it replaces
+func (l *localFS) write(itemPath string, data []byte) {
+	fileID, etag := "", ""
+	if e, ok := l.entries[itemPath]; ok && !e.item.Dir && e.item.Commited != fsync.CommitedAwaitingRemoteDeletion {
+		fileID, etag = e.item.FileID, e.item.Etag
+	}
+	if fileID == "" {
+		fileID = l.newFileID()
+	}
+	l.entries[itemPath] = &localEntry{
+		item: fsync.LocalItem{RelativePath: itemPath, Etag: etag, Commited: fsync.CommitedNo, FileID: fileID, ModTime: l.now(), Size: int64(len(data))},
+		data: data,
+	}
+}
+
+func (l *localFS) Rename(fromPath, toPath string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for p, e := range l.entries {
+		if !isSubPath(p, fromPath) || e.item.Commited == fsync.CommitedAwaitingRemoteDeletion {
+			continue
+		}
+		q := toPath + strings.TrimPrefix(p, fromPath)
+		l.entries[q] = &localEntry{
+			item: fsync.LocalItem{RelativePath: q, Dir: e.item.Dir, Commited: fsync.CommitedNo, FileID: e.item.FileID, ModTime: e.item.ModTime, Size: e.item.Size},
+			data: e.data,
+		}
+		if e.item.Commited == fsync.CommitedNo {
+			delete(l.entries, p)
+		} else {
+			e.item.Commited = fsync.CommitedAwaitingRemoteDeletion
+		}
+	}
+}
+
+func (l *localFS) Delete(itemPath string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for p, e := range l.entries {
+		if !isSubPath(p, itemPath) {
+			continue
+		}
+		if e.item.Commited == fsync.CommitedNo {
+			delete(l.entries, p)
+		} else {
+			e.item.Commited = fsync.CommitedAwaitingRemoteDeletion
+			e.data = nil
+		}
+	}
+}
+
+func (l *localFS) Data(itemPath string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[itemPath]
+	if !ok || e.item.Dir {
+		return "", false
+	}
+	return string(e.data), true
+}
+
+func (l *localFS) Items() fsync.LocalItems {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ret := make(fsync.LocalItems, 0, len(l.entries))
+	for _, e := range l.entries {
+		ret = append(ret, e.item)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+	return ret
+}
+
+func (l *localFS) GetChildren(itemPath string) (fsync.LocalItems, error) {
+	if err := l.call(OpGetChildren, itemPath); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ret := fsync.LocalItems{}
+	for p, e := range l.entries {
+		if p != itemPath && path.Dir(p) == itemPath {
+			ret = append(ret, e.item)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+	return ret, nil
+}
+
+func (l *localFS) Open(itemPath string) (io.ReadCloser, error) {
+	if err := l.call(OpOpen, itemPath); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[itemPath]
+	if !ok || e.item.Dir || e.item.Commited == fsync.CommitedAwaitingRemoteDeletion {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(e.data)), nil
+}
+
+func (l *localFS) Create(itemPath string) (io.WriteCloser, error) {
+	if err := l.call(OpCreate, itemPath); err != nil {
+		return nil, err
+	}
+
+	return &memWriter{onClose: func(data []byte) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.write(itemPath, append([]byte{}, data...))
+	}}, nil
+}
+
+func (l *localFS) Mkdir(itemPath string) error {
+	if err := l.call(OpMkdir, itemPath); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e, ok := l.entries[itemPath]; ok && e.item.Dir && e.item.Commited != fsync.CommitedAwaitingRemoteDeletion {
+		return nil
+	}
+	l.entries[itemPath] = &localEntry{
+		item: fsync.LocalItem{RelativePath: itemPath, Dir: true, Commited: fsync.CommitedNo, FileID: l.newFileID(), ModTime: l.now()},
+	}
+	return nil
+}
+
+func (l *localFS) Remove(itemPath string) error {
+	if err := l.call(OpRemove, itemPath); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for p := range l.entries {
+		if isSubPath(p, itemPath) {
+			delete(l.entries, p)
+		}
+	}
+	return nil
+}
+
+func (l *localFS) Stat(itemPath string) (fsync.LocalItem, error) {
+	if err := l.call(OpStat, itemPath); err != nil {
+		return fsync.LocalItem{}, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[itemPath]
+	if !ok {
+		return fsync.LocalItem{}, os.ErrNotExist
+	}
+	return e.item, nil
+}
+
+func (l *localFS) Commit(itemPath string, etag string) error {
+	if err := l.call(OpCommit, itemPath); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[itemPath]
+	if !ok {
+		return os.ErrNotExist
+	}
+	e.item.Commited = fsync.CommitedYes
+	e.item.Etag = etag
+	return nil
+}
+
+// Move renames the item like localfs: when the item was already renamed only the commit status is moved
+func (l *localFS) Move(fromPath, toPath string) error {
+	if err := l.call(OpMove, fromPath); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Like a file system, a present item is never replaced
+	from, fromOk := l.entries[fromPath]
+	to, toOk := l.entries[toPath]
+	if fromOk && toOk && from.item.Commited != fsync.CommitedAwaitingRemoteDeletion && to.item.Commited != fsync.CommitedAwaitingRemoteDeletion {
+		return fmt.Errorf("fsynctest: moving %s to %s: %w", fromPath, toPath, os.ErrExist)
+	}
+
+	moved := map[string]*localEntry{}
+	for p, e := range l.entries {
+		if isSubPath(p, fromPath) {
+			moved[p] = e
+			delete(l.entries, p)
+		}
+	}
+
+	for p, e := range moved {
+		q := toPath + strings.TrimPrefix(p, fromPath)
+		if existing, ok := l.entries[q]; ok {
+			// Already renamed: moving the commit status
+			if e.item.Commited != fsync.CommitedNo && existing.item.Dir == e.item.Dir && string(existing.data) == string(e.data) {
+				existing.item.Commited = fsync.CommitedYes
+				existing.item.Etag = e.item.Etag
+			}
+			continue
+		}
+		// The items deleted before the rename stay awaiting remote deletion
+		e.item.RelativePath = q
+		l.entries[q] = e
+	}
+	return nil
+}
+
+func (l *localFS) Uncommit(itemPath string) error {
+	if err := l.call(OpUncommit, itemPath); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for p, e := range l.entries {
+		if isSubPath(p, itemPath) {
+			e.item.Commited = fsync.CommitedNo
+			e.item.Etag = ""
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package fsynctest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// RemoteFS is an in-memory fsync.RemoteWriteFS. Every write gives a new etag to the item
+	RemoteFS interface {
+		fsync.RemoteWriteFS
+		Faults
+		// Set adds the items as they are. Files contain their etag, or their path when they have none
+		Set(items ...fsync.RemoteItem)
+		// Write simulates another client writing a file
+		Write(itemPath string, data string)
+		// Delete simulates another client deleting an item
+		Delete(itemPath string)
+		// Data returns the content of a file
+		Data(itemPath string) (string, bool)
+		// Items returns every item sorted by path
+		Items() fsync.RemoteItems
+	}
+
+	remoteEntry struct {
+		item fsync.RemoteItem
+		data []byte
+	}
+
+	remoteFS struct {
+		*faults
+
+		mu      sync.Mutex
+		entries map[string]*remoteEntry
+		version int
+	}
+)
+
+// NewRemoteFS creates a remote file system holding the items
+func NewRemoteFS(items ...fsync.RemoteItem) RemoteFS {
+	r := &remoteFS{
+		faults:  newFaults(),
+		entries: map[string]*remoteEntry{},
+	}
+	r.Set(items...)
+	return r
+}
+
+// newEtag returns an etag which cannot collide with the etags of the seeded items
+func (r *remoteFS) newEtag(prefix string) string {
+	r.version++
+	return fmt.Sprintf("fsynctest-%s%d", prefix, r.version)
+}
+
+func (r *remoteFS) Set(items ...fsync.RemoteItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ri := range items {
+		e := &remoteEntry{item: ri}
+		if !ri.Dir {
+			e.data = seedData(ri.RelativePath, ri.Etag)
+		}
+		r.entries[ri.RelativePath] = e
+	}
+}
+
+func (r *remoteFS) Write(itemPath string, data string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.write(itemPath, []byte(data))
+}
+
+func (r *remoteFS) write(itemPath string, data []byte) {
+	etag := r.newEtag("v")
+	r.entries[itemPath] = &remoteEntry{
+		item: fsync.RemoteItem{RelativePath: itemPath, Etag: etag, ModTime: time.Unix(0, int64(r.version)), Size: int64(len(data))},
+		data: data,
+	}
+}
+
+func (r *remoteFS) Delete(itemPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(itemPath)
+}
+
+func (r *remoteFS) remove(itemPath string) {
+	for p := range r.entries {
+		if isSubPath(p, itemPath) {
+			delete(r.entries, p)
+		}
+	}
+}
+
+func (r *remoteFS) Data(itemPath string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[itemPath]
+	if !ok || e.item.Dir {
+		return "", false
+	}
+	return string(e.data), true
+}
+
+func (r *remoteFS) Items() fsync.RemoteItems {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ret := make(fsync.RemoteItems, 0, len(r.entries))
+	for _, e := range r.entries {
+		ret = append(ret, e.item)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+	return ret
+}
+
+func (r *remoteFS) GetChildren(itemPath string) (fsync.RemoteItems, error) {
+	if err := r.call(OpGetChildren, itemPath); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ret := fsync.RemoteItems{}
+	for p, e := range r.entries {
+		if p != itemPath && path.Dir(p) == itemPath {
+			ret = append(ret, e.item)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+	return ret, nil
+}
+
+func (r *remoteFS) Open(itemPath string) (io.ReadCloser, error) {
+	if err := r.call(OpOpen, itemPath); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[itemPath]
+	if !ok || e.item.Dir {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(e.data)), nil
+}
+
+func (r *remoteFS) Create(itemPath string) (io.WriteCloser, error) {
+	if err := r.call(OpCreate, itemPath); err != nil {
+		return nil, err
+	}
+
+	return &memWriter{onClose: func(data []byte) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.write(itemPath, append([]byte{}, data...))
+	}}, nil
+}
+
+func (r *remoteFS) Mkdir(itemPath string) error {
+	if err := r.call(OpMkdir, itemPath); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.entries[itemPath]; ok && e.item.Dir {
+		return nil
+	}
+	r.entries[itemPath] = &remoteEntry{
+		item: fsync.RemoteItem{RelativePath: itemPath, Dir: true, Etag: r.newEtag("d")},
+	}
+	return nil
+}
+
+func (r *remoteFS) Move(fromPath, toPath string) error {
+	if err := r.call(OpMove, fromPath); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	moved := map[string]*remoteEntry{}
+	for p, e := range r.entries {
+		if isSubPath(p, fromPath) {
+			moved[p] = e
+			delete(r.entries, p)
+		}
+	}
+	for p, e := range moved {
+		q := toPath + strings.TrimPrefix(p, fromPath)
+		e.item.RelativePath = q
+		r.entries[q] = e
+	}
+	return nil
+}
+
+func (r *remoteFS) Remove(itemPath string) error {
+	if err := r.call(OpRemove, itemPath); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(itemPath)
+	return nil
+}
+
+func (r *remoteFS) Stat(itemPath string) (fsync.RemoteItem, error) {
+	if err := r.call(OpStat, itemPath); err != nil {
+		return fsync.RemoteItem{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[itemPath]
+	if !ok {
+		return fsync.RemoteItem{}, os.ErrNotExist
+	}
+	return e.item, nil
+}
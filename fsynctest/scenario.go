@@ -0,0 +1,145 @@
+package fsynctest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// Scenario is a sync between a local and a remote tree
+	Scenario struct {
+		Local  fsync.LocalItems
+		Remote fsync.RemoteItems
+		// Expected are the decisions of the initial sync, compared by flag and path in any order
+		Expected []fsync.Decision
+		// Options are given to the providers. Options.Base is also given to the executor
+		Options *fsync.Options
+	}
+)
+
+// RunScenario seeds the file systems with the items and checks that:
+//   - the initial sync takes the expected decisions
+//   - CheckDecision agrees with every decision
+//   - once executed, the decisions make the trees converge: a second sync takes no decision
+//     and the items present on both sides have the same kind and content
+//
+// The convergence is not checked when a DecisionConflict is left to an external resolution.
+// The file systems are returned for further checks
+func RunScenario(t testing.TB, s Scenario) (LocalFS, RemoteFS) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := NewLocalFS(s.Local...)
+	r := NewRemoteFS(s.Remote...)
+
+	p := fsync.NewProvider(l, r, nil, s.Options)
+	decisions := Decisions(t, l, r, s.Options)
+
+	t.Logf("%d decisions made", len(decisions))
+	for _, d := range decisions {
+		t.Logf("Decision flag %s, relativePath: %s", d.Flag.ToString(), d.RelativePath)
+	}
+
+	if len(decisions) != len(s.Expected) {
+		t.Errorf("got %d decisions, expected %d", len(decisions), len(s.Expected))
+	}
+	for _, d := range s.Expected {
+		if !isDecisionPresent(d, decisions) {
+			t.Errorf("missing decision %s on %s", d.Flag.ToString(), d.RelativePath)
+		}
+	}
+
+	conflict := false
+	for _, d := range decisions {
+		err, ok := p.CheckDecision(ctx, d)
+		if err != nil {
+			t.Fatalf("checking decision %s on %s: %v", d.Flag.ToString(), d.RelativePath, err)
+		}
+		if !ok {
+			t.Errorf("decision %s on %s is obsolete", d.Flag.ToString(), d.RelativePath)
+		}
+		conflict = conflict || d.Flag == fsync.DecisionConflict
+	}
+
+	execOpts := &fsync.ExecutorOptions{}
+	if s.Options != nil {
+		execOpts.Base = s.Options.Base
+	}
+	e := fsync.NewExecutor(l, r, nil, execOpts)
+	for _, d := range decisions {
+		if err := e.Execute(ctx, d); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	if !conflict {
+		AssertConverged(t, l, r, s.Options)
+	}
+
+	return l, r
+}
+
+// Decisions returns the decisions of an initial sync without executing them
+func Decisions(t testing.TB, l fsync.LocalFS, r fsync.RemoteFS, opts *fsync.Options) []fsync.Decision {
+	t.Helper()
+
+	decisions := []fsync.Decision{}
+	cb := fsync.DecisionCallback(func(ctx context.Context, d fsync.Decision) error {
+		decisions = append(decisions, d)
+		return ctx.Err()
+	})
+
+	if err := fsync.NewProvider(l, r, cb, opts).DoInitialSync(context.Background()); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+	return decisions
+}
+
+// AssertConverged checks that a sync takes no decision
+// and that the items present on both sides have the same kind and content and are commited
+func AssertConverged(t testing.TB, l LocalFS, r RemoteFS, opts *fsync.Options) {
+	t.Helper()
+
+	for _, d := range Decisions(t, l, r, opts) {
+		t.Errorf("not converged: decision %s on %s", d.Flag.ToString(), d.RelativePath)
+	}
+
+	local := map[string]fsync.LocalItem{}
+	for _, li := range l.Items() {
+		local[li.RelativePath] = li
+	}
+	for _, ri := range r.Items() {
+		li, ok := local[ri.RelativePath]
+		if !ok {
+			continue
+		}
+		if li.Dir != ri.Dir {
+			t.Errorf("not converged: %s is a dir on one side only", ri.RelativePath)
+			continue
+		}
+		if li.Commited != fsync.CommitedYes {
+			t.Errorf("not converged: %s is %s", ri.RelativePath, li.Commited.ToString())
+		}
+		if ri.Dir {
+			continue
+		}
+		ld, _ := l.Data(ri.RelativePath)
+		rd, _ := r.Data(ri.RelativePath)
+		if ld != rd {
+			t.Errorf("not converged: %s is %q locally and %q remotely", ri.RelativePath, ld, rd)
+		}
+	}
+}
+
+func isDecisionPresent(d fsync.Decision, in []fsync.Decision) bool {
+	for _, d2 := range in {
+		if d.Flag == d2.Flag && d.RelativePath == d2.RelativePath {
+			return true
+		}
+	}
+	return false
+}
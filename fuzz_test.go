@@ -0,0 +1,566 @@
+package fsync_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	// fuzzTree is a random pair of local and remote trees and the options to sync them
+	fuzzTree struct {
+		local  fsync.LocalItems
+		remote fsync.RemoteItems
+		opts   *fsync.Options
+		policy int
+		// plan executes the decisions with Plan.Apply instead of the DecisionCallback
+		plan bool
+		// paged lists the children one by one, in the reverse order on the remote side,
+		// so that the dirs are checked while they are listed
+		paged bool
+		// remoteData are the local files commited from a remote file without etag.
+		// They contain the path like the remote file instead of their etag
+		remoteData []string
+	}
+
+	// pagedFuzzLocalFS lists the children one by one
+	pagedFuzzLocalFS struct {
+		fsynctest.LocalFS
+	}
+
+	// pagedFuzzRemoteFS lists the children one by one, from the last one
+	pagedFuzzRemoteFS struct {
+		fsynctest.RemoteFS
+	}
+
+	// fuzzData is the content of a file before the sync
+	fuzzData struct {
+		relativePath string
+		data         string
+		local        bool
+	}
+)
+
+const (
+	fuzzKindNone = iota
+	fuzzKindFile
+	fuzzKindDir
+)
+
+const (
+	fuzzPolicyManual = iota
+	fuzzPolicyRemoteWins
+	fuzzPolicyLocalWins
+	fuzzPolicyKeepBoth
+)
+
+var (
+	fuzzNames = []string{"a", "b", "c"}
+
+	fuzzPolicies = []fsync.ConflictPolicy{
+		fuzzPolicyManual:     nil,
+		fuzzPolicyRemoteWins: fsync.ConflictPolicyRemoteWins,
+		fuzzPolicyLocalWins:  fsync.ConflictPolicyLocalWins,
+		fuzzPolicyKeepBoth:   fsync.ConflictPolicyKeepBoth,
+	}
+
+	fuzzComparisons = []fsync.ComparisonStrategy{fsync.CompareEtag, fsync.CompareContentHash, fsync.CompareSizeModTime, fsync.CompareEtag}
+)
+
+// newFuzzTree decodes the options from the first two bytes of the input
+// and the trees from the next ones, one byte per path of a tree of depth 3.
+//
+// The first byte enables DeleteNonEmptyFolder, Concurrency, DetectMoves, a ConflictPolicy,
+// a base snapshot and the execution with Plan.Apply.
+// The second one selects the Comparison, ignores the items named "c", excludes "/b"
+// and lists the children by pages.
+//
+// A path byte gives the kind of the local and remote items, the CommitedFlag of the local item,
+// whether the remote file changed since it was commited, whether it has no etag
+// and whether its content is shared with other files of the dir (copies and renames).
+// The trees are valid: the parents are dirs, the sub-items of a new local dir are new
+// and the sub-items of a local dir awaiting remote deletion await it too
+func newFuzzTree(data []byte) fuzzTree {
+	t := fuzzTree{opts: &fsync.Options{}}
+	next := func() int {
+		if len(data) == 0 {
+			return 0
+		}
+		b := int(data[0])
+		data = data[1:]
+		return b
+	}
+
+	options := next()
+	t.opts.RemoteFSDeleteNonEmptyFolder = options&1 != 0
+	t.opts.LocalFSDeleteNonEmptyFolder = options&2 != 0
+	if options&4 != 0 {
+		t.opts.Concurrency = 4
+	}
+	t.opts.DetectMoves = options&8 != 0
+	t.policy = (options >> 4) & 3
+	t.opts.ConflictPolicy = fuzzPolicies[t.policy]
+	if options&64 != 0 {
+		t.opts.Base = fsync.NewBaseSnapshot()
+	}
+	t.plan = options&128 != 0
+
+	options = next()
+	t.opts.Comparison = fuzzComparisons[options&3]
+	if options&4 != 0 {
+		t.opts.Ignore = &fsync.IgnoreRules{Patterns: []string{"c"}}
+	}
+	if options&8 != 0 {
+		t.opts.ExcludedPaths = []string{"/b"}
+	}
+	t.paged = options&16 != 0
+
+	var walk func(dir string, localDir *fsync.LocalItem, remoteDir bool, depth int)
+	walk = func(dir string, localDir *fsync.LocalItem, remoteDir bool, depth int) {
+		if depth == 3 {
+			return
+		}
+		for _, name := range fuzzNames {
+			b := next()
+			p := path.Join(dir, name)
+
+			localKind, remoteKind := b%3, (b/3)%3
+			flag := fsync.CommitedFlag((b / 9) % 3)
+			remoteChanged := (b/27)%2 == 1
+			noEtag := (b/54)%2 == 1
+
+			// The files of a dir with the same identity have the same content
+			identity := p
+			if b/108 > 0 {
+				identity = path.Join(dir, fmt.Sprintf("#%d", b/108))
+			}
+
+			// The remote file as it was commited, and as it is
+			commited := fsync.RemoteItem{RelativePath: p, Etag: "v1:" + identity}
+			ri := fsync.RemoteItem{RelativePath: p, Etag: "v1:" + identity}
+			if remoteChanged {
+				ri.Etag = "v2:" + identity
+			}
+			if noEtag {
+				// The derived etags are unique as the remote files without etag contain their path
+				commited = fsync.RemoteItem{RelativePath: p, ContentHash: "v1:" + p, HashAlgorithm: "test", ModTime: time.Unix(1, int64(b)), Size: int64(len(p))}
+				ri = commited
+				if remoteChanged {
+					ri.ContentHash = "v2:" + p
+					ri.ModTime = time.Unix(2, int64(b))
+				}
+			}
+
+			var li *fsync.LocalItem
+			if localKind != fuzzKindNone {
+				if localDir != nil && localDir.Commited != fsync.CommitedYes {
+					flag = localDir.Commited
+				}
+				// The distinct ModTime tells the base the files apart
+				li = &fsync.LocalItem{RelativePath: p, Dir: localKind == fuzzKindDir, Commited: flag, FileID: identity, ModTime: time.Unix(3, int64(len(t.local)))}
+				if !li.Dir && flag != fsync.CommitedNo {
+					li.Etag = commited.Etag
+					if noEtag && t.opts.Comparison != fsync.CompareEtag {
+						li.Etag = t.opts.Comparison.Etag(commited)
+						if flag == fsync.CommitedYes {
+							t.remoteData = append(t.remoteData, p)
+						}
+					}
+				}
+				if !li.Dir && flag == fsync.CommitedNo {
+					// A new local file contains its path, like a remote file without etag
+					li.ContentHash, li.HashAlgorithm = "v1:"+p, "test"
+				}
+				t.local = append(t.local, *li)
+			}
+
+			if remoteKind != fuzzKindNone {
+				if remoteKind == fuzzKindDir {
+					ri = fsync.RemoteItem{RelativePath: p, Dir: true}
+				}
+				t.remote = append(t.remote, ri)
+			}
+
+			localIsDir := localKind == fuzzKindDir
+			remoteIsDir := remoteKind == fuzzKindDir
+			if localIsDir || remoteIsDir {
+				if !localIsDir {
+					li = nil
+				}
+				walk(p, li, remoteIsDir, depth+1)
+			}
+		}
+	}
+	// The local root dir is commited
+	walk("/", &fsync.LocalItem{Commited: fsync.CommitedYes}, true, 0)
+
+	// Dropping the items of a side whose parent is not a dir on this side
+	local := fsync.LocalItems{}
+	localDirs := map[string]bool{"/": true}
+	for _, li := range t.local {
+		if localDirs[path.Dir(li.RelativePath)] {
+			local = append(local, li)
+			localDirs[li.RelativePath] = li.Dir
+		}
+	}
+	remote := fsync.RemoteItems{}
+	remoteDirs := map[string]bool{"/": true}
+	for _, ri := range t.remote {
+		if remoteDirs[path.Dir(ri.RelativePath)] {
+			remote = append(remote, ri)
+			remoteDirs[ri.RelativePath] = ri.Dir
+		}
+	}
+	remoteData := []string{}
+	for _, p := range t.remoteData {
+		if _, ok := localDirs[p]; ok {
+			remoteData = append(remoteData, p)
+		}
+	}
+	t.local, t.remote, t.remoteData = local, remote, remoteData
+
+	return t
+}
+
+// onePage returns the page of a single item of a listing of n items
+func onePage(pageToken string, n int) (k int, nextPageToken string, err error) {
+	if pageToken != "" {
+		if k, err = strconv.Atoi(pageToken); err != nil {
+			return 0, "", err
+		}
+	}
+	if k+1 < n {
+		nextPageToken = strconv.Itoa(k + 1)
+	}
+	return k, nextPageToken, nil
+}
+
+func (l pagedFuzzLocalFS) GetChildrenPage(ctx context.Context, relativePath string, pageToken string) (fsync.LocalItems, string, error) {
+	lis, err := l.GetChildren(relativePath)
+	if err != nil || len(lis) == 0 {
+		return nil, "", err
+	}
+	k, next, err := onePage(pageToken, len(lis))
+	if err != nil {
+		return nil, "", err
+	}
+	return lis[k : k+1], next, nil
+}
+
+func (r pagedFuzzRemoteFS) GetChildrenPage(ctx context.Context, relativePath string, pageToken string) (fsync.RemoteItems, string, error) {
+	ris, err := r.GetChildren(relativePath)
+	if err != nil || len(ris) == 0 {
+		return nil, "", err
+	}
+	k, next, err := onePage(pageToken, len(ris))
+	if err != nil {
+		return nil, "", err
+	}
+	k = len(ris) - 1 - k
+	return ris[k : k+1], next, nil
+}
+
+// newFS seeds the file systems and the base snapshot with the trees
+func (tree fuzzTree) newFS(t *testing.T) (fsynctest.LocalFS, fsynctest.RemoteFS) {
+	l := fsynctest.NewLocalFS(tree.local...)
+	r := fsynctest.NewRemoteFS(tree.remote...)
+
+	for _, p := range tree.remoteData {
+		li, err := l.Stat(p)
+		require.NoError(t, err)
+		w, err := l.Create(p)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(p))
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		require.NoError(t, l.Commit(p, li.Etag))
+	}
+
+	// The base holds the commited items, as they are now
+	if tree.opts.Base != nil {
+		for _, li := range l.Items() {
+			if li.Commited == fsync.CommitedNo {
+				continue
+			}
+			require.NoError(t, tree.opts.Base.Set(fsync.BaseItem{
+				RelativePath:  li.RelativePath,
+				Dir:           li.Dir,
+				Etag:          li.Etag,
+				Size:          li.Size,
+				ModTime:       li.ModTime,
+				ContentHash:   li.ContentHash,
+				HashAlgorithm: li.HashAlgorithm,
+				FileID:        li.FileID,
+			}))
+		}
+	}
+
+	if tree.paged {
+		return pagedFuzzLocalFS{l}, pagedFuzzRemoteFS{r}
+	}
+	return l, r
+}
+
+// rounds is the number of syncs needed to converge. The sub-items of a moved dir,
+// of a dir replacing a file in a resolved conflict and the conflict copies are synced by the next sync
+func (tree fuzzTree) rounds() int {
+	rounds := 1
+	if tree.opts.DetectMoves {
+		rounds++
+	}
+	if tree.policy != fuzzPolicyManual {
+		rounds++
+	}
+	return rounds
+}
+
+// synced returns false for the items which are not expected to be the same on both sides
+func (tree fuzzTree) synced(ri fsync.RemoteItem) bool {
+	if tree.opts.Ignore != nil && isIgnoredName(ri.RelativePath, "c") {
+		return false
+	}
+	if isUnderAny(ri.RelativePath, tree.opts.ExcludedPaths) {
+		return false
+	}
+	return ri.Dir || tree.opts.Comparison.Etag(ri) != ""
+}
+
+// overwrites returns true when the decision legitimately replaces the data at itemPath
+func (tree fuzzTree) overwrites(d fsync.Decision, itemPath string, local bool) bool {
+	switch d.Flag {
+	case fsync.DecisionDeleteLocal, fsync.DecisionDeleteLocalAndCreateDirLocal, fsync.DecisionDeleteLocalAndDownloadRemote:
+		return local && isUnder(itemPath, d.RelativePath)
+	case fsync.DecisionDeleteRemote:
+		return !local && isUnder(itemPath, d.RelativePath)
+	case fsync.DecisionDownloadRemote:
+		// The remote file wins the conflicts
+		return local && tree.policy == fuzzPolicyRemoteWins && itemPath == d.RelativePath
+	case fsync.DecisionUploadLocal:
+		// The local file wins the conflicts, or a modified local file replaces its unchanged remote version
+		return !local && (tree.policy == fuzzPolicyLocalWins || d.Why.LocalItemEtag == d.RemoteValidEtag) && itemPath == d.RelativePath
+	}
+	return false
+}
+
+// moved returns the path of the item after the decision
+func moved(d fsync.Decision, itemPath string, local bool) string {
+	switch d.Flag {
+	case fsync.DecisionRenameLocal:
+		if !local {
+			return itemPath
+		}
+	case fsync.DecisionMoveLocal, fsync.DecisionMoveRemote:
+	default:
+		return itemPath
+	}
+	if !isUnder(itemPath, d.FromRelativePath) {
+		return itemPath
+	}
+	return d.RelativePath + strings.TrimPrefix(itemPath, d.FromRelativePath)
+}
+
+func isIgnoredName(itemPath, name string) bool {
+	for _, s := range strings.Split(itemPath, "/") {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnder(itemPath, dir string) bool {
+	return itemPath == dir || (len(itemPath) > len(dir) && itemPath[:len(dir)] == dir && itemPath[len(dir)] == '/')
+}
+
+func isUnderAny(itemPath string, dirs []string) bool {
+	for _, dir := range dirs {
+		if isUnder(itemPath, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRound takes the decisions of a sync, checks them with CheckDecision and executes them
+func syncRound(t *testing.T, tree fuzzTree, l fsynctest.LocalFS, r fsynctest.RemoteFS) []fsync.Decision {
+	ctx := context.Background()
+
+	p := fsync.NewProvider(l, r, nil, tree.opts)
+	e := fsync.NewExecutor(l, r, nil, &fsync.ExecutorOptions{Base: tree.opts.Base, Comparison: tree.opts.Comparison})
+
+	var pl fsync.Plan
+	if tree.plan {
+		var err error
+		pl, err = p.Plan(ctx, "/")
+		require.NoError(t, err)
+	} else {
+		pl.Decisions = fsynctest.Decisions(t, l, r, tree.opts)
+	}
+
+	for _, d := range pl.Decisions {
+		err, ok := p.CheckDecision(ctx, d)
+		require.NoError(t, err)
+		require.True(t, ok, "CheckDecision disagrees with %s on %s", d.Flag.ToString(), d.RelativePath)
+	}
+
+	if tree.plan {
+		require.NoError(t, pl.Apply(ctx, e.Execute))
+	} else {
+		for _, d := range pl.Decisions {
+			require.NoError(t, e.Execute(ctx, d))
+		}
+	}
+	return pl.Decisions
+}
+
+// checkConvergence syncs the trees and asserts the invariants of the decision engine
+func checkConvergence(t *testing.T, tree fuzzTree) {
+	l, r := tree.newFS(t)
+
+	// The new local files and the remote files must not be lost without a decision deleting or replacing them
+	before := []fuzzData{}
+	for _, li := range l.Items() {
+		if !li.Dir && li.Commited == fsync.CommitedNo {
+			data, _ := l.Data(li.RelativePath)
+			before = append(before, fuzzData{relativePath: li.RelativePath, data: data, local: true})
+		}
+	}
+	for _, ri := range r.Items() {
+		if !ri.Dir {
+			data, _ := r.Data(ri.RelativePath)
+			before = append(before, fuzzData{relativePath: ri.RelativePath, data: data})
+		}
+	}
+
+	decisions := []fsync.Decision{}
+	last := []fsync.Decision{}
+	for k := 0; k < tree.rounds(); k++ {
+		last = syncRound(t, tree, l, r)
+		decisions = append(decisions, last...)
+	}
+
+	// The conflicts left to an external resolution are the only decisions of the next sync
+	conflicts := []string{}
+	for _, d := range fsynctest.Decisions(t, l, r, tree.opts) {
+		if d.Flag != fsync.DecisionConflict || !IsDecisionPresent(d, last) {
+			t.Errorf("not converged: decision %s on %s", d.Flag.ToString(), d.RelativePath)
+		}
+		conflicts = append(conflicts, d.RelativePath)
+	}
+
+	local := map[string]fsync.LocalItem{}
+	for _, li := range l.Items() {
+		local[li.RelativePath] = li
+	}
+	for _, ri := range r.Items() {
+		li, ok := local[ri.RelativePath]
+		if !ok || isUnderAny(ri.RelativePath, conflicts) || !tree.synced(ri) {
+			continue
+		}
+		require.Equal(t, ri.Dir, li.Dir, ri.RelativePath)
+		require.Equal(t, fsync.CommitedYes, li.Commited, ri.RelativePath)
+		ld, _ := l.Data(ri.RelativePath)
+		rd, _ := r.Data(ri.RelativePath)
+		require.Equal(t, rd, ld, ri.RelativePath)
+	}
+
+	after := map[string]bool{}
+	for _, li := range l.Items() {
+		if data, ok := l.Data(li.RelativePath); ok && li.Commited != fsync.CommitedAwaitingRemoteDeletion {
+			after[data] = true
+		}
+	}
+	for _, ri := range r.Items() {
+		if data, ok := r.Data(ri.RelativePath); ok {
+			after[data] = true
+		}
+	}
+
+	for _, b := range before {
+		if after[b.data] {
+			continue
+		}
+		overwritten := false
+		p := b.relativePath
+		for _, d := range decisions {
+			overwritten = overwritten || tree.overwrites(d, p, b.local)
+			p = moved(d, p, b.local)
+		}
+		if !overwritten {
+			t.Errorf("%s lost without a delete decision (local: %v)", b.relativePath, b.local)
+		}
+	}
+}
+
+func logFuzzTree(t *testing.T, tree fuzzTree) {
+	o := tree.opts
+	t.Logf("options: delete non-empty folder remote: %v local: %v, concurrency: %d, moves: %v, policy: %d, base: %v, plan: %v, comparison: %d, ignore: %v, excluded: %v, paged: %v",
+		o.RemoteFSDeleteNonEmptyFolder, o.LocalFSDeleteNonEmptyFolder, o.Concurrency, o.DetectMoves, tree.policy, o.Base != nil, tree.plan, o.Comparison, o.Ignore != nil, o.ExcludedPaths, tree.paged)
+	for _, li := range tree.local {
+		t.Logf("local %s dir: %v, %s, etag: %s, file id: %s", li.RelativePath, li.Dir, li.Commited.ToString(), li.Etag, li.FileID)
+	}
+	for _, ri := range tree.remote {
+		t.Logf("remote %s dir: %v, etag: %s, hash: %s", ri.RelativePath, ri.Dir, ri.Etag, ri.ContentHash)
+	}
+}
+
+func FuzzConvergence(f *testing.F) {
+	f.Add([]byte{})
+	// Everything in sync
+	f.Add([]byte{0, 0, 4, 4, 4, 4, 4, 4, 8, 8, 8})
+	// New local items, remote changes, local deletions
+	f.Add([]byte{4, 0, 11, 32, 19, 5, 1, 31, 20, 2, 45, 8, 22})
+	// Kind conflicts
+	f.Add([]byte{3, 0, 7, 5, 14, 16, 23, 2, 6, 17, 26})
+	// Kind conflicts resolved by every policy, executed with Plan.Apply
+	f.Add([]byte{0x10, 0, 7, 5, 14, 16, 23, 2, 6, 17, 26})
+	f.Add([]byte{0xa0, 0, 7, 5, 14, 16, 23, 2, 6, 17, 26})
+	f.Add([]byte{0xb3, 0, 7, 5, 14, 16, 23, 2, 6, 17, 26})
+	// Renames with shared contents, with a base
+	f.Add([]byte{0x48, 0, 112, 130, 229, 121, 139, 238, 112, 130})
+	// Remote files without etag, ignored and excluded items
+	f.Add([]byte{0, 13, 58, 85, 67, 139, 58, 85, 8, 4})
+	f.Add([]byte{0x40, 14, 58, 85, 67, 139, 58, 85, 8, 4})
+	// Dirs checked while they are listed, with moves
+	f.Add([]byte{0x0c, 16, 11, 32, 19, 5, 1, 31, 20, 2, 45, 8, 22})
+	f.Add([]byte{0x08, 16, 112, 130, 229, 121, 139, 238, 112, 130})
+
+	// Every paged listing is streamed
+	defer fsync.SetMaxBufferedChildren(1)()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tree := newFuzzTree(data)
+		logFuzzTree(t, tree)
+		checkConvergence(t, tree)
+	})
+}
+
+// TestConvergenceRandom checks the invariants of FuzzConvergence with random trees and options
+func TestConvergenceRandom(t *testing.T) {
+	defer fsync.SetMaxBufferedChildren(1)()
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, 2+rnd.Intn(40))
+		rnd.Read(data)
+		tree := newFuzzTree(data)
+
+		ok := t.Run("", func(t *testing.T) {
+			checkConvergence(t, tree)
+		})
+		if !ok {
+			t.Logf("input %v", data)
+			logFuzzTree(t, tree)
+			return
+		}
+	}
+}
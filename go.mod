@@ -3,14 +3,19 @@ module github.com/fenritec/go-fsync
 go 1.18
 
 require (
+	github.com/pkg/sftp v1.13.6
 	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.19.0
 	gotest.tools v2.2.0+incompatible
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,154 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+type (
+	// MassDeletionGuard holds back the deletions of a check when there are too many of them,
+	// e.g. when a buggy file system returns an empty listing
+	MassDeletionGuard struct {
+		// MaxDeletions is the number of deletions allowed on each side. 0 disables the limit
+		MaxDeletions int
+		// MaxDeletionPercent is the percentage of the listed items of each side which can be deleted. 0 disables the limit.
+		// Every child of a listed dir is counted, even when only some of them are checked (e.g. by Run)
+		MaxDeletionPercent float64
+		// MinItemsForPercent is the number of listed items of a side below which MaxDeletionPercent is not applied
+		MinItemsForPercent int
+		// Confirm is called when a limit is exceeded, before any decision reaches the DecisionCallback.
+		// The decisions are taken when it returns true. Without Confirm the check fails with a *MassDeletionError
+		Confirm func(ctx context.Context, err *MassDeletionError) (bool, error)
+	}
+
+	// MassDeletionError is returned when a check exceeds the limits of the MassDeletionGuard
+	MassDeletionError struct {
+		RelativePath    string
+		LocalDeletions  int
+		RemoteDeletions int
+		LocalItems      int
+		RemoteItems     int
+	}
+
+	// deletionTally counts the listed items of a guarded check by listed dir
+	deletionTally struct {
+		localItems  map[string]int
+		remoteItems map[string]int
+	}
+
+	deletionTallyKey struct{}
+)
+
+var (
+	ErrMassDeletion = errors.New("fsync: too many deletions")
+)
+
+func (e *MassDeletionError) Error() string {
+	return fmt.Sprintf("%s: checking %s would delete %d of %d local items and %d of %d remote items",
+		ErrMassDeletion, e.RelativePath, e.LocalDeletions, e.LocalItems, e.RemoteDeletions, e.RemoteItems)
+}
+
+func (e *MassDeletionError) Unwrap() error {
+	return ErrMassDeletion
+}
+
+func (g *MassDeletionGuard) exceeded(deletions, items int) bool {
+	if g.MaxDeletions > 0 && deletions > g.MaxDeletions {
+		return true
+	}
+	if g.MaxDeletionPercent > 0 && items > 0 && items >= g.MinItemsForPercent {
+		return float64(deletions)*100 > g.MaxDeletionPercent*float64(items)
+	}
+	return false
+}
+
+func deletionTallyFrom(ctx context.Context) *deletionTally {
+	t, _ := ctx.Value(deletionTallyKey{}).(*deletionTally)
+	return t
+}
+
+// count records the number of children listed in a dir on each side
+func (t *deletionTally) count(relativePath string, localListed, remoteListed int) {
+	if t == nil {
+		return
+	}
+	t.localItems[relativePath] = localListed
+	t.remoteItems[relativePath] = remoteListed
+}
+
+// listedBelow returns the number of items listed in the subtree of relativePath, or in the whole check
+func listedBelow(items map[string]int, relativePath string) int {
+	n := 0
+	for p, c := range items {
+		if relativePath == "" || isChildPath(p, relativePath) {
+			n += c
+		}
+	}
+	return n
+}
+
+// deletions returns the number of items deleted by the decisions on each side.
+// A dir deleted at once with the DeleteNonEmptyFolder options covers its listed sub-items
+func (p *provider) deletions(t *deletionTally, decisions []Decision) (local, remote int) {
+	for _, d := range decisions {
+		switch d.Flag {
+		case DecisionDeleteLocal:
+			local++
+			if d.RemoteIsDir && p.localFSDeleteNonEmptyFolder {
+				local += listedBelow(t.localItems, d.RelativePath)
+			}
+		case DecisionDeleteRemote:
+			remote++
+			if d.RemoteIsDir && p.remoteFSDeleteNonEmptyFolder {
+				remote += listedBelow(t.remoteItems, d.RelativePath)
+			}
+		}
+	}
+	return
+}
+
+// guardDeletions runs the check with the mass-deletion guard.
+// The decisions are held back until the deletions are counted
+func (p *provider) guardDeletions(ctx context.Context, relativePath string, takeDecision DecisionCallback, check func(ctx context.Context, takeDecision DecisionCallback) error) error {
+	if p.massDeletionGuard == nil {
+		return check(ctx, takeDecision)
+	}
+
+	t := &deletionTally{localItems: map[string]int{}, remoteItems: map[string]int{}}
+	decisions := []Decision{}
+	err := check(context.WithValue(ctx, deletionTallyKey{}, t), func(ctx context.Context, d Decision) error {
+		decisions = append(decisions, d)
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	mdErr := &MassDeletionError{
+		RelativePath: relativePath,
+		LocalItems:   listedBelow(t.localItems, ""),
+		RemoteItems:  listedBelow(t.remoteItems, ""),
+	}
+	mdErr.LocalDeletions, mdErr.RemoteDeletions = p.deletions(t, decisions)
+	g := p.massDeletionGuard
+	if g.exceeded(mdErr.LocalDeletions, mdErr.LocalItems) || g.exceeded(mdErr.RemoteDeletions, mdErr.RemoteItems) {
+		if g.Confirm == nil {
+			return mdErr
+		}
+		confirmed, err := g.Confirm(ctx, mdErr)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			return mdErr
+		}
+	}
+
+	for _, d := range decisions {
+		if err := takeDecision(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package fsync_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestMassDeletionGuard(t *testing.T) {
+	// The remote listing is empty: every commited local item would be deleted
+	localStatus := fsync.LocalItems{}
+	for k := 0; k < 10; k++ {
+		localStatus = append(localStatus, fsync.LocalItem{RelativePath: fmt.Sprintf("/f%d", k), Etag: "v1", Commited: fsync.CommitedYes})
+	}
+	localStatus = append(localStatus, fsync.LocalItem{RelativePath: "/new", Commited: fsync.CommitedNo})
+
+	check := func(t *testing.T, guard *fsync.MassDeletionGuard) ([]fsync.Decision, error) {
+		lFS := fsynctest.NewLocalFS(localStatus...)
+		rFS := fsynctest.NewRemoteFS()
+
+		decisions := []fsync.Decision{}
+		p := fsync.NewProvider(lFS, rFS, func(ctx context.Context, d fsync.Decision) error {
+			decisions = append(decisions, d)
+			return nil
+		}, &fsync.Options{MassDeletionGuard: guard})
+		return decisions, p.DoInitialSync(context.Background())
+	}
+
+	t.Run("Absolute limit", func(t *testing.T) {
+		decisions, err := check(t, &fsync.MassDeletionGuard{MaxDeletions: 5})
+		require.ErrorIs(t, err, fsync.ErrMassDeletion)
+		assert.Equal(t, 0, len(decisions))
+
+		var mdErr *fsync.MassDeletionError
+		require.True(t, errors.As(err, &mdErr))
+		assert.DeepEqual(t, fsync.MassDeletionError{RelativePath: "/", LocalDeletions: 10, LocalItems: 11}, *mdErr)
+	})
+
+	t.Run("Percentage limit", func(t *testing.T) {
+		_, err := check(t, &fsync.MassDeletionGuard{MaxDeletionPercent: 50})
+		require.ErrorIs(t, err, fsync.ErrMassDeletion)
+
+		// Too few items to apply the percentage
+		decisions, err := check(t, &fsync.MassDeletionGuard{MaxDeletionPercent: 50, MinItemsForPercent: 20})
+		require.NoError(t, err)
+		assert.Equal(t, 11, len(decisions))
+	})
+
+	t.Run("Below the limits", func(t *testing.T) {
+		decisions, err := check(t, &fsync.MassDeletionGuard{MaxDeletions: 10, MaxDeletionPercent: 95})
+		require.NoError(t, err)
+		assert.Equal(t, 11, len(decisions))
+	})
+
+	t.Run("Confirmation hook", func(t *testing.T) {
+		confirmed := false
+		guard := &fsync.MassDeletionGuard{
+			MaxDeletions: 5,
+			Confirm: func(ctx context.Context, err *fsync.MassDeletionError) (bool, error) {
+				assert.Equal(t, 10, err.LocalDeletions)
+				return confirmed, nil
+			},
+		}
+
+		decisions, err := check(t, guard)
+		require.ErrorIs(t, err, fsync.ErrMassDeletion)
+		assert.Equal(t, 0, len(decisions))
+
+		confirmed = true
+		decisions, err = check(t, guard)
+		require.NoError(t, err)
+		assert.Equal(t, 11, len(decisions))
+	})
+}
+
+func TestMassDeletionGuardDirs(t *testing.T) {
+	// The remote listing is empty: the commited local dir would be deleted
+	newLocalFS := func() fsynctest.LocalFS {
+		items := []fsync.LocalItem{{RelativePath: "/docs", Dir: true, Commited: fsync.CommitedYes}}
+		for k := 0; k < 10; k++ {
+			items = append(items, fsync.LocalItem{RelativePath: fmt.Sprintf("/docs/f%d", k), Etag: "v1", Commited: fsync.CommitedYes})
+		}
+		return fsynctest.NewLocalFS(items...)
+	}
+	guard := &fsync.MassDeletionGuard{MaxDeletions: 5}
+
+	t.Run("Dir deleted at once", func(t *testing.T) {
+		decisions := []fsync.Decision{}
+		p := fsync.NewProvider(newLocalFS(), fsynctest.NewRemoteFS(), func(ctx context.Context, d fsync.Decision) error {
+			decisions = append(decisions, d)
+			return nil
+		}, &fsync.Options{MassDeletionGuard: guard, LocalFSDeleteNonEmptyFolder: true})
+		err := p.DoInitialSync(context.Background())
+		require.ErrorIs(t, err, fsync.ErrMassDeletion)
+		assert.Equal(t, 0, len(decisions))
+
+		var mdErr *fsync.MassDeletionError
+		require.True(t, errors.As(err, &mdErr))
+		assert.DeepEqual(t, fsync.MassDeletionError{RelativePath: "/", LocalDeletions: 11, LocalItems: 11}, *mdErr)
+	})
+
+	t.Run("Plan", func(t *testing.T) {
+		p := fsync.NewProvider(newLocalFS(), fsynctest.NewRemoteFS(), nil, &fsync.Options{MassDeletionGuard: guard, LocalFSDeleteNonEmptyFolder: true})
+		_, err := p.Plan(context.Background(), "/")
+		require.ErrorIs(t, err, fsync.ErrMassDeletion)
+	})
+}
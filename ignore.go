@@ -0,0 +1,330 @@
+package fsync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+type (
+	// IgnoreRules excludes items from the synchronization with gitignore patterns.
+	// An excluded item never produces a decision and its sub-items are not inspected
+	IgnoreRules struct {
+		// Patterns exclude the local and the remote items
+		Patterns []string
+		// LocalPatterns exclude the local items only (e.g. editor swap files)
+		LocalPatterns []string
+		// RemotePatterns exclude the remote items only (e.g. temporary upload parts)
+		RemotePatterns []string
+		// FileName is the name of the per-dir ignore files (e.g. ".fsyncignore") read through LocalFS.
+		// Their patterns are relative to their dir and exclude the items of both sides
+		FileName string
+	}
+
+	// LocalFSOpener is implemented by the LocalFS able to read the per-dir ignore files
+	LocalFSOpener interface {
+		Open(itemPath string) (io.ReadCloser, error)
+	}
+
+	ignoreRule struct {
+		// base is the dir of the ignore file defining the rule
+		base     string
+		segments []string
+		negate   bool
+		dirOnly  bool
+		anchored bool
+	}
+
+	ignoreMatcher struct {
+		local  []ignoreRule
+		remote []ignoreRule
+	}
+
+	// ignoreFiles caches the parsed ignore files of a traversal by dir
+	ignoreFiles struct {
+		mu    sync.Mutex
+		rules map[string][]ignoreRule
+	}
+
+	ignoreFilesKey struct{}
+)
+
+// parseIgnoreRule parses a gitignore line relative to the base dir
+func parseIgnoreRule(base, line string) (ignoreRule, bool) {
+	r := ignoreRule{base: base}
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// A slash at the beginning or in the middle anchors the pattern to the base dir
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+
+	if line == "" {
+		return r, false
+	}
+
+	r.segments = strings.Split(line, "/")
+	for _, s := range r.segments {
+		if _, err := path.Match(s, ""); err != nil {
+			return r, false
+		}
+	}
+
+	return r, true
+}
+
+func parseIgnoreRules(base string, lines []string) []ignoreRule {
+	rules := []ignoreRule{}
+	for _, line := range lines {
+		if r, ok := parseIgnoreRule(base, line); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func (r ignoreRule) match(relativePath string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+
+	var rel string
+	if r.base == "/" {
+		rel = strings.TrimPrefix(relativePath, "/")
+	} else if strings.HasPrefix(relativePath, r.base+"/") {
+		rel = strings.TrimPrefix(relativePath, r.base+"/")
+	} else {
+		return false
+	}
+
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches the path segments where "**" matches any number of segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return len(name) > 0
+			}
+			for k := 0; k < len(name); k++ {
+				if matchSegments(pattern, name[k:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// matchRules returns true when the last matching rule is not a negation
+func matchRules(rules []ignoreRule, relativePath string, dir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.match(relativePath, dir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func newIgnoreMatcher(rules *IgnoreRules) *ignoreMatcher {
+	if rules == nil {
+		return nil
+	}
+
+	both := parseIgnoreRules("/", rules.Patterns)
+	return &ignoreMatcher{
+		local:  append(append([]ignoreRule{}, both...), parseIgnoreRules("/", rules.LocalPatterns)...),
+		remote: append(append([]ignoreRule{}, both...), parseIgnoreRules("/", rules.RemotePatterns)...),
+	}
+}
+
+// withIgnoreFiles returns a context caching the ignore files read by the traversal
+func withIgnoreFiles(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ignoreFilesKey{}, &ignoreFiles{rules: map[string][]ignoreRule{}})
+}
+
+func ignoreFilesFrom(ctx context.Context) *ignoreFiles {
+	f, _ := ctx.Value(ignoreFilesKey{}).(*ignoreFiles)
+	return f
+}
+
+// ignoreMatcherFor returns the rules applying to the children of relativePath,
+// reading the ignore files of relativePath and of its parents
+func (p *provider) ignoreMatcherFor(ctx context.Context, relativePath string) (*ignoreMatcher, error) {
+	if p.ignore == nil || p.ignoreFileName == "" {
+		return p.ignore, nil
+	}
+
+	opener, ok := p.local.(LocalFSOpener)
+	if !ok {
+		return p.ignore, nil
+	}
+
+	dirs := []string{}
+	for d := path.Clean("/" + relativePath); ; d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+		if d == "/" {
+			break
+		}
+	}
+
+	fileRules := []ignoreRule{}
+	for _, d := range dirs {
+		rules, err := ignoreFilesFrom(ctx).read(opener, d, p.ignoreFileName)
+		if err != nil {
+			return nil, err
+		}
+		fileRules = append(fileRules, rules...)
+	}
+
+	if len(fileRules) == 0 {
+		return p.ignore, nil
+	}
+
+	return &ignoreMatcher{
+		local:  append(append([]ignoreRule{}, p.ignore.local...), fileRules...),
+		remote: append(append([]ignoreRule{}, p.ignore.remote...), fileRules...),
+	}, nil
+}
+
+// read returns the rules of the ignore file of dir, parsed once per traversal
+func (f *ignoreFiles) read(opener LocalFSOpener, dir, fileName string) ([]ignoreRule, error) {
+	if f != nil {
+		f.mu.Lock()
+		rules, ok := f.rules[dir]
+		f.mu.Unlock()
+		if ok {
+			return rules, nil
+		}
+	}
+
+	lines, err := readIgnoreFile(opener, path.Join(dir, fileName))
+	if err != nil {
+		return nil, err
+	}
+	rules := parseIgnoreRules(dir, lines)
+
+	if f != nil {
+		f.mu.Lock()
+		f.rules[dir] = rules
+		f.mu.Unlock()
+	}
+	return rules, nil
+}
+
+// isIgnored returns true when the dir relativePath or one of its parents is ignored
+func (p *provider) isIgnored(ctx context.Context, relativePath string) (bool, error) {
+	if p.ignore == nil {
+		return false, nil
+	}
+
+	dirs := []string{}
+	for d := path.Clean("/" + relativePath); d != "/"; d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+	}
+
+	for _, d := range dirs {
+		m, err := p.ignoreMatcherFor(ctx, path.Dir(d))
+		if err != nil {
+			return false, err
+		}
+		if matchRules(m.local, d, true) || matchRules(m.remote, d, true) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func readIgnoreFile(opener LocalFSOpener, itemPath string) ([]string, error) {
+	r, err := opener.Open(itemPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// filter drops the ignored items of both sides. An item ignored on one side
+// is dropped on the other side too so that it is never overwritten or deleted
+func (m *ignoreMatcher) filter(lis LocalItems, ris RemoteItems) (LocalItems, RemoteItems) {
+	if m == nil || (len(m.local) == 0 && len(m.remote) == 0) {
+		return lis, ris
+	}
+
+	ignored := map[string]bool{}
+	for _, li := range lis {
+		if matchRules(m.local, li.RelativePath, li.Dir) {
+			ignored[li.RelativePath] = true
+		}
+	}
+	for _, ri := range ris {
+		if matchRules(m.remote, ri.RelativePath, ri.Dir) {
+			ignored[ri.RelativePath] = true
+		}
+	}
+	if len(ignored) == 0 {
+		return lis, ris
+	}
+
+	keptLis := make(LocalItems, 0, len(lis))
+	for _, li := range lis {
+		if !ignored[li.RelativePath] {
+			keptLis = append(keptLis, li)
+		}
+	}
+	keptRis := make(RemoteItems, 0, len(ris))
+	for _, ri := range ris {
+		if !ignored[ri.RelativePath] {
+			keptRis = append(keptRis, ri)
+		}
+	}
+	return keptLis, keptRis
+}
@@ -0,0 +1,183 @@
+package fsync_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func testScenarioIgnore(t *testing.T, lst fsync.LocalItems, rst fsync.RemoteItems, expectedDecisions []fsync.Decision, rules *fsync.IgnoreRules) {
+	testScenarioWithOptions(t, lst, rst, expectedDecisions, &fsync.Options{
+		Ignore: rules,
+	})
+}
+
+func TestIgnore(t *testing.T) {
+	t.Run("Gitignore patterns", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/.DS_Store", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedNo},
+			{RelativePath: "/a/.DS_Store", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/a/node_modules", Dir: true, Commited: fsync.CommitedNo},
+			{RelativePath: "/a/node_modules/b", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/a/debug.log", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/a/keep.log", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/build", Dir: true, Commited: fsync.CommitedNo},
+			{RelativePath: "/a/build", Dir: true, Commited: fsync.CommitedNo},
+			{RelativePath: "/docs", Dir: true, Commited: fsync.CommitedNo},
+			{RelativePath: "/docs/c", Dir: true, Commited: fsync.CommitedNo},
+			{RelativePath: "/docs/c/d.tmp", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/docs/e.tmp", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/node_modules", Dir: false, Commited: fsync.CommitedNo},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirRemote},
+			{RelativePath: "/a/keep.log", Flag: fsync.DecisionUploadLocal},
+			{RelativePath: "/a/build", Flag: fsync.DecisionCreateDirRemote},
+			{RelativePath: "/docs", Flag: fsync.DecisionCreateDirRemote},
+			{RelativePath: "/docs/c", Flag: fsync.DecisionCreateDirRemote},
+			{RelativePath: "/node_modules", Flag: fsync.DecisionUploadLocal},
+		}
+
+		testScenarioIgnore(t, localStatus, fsync.RemoteItems{}, expectedDecisions, &fsync.IgnoreRules{
+			Patterns: []string{
+				"# Comment",
+				".DS_Store",
+				"node_modules/",
+				"*.log",
+				"!keep.log",
+				"/build",
+				"docs/**/*.tmp",
+			},
+		})
+	})
+
+	t.Run("Local and remote only patterns", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a.swp", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/b.part", Dir: false, Commited: fsync.CommitedNo},
+			{RelativePath: "/c.swp", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/c.swp", Dir: false, Etag: "v2"},
+			{RelativePath: "/d.swp", Dir: false, Etag: "v1"},
+			{RelativePath: "/e.part", Dir: false, Etag: "v1"},
+		}
+
+		// A remote item is not downloaded over an ignored local item
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/b.part", Flag: fsync.DecisionUploadLocal},
+			{RelativePath: "/d.swp", Flag: fsync.DecisionDownloadRemote},
+		}
+
+		testScenarioIgnore(t, localStatus, remoteStatus, expectedDecisions, &fsync.IgnoreRules{
+			LocalPatterns:  []string{"*.swp"},
+			RemotePatterns: []string{"*.part"},
+		})
+	})
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	opts := &fsync.Options{
+		Ignore: &fsync.IgnoreRules{FileName: ".fsyncignore"},
+	}
+
+	lFS := fsynctest.NewLocalFS()
+	lFS.Write("/.fsyncignore", "*.tmp\n")
+	lFS.Write("/a.tmp", "a")
+	require.NoError(t, lFS.Mkdir("/b"))
+	lFS.Write("/b/.fsyncignore", "!c.tmp\n/d\n")
+	lFS.Write("/b/c.tmp", "c")
+	lFS.Write("/b/d", "d")
+	require.NoError(t, lFS.Mkdir("/b/e"))
+	lFS.Write("/b/e/d", "d")
+	lFS.Write("/b/e/f.tmp", "f")
+
+	rFS := fsynctest.NewRemoteFS()
+	syncWithExecutor(t, lFS, rFS, opts)
+
+	paths := map[string]bool{}
+	for _, ri := range rFS.Items() {
+		paths[ri.RelativePath] = true
+	}
+	assert.DeepEqual(t, map[string]bool{
+		"/.fsyncignore":   true,
+		"/b":              true,
+		"/b/.fsyncignore": true,
+		"/b/c.tmp":        true,
+		"/b/e":            true,
+		"/b/e/d":          true,
+	}, paths)
+
+	// Ignored items are not deleted remotely
+	rFS.Write("/a.tmp", "remote a")
+	results := syncWithExecutor(t, lFS, rFS, opts)
+	assert.Equal(t, 0, len(results))
+}
+
+func TestIgnoreAncestors(t *testing.T) {
+	opts := &fsync.Options{
+		Ignore:      &fsync.IgnoreRules{Patterns: []string{"node_modules/"}, FileName: ".fsyncignore"},
+		ChangeDelay: 10 * time.Millisecond,
+	}
+
+	lFS := fsynctest.NewLocalFS()
+	require.NoError(t, lFS.Mkdir("/node_modules"))
+	require.NoError(t, lFS.Mkdir("/node_modules/a"))
+	lFS.Write("/node_modules/a/b", "b")
+	require.NoError(t, lFS.Mkdir("/c"))
+	lFS.Write("/c/.fsyncignore", "/d\n")
+	require.NoError(t, lFS.Mkdir("/c/d"))
+	lFS.Write("/c/d/e", "e")
+	rFS := fsynctest.NewRemoteFS()
+
+	decisions := make(chan fsync.Decision, 100)
+	p := fsync.NewProvider(lFS, rFS, func(ctx context.Context, d fsync.Decision) error {
+		decisions <- d
+		return nil
+	}, opts)
+
+	t.Run("Checking an ignored dir", func(t *testing.T) {
+		for _, rPath := range []string{"/node_modules", "/node_modules/a", "/c/d"} {
+			require.NoError(t, p.CheckChanges(context.Background(), rPath))
+		}
+		assert.Equal(t, 0, len(decisions))
+	})
+
+	t.Run("Running on the changes of an ignored dir", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- p.Run(ctx)
+		}()
+
+		p.LocalChange(fsync.LocalItem{RelativePath: "/node_modules/a/b"})
+		p.LocalChange(fsync.LocalItem{RelativePath: "/c/d/e"})
+		p.LocalChange(fsync.LocalItem{RelativePath: "/c/.fsyncignore"})
+
+		select {
+		case d := <-decisions:
+			assert.Equal(t, "/c/.fsyncignore", d.RelativePath)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the decision")
+		}
+		cancel()
+		require.True(t, errors.Is(<-done, context.Canceled))
+		assert.Equal(t, 0, len(decisions))
+	})
+
+	t.Run("Ignore files are read once per check", func(t *testing.T) {
+		lFS.ResetCalls()
+		require.NoError(t, p.CheckChanges(context.Background(), "/c"))
+		// The ignore files of / and /c
+		assert.Equal(t, 2, lFS.Calls(fsynctest.OpOpen))
+	})
+}
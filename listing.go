@@ -0,0 +1,432 @@
+package fsync
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	// maxBufferedChildren is the number of children of a side read before the check of a dir
+	// listed by pages is streamed (see checkChangesStreamed)
+	maxBufferedChildren = 10000
+)
+
+// listLocal lists the local children and merges them with the base when there is one.
+// listed is the number of children returned by the file system, before keepOnlyChildRPaths
+func (p *provider) listLocal(ctx context.Context, relativePath string, keepOnlyChildRPaths map[string]bool) (lis LocalItems, listed int, err error) {
+	lis, listed, _, err = p.listLocalPages(ctx, relativePath, "", keepOnlyChildRPaths, 0)
+	return
+}
+
+// listLocalPages lists the local children from pageToken until limit children are read, or all of them with a limit of 0.
+// The listing is complete when nextPageToken is empty. It is always complete with a base, which is merged with the whole listing
+func (p *provider) listLocalPages(ctx context.Context, relativePath string, pageToken string, keepOnlyChildRPaths map[string]bool, limit int) (lis LocalItems, listed int, nextPageToken string, err error) {
+	if p.base != nil {
+		limit = 0
+	}
+	lis, listed, nextPageToken, err = p.listLocalFS(ctx, relativePath, pageToken, keepOnlyChildRPaths, limit)
+	if err != nil {
+		return nil, 0, "", &ListError{RelativePath: relativePath, Side: SideLocal, Err: err}
+	}
+	if p.base == nil {
+		return lis, listed, nextPageToken, nil
+	}
+	lis, err = p.applyBase(relativePath, lis, keepOnlyChildRPaths)
+	return lis, listed, "", err
+}
+
+// listLocalFS lists the local children page by page when the file system is a LocalFSPager.
+// Items missing from keepOnlyChildRPaths are dropped as soon as a page is read
+func (p *provider) listLocalFS(ctx context.Context, relativePath string, pageToken string, keepOnlyChildRPaths map[string]bool, limit int) (LocalItems, int, string, error) {
+	pager, ok := p.local.(LocalFSPager)
+	if !ok {
+		lis, err := p.local.GetChildren(relativePath)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		return filterLocalItems(lis, keepOnlyChildRPaths), len(lis), "", nil
+	}
+
+	ret := LocalItems{}
+	listed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, "", err
+		}
+
+		lis, nextPageToken, err := pager.GetChildrenPage(ctx, relativePath, pageToken)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		listed += len(lis)
+		ret = append(ret, filterLocalItems(lis, keepOnlyChildRPaths)...)
+
+		if nextPageToken == "" || (limit > 0 && listed >= limit) {
+			return ret, listed, nextPageToken, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// listRemote lists the remote children and derives the etags of the files without one
+// according to the comparison strategy
+func (p *provider) listRemote(ctx context.Context, relativePath string, keepOnlyChildRPaths map[string]bool) (ris RemoteItems, listed int, err error) {
+	ris, listed, _, err = p.listRemotePages(ctx, relativePath, "", keepOnlyChildRPaths, 0)
+	return
+}
+
+// listRemotePages lists the remote children from pageToken until limit children are read, or all of them with a limit of 0.
+// The listing is complete when nextPageToken is empty
+func (p *provider) listRemotePages(ctx context.Context, relativePath string, pageToken string, keepOnlyChildRPaths map[string]bool, limit int) (RemoteItems, int, string, error) {
+	ris, listed, nextPageToken, err := p.listRemoteFS(ctx, relativePath, pageToken, keepOnlyChildRPaths, limit)
+	if err != nil {
+		return nil, 0, "", &ListError{RelativePath: relativePath, Side: SideRemote, Err: err}
+	}
+	if p.comparison == CompareEtag {
+		return ris, listed, nextPageToken, nil
+	}
+	for k := range ris {
+		ris[k].Etag = p.comparison.Etag(ris[k])
+	}
+	return ris, listed, nextPageToken, nil
+}
+
+// listRemoteFS lists the remote children page by page when the file system is a RemoteFSPager.
+// Items missing from keepOnlyChildRPaths are dropped as soon as a page is read
+func (p *provider) listRemoteFS(ctx context.Context, relativePath string, pageToken string, keepOnlyChildRPaths map[string]bool, limit int) (RemoteItems, int, string, error) {
+	pager, ok := p.remote.(RemoteFSPager)
+	if !ok {
+		ris, err := p.remote.GetChildren(relativePath)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		return filterRemoteItems(ris, keepOnlyChildRPaths), len(ris), "", nil
+	}
+
+	ret := RemoteItems{}
+	listed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, "", err
+		}
+
+		ris, nextPageToken, err := pager.GetChildrenPage(ctx, relativePath, pageToken)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		listed += len(ris)
+		ret = append(ret, filterRemoteItems(ris, keepOnlyChildRPaths)...)
+
+		if nextPageToken == "" || (limit > 0 && listed >= limit) {
+			return ret, listed, nextPageToken, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+func filterLocalItems(lis LocalItems, keepOnlyChildRPaths map[string]bool) LocalItems {
+	if keepOnlyChildRPaths == nil {
+		return lis
+	}
+
+	for i := len(lis) - 1; i >= 0; i-- {
+		if !keepOnlyChildRPaths[lis[i].RelativePath] {
+			lis[i] = lis[len(lis)-1]
+			lis = lis[:len(lis)-1]
+		}
+	}
+	return lis
+}
+
+func filterRemoteItems(ris RemoteItems, keepOnlyChildRPaths map[string]bool) RemoteItems {
+	if keepOnlyChildRPaths == nil {
+		return ris
+	}
+
+	for i := len(ris) - 1; i >= 0; i-- {
+		if !keepOnlyChildRPaths[ris[i].RelativePath] {
+			ris[i] = ris[len(ris)-1]
+			ris = ris[:len(ris)-1]
+		}
+	}
+	return ris
+}
+
+type (
+	// prefetcher lists the sub-dirs of the traversed dirs in advance through a bounded pool.
+	// The traversal still consumes the listings in the sequential order so that decisions are deterministic.
+	// At most window listings are started and not yet consumed: the other sub-dirs wait in the queue
+	prefetcher struct {
+		p      *provider
+		ctx    context.Context
+		sem    chan struct{}
+		wg     sync.WaitGroup
+		window int
+
+		mu       sync.Mutex
+		queue    []string
+		queued   map[string]*listing
+		listings map[string]*listing
+		// children are the prefetched sub-dirs of each listed dir, dropped once the dir is checked
+		children map[string][]string
+	}
+
+	// listing is the future result of a prefetched dir
+	listing struct {
+		done   chan struct{}
+		cancel context.CancelFunc
+
+		withLocal       bool
+		withRemote      bool
+		lis             LocalItems
+		ris             RemoteItems
+		localListed     int
+		remoteListed    int
+		localPageToken  string
+		remotePageToken string
+		err             error
+	}
+
+	// continuation resumes the listing of a dir stopped after maxBufferedChildren children on a side.
+	// A side with an empty page token is fully listed
+	continuation struct {
+		localPageToken  string
+		remotePageToken string
+		localListed     int
+		remoteListed    int
+	}
+
+	prefetcherKey struct{}
+)
+
+const (
+	// prefetchWindowFactor is the number of listings started in advance per goroutine of the pool
+	prefetchWindowFactor = 4
+)
+
+// withPrefetcher attaches a prefetcher to the traversal.
+// The returned stop function cancels the pending listings and waits for the running ones
+func (p *provider) withPrefetcher(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	pf := &prefetcher{
+		p:        p,
+		ctx:      ctx,
+		sem:      make(chan struct{}, p.concurrency),
+		window:   prefetchWindowFactor * p.concurrency,
+		queued:   map[string]*listing{},
+		listings: map[string]*listing{},
+		children: map[string][]string{},
+	}
+
+	return context.WithValue(ctx, prefetcherKey{}, pf), func() {
+		cancel()
+		pf.wg.Wait()
+	}
+}
+
+func prefetcherFrom(ctx context.Context) *prefetcher {
+	pf, _ := ctx.Value(prefetcherKey{}).(*prefetcher)
+	return pf
+}
+
+// prefetch queues the sub-dirs of the listed dir. Each side is listed only where the item is a dir
+// since the other side may be replaced by a decision before the traversal reaches it.
+// The dirs with the same TreeHash on both sides are not inspected and not listed
+func (pf *prefetcher) prefetch(relativePath string, lis LocalItems, ris RemoteItems) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	paths := []string{}
+	byPath := map[string]*listing{}
+	add := func(relativePath string) *listing {
+		if l, ok := byPath[relativePath]; ok {
+			return l
+		}
+		l := &listing{done: make(chan struct{})}
+		byPath[relativePath] = l
+		paths = append(paths, relativePath)
+		return l
+	}
+	treeHashes := map[string]string{}
+	for _, li := range lis {
+		if li.Dir {
+			add(li.RelativePath).withLocal = true
+			treeHashes[li.RelativePath] = li.TreeHash
+		}
+	}
+	for _, ri := range ris {
+		if ri.Dir {
+			if ri.TreeHash != "" && ri.TreeHash == treeHashes[ri.RelativePath] {
+				// Not inspected by the traversal
+				delete(byPath, ri.RelativePath)
+				continue
+			}
+			add(ri.RelativePath).withRemote = true
+		}
+	}
+
+	for _, childPath := range paths {
+		if _, ok := byPath[childPath]; !ok {
+			continue
+		}
+		if _, ok := pf.queued[childPath]; ok {
+			continue
+		}
+		if _, ok := pf.listings[childPath]; ok {
+			continue
+		}
+		pf.queued[childPath] = byPath[childPath]
+		pf.queue = append(pf.queue, childPath)
+		pf.children[relativePath] = append(pf.children[relativePath], childPath)
+	}
+	pf.fill()
+}
+
+// fill starts the queued listings while the window is not full. pf.mu must be held
+func (pf *prefetcher) fill() {
+	for len(pf.listings) < pf.window && len(pf.queue) > 0 {
+		relativePath := pf.queue[0]
+		pf.queue = pf.queue[1:]
+
+		l, ok := pf.queued[relativePath]
+		if !ok {
+			// Taken or dropped before it was started
+			continue
+		}
+		delete(pf.queued, relativePath)
+
+		ctx, cancel := context.WithCancel(pf.ctx)
+		l.cancel = cancel
+		pf.listings[relativePath] = l
+
+		pf.wg.Add(1)
+		go pf.run(ctx, relativePath, l)
+	}
+}
+
+func (pf *prefetcher) run(ctx context.Context, relativePath string, l *listing) {
+	defer pf.wg.Done()
+	defer close(l.done)
+
+	if l.err = pf.acquire(ctx); l.err != nil {
+		return
+	}
+	defer pf.release()
+
+	if l.withLocal {
+		if l.lis, l.localListed, l.localPageToken, l.err = pf.p.listLocalPages(ctx, relativePath, "", nil, maxBufferedChildren); l.err != nil {
+			return
+		}
+	}
+	if l.withRemote {
+		l.ris, l.remoteListed, l.remotePageToken, l.err = pf.p.listRemotePages(ctx, relativePath, "", nil, maxBufferedChildren)
+	}
+}
+
+// acquire waits for a goroutine of the pool
+func (pf *prefetcher) acquire(ctx context.Context) error {
+	select {
+	case pf.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (pf *prefetcher) release() {
+	<-pf.sem
+}
+
+// take returns the started listing of the dir, if any. A listing is used once.
+// A queued dir which is not started yet is removed from the queue and listed by the traversal
+func (pf *prefetcher) take(relativePath string) *listing {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	delete(pf.queued, relativePath)
+	l, ok := pf.listings[relativePath]
+	if !ok {
+		return nil
+	}
+	delete(pf.listings, relativePath)
+	pf.fill()
+	return l
+}
+
+// drop cancels the listings of the sub-dirs of a checked dir which were not consumed,
+// e.g. because they are ignored, excluded or unchanged
+func (pf *prefetcher) drop(relativePath string) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	for _, childPath := range pf.children[relativePath] {
+		delete(pf.queued, childPath)
+		if l, ok := pf.listings[childPath]; ok {
+			l.cancel()
+			delete(pf.listings, childPath)
+		}
+	}
+	delete(pf.children, relativePath)
+	pf.fill()
+}
+
+// list returns the children of both sides, using the prefetched listings when available.
+// A side listed by pages is read up to maxBufferedChildren children: the continuation of the listing
+// is returned when a side is not fully listed, and the children are then neither prefetched nor counted
+func (p *provider) list(ctx context.Context, relativePath string, keepOnlyChildRPaths map[string]bool) (lis LocalItems, ris RemoteItems, cont *continuation, err error) {
+	pf := prefetcherFrom(ctx)
+
+	var l *listing
+	if pf != nil && keepOnlyChildRPaths == nil {
+		l = pf.take(relativePath)
+	}
+	if l != nil {
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		}
+		if l.err != nil {
+			return nil, nil, nil, l.err
+		}
+	}
+
+	// The listings of the traversal also go through the pool
+	if pf != nil && (l == nil || !l.withLocal || !l.withRemote) {
+		if err := pf.acquire(ctx); err != nil {
+			return nil, nil, nil, err
+		}
+		defer pf.release()
+	}
+
+	// The filtered listings of CheckDecision are not streamed
+	limit := maxBufferedChildren
+	if keepOnlyChildRPaths != nil {
+		limit = 0
+	}
+
+	// The mass-deletion guard counts every listed child, including those dropped by keepOnlyChildRPaths
+	c := continuation{}
+	if l != nil && l.withLocal {
+		lis, c.localListed, c.localPageToken = l.lis, l.localListed, l.localPageToken
+	} else if lis, c.localListed, c.localPageToken, err = p.listLocalPages(ctx, relativePath, "", keepOnlyChildRPaths, limit); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if l != nil && l.withRemote {
+		ris, c.remoteListed, c.remotePageToken = l.ris, l.remoteListed, l.remotePageToken
+	} else if ris, c.remoteListed, c.remotePageToken, err = p.listRemotePages(ctx, relativePath, "", keepOnlyChildRPaths, limit); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if c.localPageToken != "" || c.remotePageToken != "" {
+		return lis, ris, &c, nil
+	}
+
+	if pf != nil {
+		pf.prefetch(relativePath, lis, ris)
+	}
+	deletionTallyFrom(ctx).count(relativePath, c.localListed, c.remoteListed)
+
+	return lis, ris, nil, nil
+}
@@ -0,0 +1,150 @@
+package fsync_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+type (
+	// pagedLocalFS lists the children two by two
+	pagedLocalFS struct {
+		localFS
+		pages int
+	}
+
+	// pagedRemoteFS lists the children two by two and cancels the listing after cancelAfter pages
+	pagedRemoteFS struct {
+		remoteFS
+		pages       int
+		cancelAfter int
+		cancel      context.CancelFunc
+	}
+)
+
+func page(pageToken string, n int) (start, end int, nextPageToken string) {
+	start, _ = strconv.Atoi(pageToken)
+	end = start + 2
+	if end >= n {
+		return start, n, ""
+	}
+	return start, end, strconv.Itoa(end)
+}
+
+func (l *pagedLocalFS) GetChildrenPage(ctx context.Context, relativePath string, pageToken string) (fsync.LocalItems, string, error) {
+	lis, _ := l.GetChildren(relativePath)
+	start, end, next := page(pageToken, len(lis))
+	l.pages++
+	return lis[start:end], next, nil
+}
+
+func (r *pagedRemoteFS) GetChildrenPage(ctx context.Context, relativePath string, pageToken string) (fsync.RemoteItems, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	ris, _ := r.GetChildren(relativePath)
+	start, end, next := page(pageToken, len(ris))
+	r.pages++
+	if r.cancel != nil && r.pages == r.cancelAfter {
+		r.cancel()
+	}
+	return ris[start:end], next, nil
+}
+
+func TestPagedListing(t *testing.T) {
+	lst := fsync.LocalItems{
+		{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		{RelativePath: "/b", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		{RelativePath: "/c", Dir: false, Etag: "v1", Commited: fsync.CommitedNo},
+		{RelativePath: "/d", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		{RelativePath: "/e", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+	}
+	rst := fsync.RemoteItems{
+		{RelativePath: "/a", Dir: false, Etag: "v1"},
+		{RelativePath: "/b", Dir: false, Etag: "v2"},
+		{RelativePath: "/c", Dir: false, Etag: "v1"},
+		{RelativePath: "/d", Dir: false, Etag: "v1"},
+		{RelativePath: "/f", Dir: false, Etag: "v1"},
+	}
+
+	t.Run("Pages are merged", func(t *testing.T) {
+		lFS := pagedLocalFS{localFS: localFS{status: lst}}
+		rFS := pagedRemoteFS{remoteFS: remoteFS{status: rst}}
+
+		decisions := []fsync.Decision{}
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			decisions = append(decisions, d)
+			return nil
+		}, nil)
+		require.NoError(t, p.DoInitialSync(context.Background()))
+
+		assert.Equal(t, 3, lFS.pages)
+		assert.Equal(t, 3, rFS.pages)
+		assert.Equal(t, 4, len(decisions))
+		for _, d := range []fsync.Decision{
+			{RelativePath: "/b", Flag: fsync.DecisionDownloadRemote},
+			{RelativePath: "/c", Flag: fsync.DecisionUploadLocal},
+			{RelativePath: "/e", Flag: fsync.DecisionDeleteLocal},
+			{RelativePath: "/f", Flag: fsync.DecisionDownloadRemote},
+		} {
+			assert.Equal(t, true, IsDecisionPresent(d, decisions))
+		}
+
+		for _, d := range decisions {
+			err, ok := p.CheckDecision(context.Background(), d)
+			require.NoError(t, err)
+			assert.Equal(t, true, ok)
+		}
+	})
+
+	t.Run("Huge dirs are checked while they are listed", func(t *testing.T) {
+		defer fsync.SetMaxBufferedChildren(2)()
+
+		lFS := pagedLocalFS{localFS: localFS{status: lst}}
+		rFS := pagedRemoteFS{remoteFS: remoteFS{status: rst}}
+
+		decisions := []fsync.Decision{}
+		pagesAtFirstDecision := 0
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			if len(decisions) == 0 {
+				pagesAtFirstDecision = lFS.pages + rFS.pages
+			}
+			decisions = append(decisions, d)
+			return nil
+		}, nil)
+		require.NoError(t, p.DoInitialSync(context.Background()))
+
+		assert.Equal(t, 3, lFS.pages)
+		assert.Equal(t, 3, rFS.pages)
+		assert.Assert(t, pagesAtFirstDecision < 6)
+		assert.Equal(t, 4, len(decisions))
+		for _, d := range []fsync.Decision{
+			{RelativePath: "/b", Flag: fsync.DecisionDownloadRemote},
+			{RelativePath: "/c", Flag: fsync.DecisionUploadLocal},
+			{RelativePath: "/e", Flag: fsync.DecisionDeleteLocal},
+			{RelativePath: "/f", Flag: fsync.DecisionDownloadRemote},
+		} {
+			assert.Equal(t, true, IsDecisionPresent(d, decisions))
+		}
+		// The deletions are taken once the dir is fully listed
+		assert.Equal(t, fsync.DecisionDeleteLocal, decisions[len(decisions)-1].Flag)
+	})
+
+	t.Run("Listing is cancelled between pages", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		lFS := pagedLocalFS{localFS: localFS{status: lst}}
+		rFS := pagedRemoteFS{remoteFS: remoteFS{status: rst}, cancelAfter: 1, cancel: cancel}
+
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			return nil
+		}, nil)
+		require.ErrorIs(t, p.DoInitialSync(ctx), context.Canceled)
+		assert.Equal(t, 1, rFS.pages)
+	})
+}
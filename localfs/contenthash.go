@@ -0,0 +1,79 @@
+package localfs
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// cachedHash is the ContentHash of a file with the status it was computed with
+	cachedHash struct {
+		size    int64
+		modTime time.Time
+		hash    string
+	}
+)
+
+var (
+	ErrHashAlgorithm = errors.New("localfs: unsupported hash algorithm")
+
+	// hashAlgorithms are the supported values of Options.HashAlgorithm
+	hashAlgorithms = map[string]func() hash.Hash{
+		"md5":    md5.New,
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// withContentHash sets the ContentHash of a file when the hashing is enabled.
+// The hash is computed again when the size or the modification time of the file changes
+func (l *localFS) withContentHash(li fsync.LocalItem) (fsync.LocalItem, error) {
+	if l.hashAlgorithm == "" || li.Dir || li.Commited == fsync.CommitedAwaitingRemoteDeletion {
+		return li, nil
+	}
+
+	l.contentMu.Lock()
+	c, ok := l.contentHashes[li.RelativePath]
+	l.contentMu.Unlock()
+
+	if !ok || c.size != li.Size || !c.modTime.Equal(li.ModTime) {
+		sum, err := l.contentHash(li.RelativePath)
+		if err != nil {
+			return li, err
+		}
+		c = cachedHash{size: li.Size, modTime: li.ModTime, hash: sum}
+
+		l.contentMu.Lock()
+		l.contentHashes[li.RelativePath] = c
+		l.contentMu.Unlock()
+	}
+
+	li.ContentHash = c.hash
+	li.HashAlgorithm = l.hashAlgorithm
+	return li, nil
+}
+
+func (l *localFS) contentHash(itemPath string) (string, error) {
+	f, err := os.Open(l.osPath(itemPath))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := hashAlgorithms[l.hashAlgorithm]()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,8 @@
+package localfs
+
+// CloseJournalFile makes the next writes of the journal fail
+func CloseJournalFile(fs FS) error {
+	return fs.(*localFS).journal.f.Close()
+}
+
+var SameDevice = sameDevice
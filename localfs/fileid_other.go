@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package localfs
+
+import "os"
+
+// fileID is not supported, renames are seen as deletions and creations
+func fileID(fi os.FileInfo) string {
+	return ""
+}
+
+// sameDevice is not supported, the rename to the trash reports the error
+func sameDevice(a, b os.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,35 @@
+//go:build !windows && !plan9
+
+package localfs
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID identifies an item across renames.
+// Size and modification time are added for files to limit inode reuse issues
+func fileID(fi os.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	if fi.IsDir() {
+		return fmt.Sprintf("%d", st.Ino)
+	}
+	return fmt.Sprintf("%d-%d-%d", st.Ino, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// sameDevice returns true when both items are on the same file system
+func sameDevice(a, b os.FileInfo) bool {
+	sa, ok := a.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	sb, ok := b.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return sa.Dev == sb.Dev
+}
@@ -0,0 +1,250 @@
+package localfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// journal is an append-only log of the commit status of the local items.
+	// It is compacted when opened and when it grows too much.
+	// Each append is synced to disk before being applied to the memory
+	journal struct {
+		mu sync.Mutex
+
+		path     string
+		f        *os.File
+		entries  map[string]journalEntry
+		children map[string]map[string]bool
+		appended int
+	}
+
+	journalEntry struct {
+		RelativePath string             `json:"path"`
+		Dir          bool               `json:"dir,omitempty"`
+		Etag         string             `json:"etag,omitempty"`
+		Commited     fsync.CommitedFlag `json:"commited"`
+		FileID       string             `json:"file_id,omitempty"`
+		Size         int64              `json:"size,omitempty"`
+		ModTime      int64              `json:"mod_time,omitempty"`
+		Removed      bool               `json:"removed,omitempty"`
+
+		// TreeHash is the remote TreeHash commited when the dir subtree was in sync
+		// and LocalTreeHash the local Merkle hash of the subtree at that time
+		TreeHash      string `json:"tree_hash,omitempty"`
+		LocalTreeHash string `json:"local_tree_hash,omitempty"`
+	}
+)
+
+const (
+	compactMinAppended = 1000
+)
+
+func openJournal(journalPath string) (*journal, error) {
+	j := &journal{
+		path:     journalPath,
+		entries:  map[string]journalEntry{},
+		children: map[string]map[string]bool{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(journalPath), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(journalPath)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			e := journalEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// Ignoring a truncated last line after a crash
+				continue
+			}
+			j.apply(e)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *journal) apply(e journalEntry) {
+	parent := path.Dir(e.RelativePath)
+	if e.Removed {
+		delete(j.entries, e.RelativePath)
+		if c, ok := j.children[parent]; ok {
+			delete(c, e.RelativePath)
+			if len(c) == 0 {
+				delete(j.children, parent)
+			}
+		}
+		return
+	}
+
+	j.entries[e.RelativePath] = e
+	if _, ok := j.children[parent]; !ok {
+		j.children[parent] = map[string]bool{}
+	}
+	j.children[parent][e.RelativePath] = true
+}
+
+// compact rewrites the journal with only the current entries
+func (j *journal) compact() error {
+	if j.f != nil {
+		if err := j.f.Close(); err != nil {
+			return err
+		}
+		j.f = nil
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range j.entries {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+
+	j.f, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	j.appended = 0
+	return err
+}
+
+func (j *journal) get(relativePath string) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e, ok := j.entries[relativePath]
+	return e, ok
+}
+
+// getChildren returns the entries whose parent is relativePath
+func (j *journal) getChildren(relativePath string) []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ret := []journalEntry{}
+	for p := range j.children[relativePath] {
+		ret = append(ret, j.entries[p])
+	}
+	return ret
+}
+
+// getTree returns relativePath entry and all its sub-entries
+func (j *journal) getTree(relativePath string) []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ret := []journalEntry{}
+	var walk func(p string)
+	walk = func(p string) {
+		if e, ok := j.entries[p]; ok {
+			ret = append(ret, e)
+		}
+		for c := range j.children[p] {
+			walk(c)
+		}
+	}
+	walk(relativePath)
+	return ret
+}
+
+// set appends the entries to the journal and applies them once they are synced to disk,
+// so that the memory never holds a commit which could be lost by a crash
+func (j *journal) set(entries ...journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return os.ErrClosed
+	}
+
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	fi, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(buf.Bytes()); err != nil {
+		// Dropping the partial write so that the disk matches the memory
+		_ = j.f.Truncate(fi.Size())
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		_ = j.f.Truncate(fi.Size())
+		return err
+	}
+
+	for _, e := range entries {
+		j.apply(e)
+		j.appended++
+	}
+
+	if j.appended > compactMinAppended && j.appended > 2*len(j.entries) {
+		return j.compact()
+	}
+
+	return nil
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+
+	err := j.f.Sync()
+	if cErr := j.f.Close(); err == nil {
+		err = cErr
+	}
+	j.f = nil
+	return err
+}
@@ -0,0 +1,527 @@
+// Package localfs implements fsync.LocalFS on top of an OS directory.
+// The commit status and the last commited etag of each item are persisted in an on-disk journal.
+package localfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// FS is a local file system usable by a provider and an executor
+	FS interface {
+		fsync.LocalWriteFS
+		fsync.LocalFSTreeHashCommitter
+		fsync.LocalTrashFS
+
+		// MarkNotCommited must be called when the app writes an item outside of the executor
+		MarkNotCommited(itemPath string) error
+		// MarkAwaitingRemoteDeletion must be called when the app deletes an item.
+		// Sub-items of a dir are marked too
+		MarkAwaitingRemoteDeletion(itemPath string) error
+		// IsIgnored returns true for the items which are never reported (journal, temporary files)
+		IsIgnored(itemPath string) bool
+		// TreeHash computes the Merkle hash of the local subtree
+		TreeHash(itemPath string) (string, error)
+		// InvalidateTreeHash must be called when an item is changed outside of the FS
+		InvalidateTreeHash(itemPath string)
+		ListTrash() ([]TrashEntry, error)
+		RestoreTrash(id string) error
+		PurgeTrash(maxAge time.Duration, maxSize int64) (purged int, err error)
+		// Root returns the OS path of the synced directory
+		Root() string
+		Close() error
+	}
+
+	localFS struct {
+		root    string
+		journal *journal
+		ignored map[string]bool
+
+		// hashes caches the Merkle hashes of the local dirs with Options.CacheTreeHash, it is nil otherwise.
+		// hashGen is incremented by every invalidation
+		hashMu  sync.Mutex
+		hashes  map[string]string
+		hashGen int
+
+		// contentHashes caches the ContentHash of the files when hashAlgorithm is set
+		hashAlgorithm string
+		contentMu     sync.Mutex
+		contentHashes map[string]cachedHash
+
+		trashDir string
+		trashMu  sync.Mutex
+		trashSeq int
+	}
+
+	Options struct {
+		// JournalPath is the OS path of the journal. Defaults to <root>/.fsync/journal
+		JournalPath string
+		// UseTrash moves the items deleted by the executor to a trash instead of removing them
+		UseTrash bool
+		// TrashDir is the OS path of the trash. Defaults to <root>/.fsync/trash
+		TrashDir string
+		// HashAlgorithm enables the ContentHash of the files for fsync.CompareContentHash: md5, sha1, sha256 or sha512.
+		// It must be the algorithm of the remote checksums. The hashes are kept in memory
+		// and computed again when the size or the modification time of a file changes
+		HashAlgorithm string
+		// CacheTreeHash keeps the Merkle hashes of the dirs in memory between the calls.
+		// Every change made outside of the FS must then be reported with InvalidateTreeHash, e.g. by the watcher
+		CacheTreeHash bool
+	}
+)
+
+var (
+	ErrRemoveRoot  = errors.New("localfs: cannot remove or move the root directory")
+	ErrTrashDevice = errors.New("localfs: the trash must be on the file system of the root directory")
+)
+
+const (
+	DefaultJournalDir  = ".fsync"
+	DefaultJournalName = "journal"
+
+	tmpSuffix = ".fsync.tmp"
+)
+
+// New opens the local file system rooted at root
+func New(root string, opts *Options) (FS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	journalPath := filepath.Join(root, DefaultJournalDir, DefaultJournalName)
+	if opts != nil && opts.JournalPath != "" {
+		if journalPath, err = filepath.Abs(opts.JournalPath); err != nil {
+			return nil, err
+		}
+	}
+
+	hashAlgorithm := ""
+	if opts != nil && opts.HashAlgorithm != "" {
+		hashAlgorithm = strings.ToLower(opts.HashAlgorithm)
+		if _, ok := hashAlgorithms[hashAlgorithm]; !ok {
+			return nil, ErrHashAlgorithm
+		}
+	}
+
+	j, err := openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &localFS{
+		root:    root,
+		journal: j,
+		ignored: map[string]bool{},
+
+		hashAlgorithm: hashAlgorithm,
+		contentHashes: map[string]cachedHash{},
+	}
+
+	if opts != nil && opts.CacheTreeHash {
+		l.hashes = map[string]string{}
+	}
+
+	// Hiding the journal when it is stored inside the synced directory
+	if top, ok := l.topLevelName(journalPath); ok {
+		l.ignored["/"+top] = true
+		if top == filepath.Base(journalPath) {
+			l.ignored["/"+top+".tmp"] = true
+		}
+	}
+
+	if opts != nil && opts.UseTrash {
+		l.trashDir = filepath.Join(root, DefaultJournalDir, DefaultTrashDir)
+		if opts.TrashDir != "" {
+			if l.trashDir, err = filepath.Abs(opts.TrashDir); err != nil {
+				return nil, err
+			}
+		}
+		if top, ok := l.topLevelName(l.trashDir); ok {
+			l.ignored["/"+top] = true
+		}
+
+		// The items are renamed to the trash
+		if err := os.MkdirAll(l.trashDir, 0o755); err != nil {
+			return nil, err
+		}
+		rootInfo, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		trashInfo, err := os.Stat(l.trashDir)
+		if err != nil {
+			return nil, err
+		}
+		if !sameDevice(rootInfo, trashInfo) {
+			return nil, ErrTrashDevice
+		}
+	}
+
+	return l, nil
+}
+
+// topLevelName returns the name of the root child containing osPath
+func (l *localFS) topLevelName(osPath string) (string, bool) {
+	rel, err := filepath.Rel(l.root, osPath)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")[0], true
+}
+
+func (l *localFS) Root() string {
+	return l.root
+}
+
+func (l *localFS) Close() error {
+	return l.journal.close()
+}
+
+func (l *localFS) osPath(itemPath string) string {
+	return filepath.Join(l.root, filepath.FromSlash(path.Clean("/"+itemPath)))
+}
+
+// IsIgnored returns true for the journal and the temporary files used by Create
+func (l *localFS) IsIgnored(itemPath string) bool {
+	itemPath = path.Clean("/" + itemPath)
+	for p := range l.ignored {
+		if itemPath == p || strings.HasPrefix(itemPath, p+"/") {
+			return true
+		}
+	}
+	return strings.HasSuffix(path.Base(itemPath), tmpSuffix)
+}
+
+// toLocalItem merges the OS status of an item with its journal entry
+func toLocalItem(itemPath string, fi os.FileInfo, e journalEntry, inJournal bool) fsync.LocalItem {
+	li := fsync.LocalItem{
+		RelativePath: itemPath,
+		Dir:          fi.IsDir(),
+		Commited:     fsync.CommitedNo,
+		FileID:       fileID(fi),
+		ModTime:      fi.ModTime(),
+	}
+	if !li.Dir {
+		li.Size = fi.Size()
+	}
+
+	if !inJournal {
+		return li
+	}
+
+	li.Etag = e.Etag
+	if e.Commited != fsync.CommitedYes || e.Dir != li.Dir {
+		return li
+	}
+
+	// Modified since the last commit
+	if !li.Dir && (e.Size != fi.Size() || e.ModTime != fi.ModTime().UnixNano()) {
+		return li
+	}
+
+	li.Commited = fsync.CommitedYes
+	return li
+}
+
+// toAwaitingItem returns the item deleted locally as it was last commited
+func toAwaitingItem(e journalEntry) fsync.LocalItem {
+	li := fsync.LocalItem{
+		RelativePath: e.RelativePath,
+		Dir:          e.Dir,
+		Etag:         e.Etag,
+		Commited:     fsync.CommitedAwaitingRemoteDeletion,
+		FileID:       e.FileID,
+		Size:         e.Size,
+	}
+	if e.ModTime != 0 {
+		li.ModTime = time.Unix(0, e.ModTime)
+	}
+	return li
+}
+
+func (l *localFS) GetChildren(itemPath string) (fsync.LocalItems, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	// A dir removed during the sync has no children, but a missing root
+	// (e.g. an unmounted disk) would delete all the remote items
+	des, err := os.ReadDir(l.osPath(itemPath))
+	if err != nil && (itemPath == "/" || !os.IsNotExist(err)) {
+		return nil, err
+	}
+
+	ret := fsync.LocalItems{}
+	present := map[string]bool{}
+	for _, de := range des {
+		childPath := path.Join(itemPath, de.Name())
+		if l.IsIgnored(childPath) {
+			continue
+		}
+		if !de.IsDir() && !de.Type().IsRegular() {
+			// Skipping symlinks, sockets, devices...
+			continue
+		}
+
+		fi, err := de.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		e, ok := l.journal.get(childPath)
+		li, err := l.withContentHash(toLocalItem(childPath, fi, e, ok))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l.withTreeHash(li, e))
+		present[childPath] = true
+	}
+
+	// Items deleted locally but still known by the journal
+	for _, e := range l.journal.getChildren(itemPath) {
+		if present[e.RelativePath] || e.Commited == fsync.CommitedNo {
+			continue
+		}
+		ret = append(ret, toAwaitingItem(e))
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+
+	return ret, nil
+}
+
+func (l *localFS) Stat(itemPath string) (fsync.LocalItem, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	fi, err := os.Stat(l.osPath(itemPath))
+	if err != nil {
+		if e, ok := l.journal.get(itemPath); ok && os.IsNotExist(err) && e.Commited != fsync.CommitedNo {
+			return toAwaitingItem(e), nil
+		}
+		return fsync.LocalItem{}, err
+	}
+
+	e, ok := l.journal.get(itemPath)
+	li, err := l.withContentHash(toLocalItem(itemPath, fi, e, ok))
+	if err != nil {
+		return fsync.LocalItem{}, err
+	}
+	return l.withTreeHash(li, e), nil
+}
+
+func (l *localFS) Open(itemPath string) (io.ReadCloser, error) {
+	return os.Open(l.osPath(itemPath))
+}
+
+// Create returns a writer on a temporary file which is renamed to the item path on Close
+func (l *localFS) Create(itemPath string) (io.WriteCloser, error) {
+	osPath := l.osPath(itemPath)
+	if err := os.MkdirAll(filepath.Dir(osPath), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(osPath), "."+filepath.Base(osPath)+".*"+tmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{File: f, l: l, itemPath: path.Clean("/" + itemPath), target: osPath}, nil
+}
+
+func (l *localFS) Mkdir(itemPath string) error {
+	defer l.invalidate(path.Clean("/"+itemPath), false)
+	return os.MkdirAll(l.osPath(itemPath), 0o755)
+}
+
+func (l *localFS) Remove(itemPath string) error {
+	itemPath = path.Clean("/" + itemPath)
+	if itemPath == "/" {
+		return ErrRemoveRoot
+	}
+	defer l.invalidate(itemPath, true)
+
+	if err := os.RemoveAll(l.osPath(itemPath)); err != nil {
+		return err
+	}
+
+	tree := l.journal.getTree(itemPath)
+	for k := range tree {
+		tree[k] = journalEntry{RelativePath: tree[k].RelativePath, Removed: true}
+	}
+	return l.journal.set(tree...)
+}
+
+// Commit marks the item as CommitedYes with the given remote etag
+func (l *localFS) Commit(itemPath string, etag string) error {
+	itemPath = path.Clean("/" + itemPath)
+	defer l.invalidate(itemPath, false)
+
+	fi, err := os.Stat(l.osPath(itemPath))
+	if err != nil {
+		return err
+	}
+
+	e := journalEntry{
+		RelativePath: itemPath,
+		Dir:          fi.IsDir(),
+		Etag:         etag,
+		Commited:     fsync.CommitedYes,
+		FileID:       fileID(fi),
+	}
+	if !e.Dir {
+		e.Size = fi.Size()
+		e.ModTime = fi.ModTime().UnixNano()
+	}
+
+	return l.journal.set(e)
+}
+
+// Move renames the item and moves the commit status of its sub-items.
+// When the item was already renamed only the commit status is moved.
+// An existing item is never replaced: the move fails with fs.ErrExist
+func (l *localFS) Move(fromPath, toPath string) error {
+	fromPath = path.Clean("/" + fromPath)
+	toPath = path.Clean("/" + toPath)
+	if fromPath == "/" || toPath == "/" {
+		return ErrRemoveRoot
+	}
+	defer l.invalidate(fromPath, true)
+	defer l.invalidate(toPath, true)
+
+	if _, err := os.Lstat(l.osPath(fromPath)); err == nil {
+		// os.Rename would replace an existing file
+		if _, err := os.Lstat(l.osPath(toPath)); err == nil {
+			return fmt.Errorf("localfs: moving %s to %s: %w", fromPath, toPath, fs.ErrExist)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(l.osPath(toPath)), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(l.osPath(fromPath), l.osPath(toPath)); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	tree := l.journal.getTree(fromPath)
+	entries := make([]journalEntry, 0, 2*len(tree))
+	for _, e := range tree {
+		entries = append(entries, journalEntry{RelativePath: e.RelativePath, Removed: true})
+	}
+	for _, e := range tree {
+		e.RelativePath = toPath + strings.TrimPrefix(e.RelativePath, fromPath)
+		if e.Commited == fsync.CommitedAwaitingRemoteDeletion {
+			e.Commited = fsync.CommitedYes
+		}
+		entries = append(entries, e)
+	}
+
+	return l.journal.set(entries...)
+}
+
+// Uncommit forgets the commit status of the item and its sub-items
+func (l *localFS) Uncommit(itemPath string) error {
+	itemPath = path.Clean("/" + itemPath)
+	defer l.invalidate(itemPath, true)
+
+	tree := l.journal.getTree(itemPath)
+	for k := range tree {
+		tree[k] = journalEntry{RelativePath: tree[k].RelativePath, Removed: true}
+	}
+	return l.journal.set(tree...)
+}
+
+func (l *localFS) MarkNotCommited(itemPath string) error {
+	itemPath = path.Clean("/" + itemPath)
+	defer l.invalidate(itemPath, false)
+
+	fi, err := os.Stat(l.osPath(itemPath))
+	if err != nil {
+		return err
+	}
+
+	// Keeping the last commited etag
+	e, _ := l.journal.get(itemPath)
+	return l.journal.set(journalEntry{
+		RelativePath: itemPath,
+		Dir:          fi.IsDir(),
+		Etag:         e.Etag,
+		Commited:     fsync.CommitedNo,
+	})
+}
+
+func (l *localFS) MarkAwaitingRemoteDeletion(itemPath string) error {
+	itemPath = path.Clean("/" + itemPath)
+	defer l.invalidate(itemPath, true)
+
+	tree := l.journal.getTree(itemPath)
+	entries := make([]journalEntry, 0, len(tree))
+	for _, e := range tree {
+		if e.Commited == fsync.CommitedNo && e.Etag == "" {
+			// Never commited, nothing to delete remotely
+			entries = append(entries, journalEntry{RelativePath: e.RelativePath, Removed: true})
+			continue
+		}
+		e.Commited = fsync.CommitedAwaitingRemoteDeletion
+		entries = append(entries, e)
+	}
+
+	return l.journal.set(entries...)
+}
+
+type atomicFile struct {
+	*os.File
+	l        *localFS
+	itemPath string
+	target   string
+}
+
+func (f *atomicFile) Close() error {
+	defer f.l.invalidate(f.itemPath, true)
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	// Replacing a dir by a file
+	if fi, err := os.Stat(f.target); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(f.target); err != nil {
+			os.Remove(f.File.Name())
+			return err
+		}
+	}
+
+	if err := os.Rename(f.File.Name(), f.target); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+
+	return nil
+}
+
+// Abort removes the temporary file without replacing the target
+func (f *atomicFile) Abort() error {
+	defer os.Remove(f.File.Name())
+	return f.File.Close()
+}
@@ -0,0 +1,462 @@
+package localfs_test
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/localfs"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func writeFile(t *testing.T, l localfs.FS, itemPath, data string) {
+	w, err := l.Create(itemPath)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+}
+
+func getChildren(t *testing.T, l localfs.FS, itemPath string) map[string]fsync.LocalItem {
+	lis, err := l.GetChildren(itemPath)
+	require.NoError(t, err)
+
+	ret := map[string]fsync.LocalItem{}
+	for _, li := range lis {
+		// The inode based identity is checked by TestLocalFSMove
+		li.FileID = ""
+		li.ModTime = time.Time{}
+		li.Size = 0
+		ret[li.RelativePath] = li
+	}
+	return ret
+}
+
+func stat(t *testing.T, l localfs.FS, itemPath string) fsync.LocalItem {
+	li, err := l.Stat(itemPath)
+	require.NoError(t, err)
+	li.FileID = ""
+	li.ModTime = time.Time{}
+	li.Size = 0
+	return li
+}
+
+func TestLocalFS(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := localfs.New(root, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "b")
+	writeFile(t, l, "/c", "c")
+
+	t.Run("New items are not commited and the journal is hidden", func(t *testing.T) {
+		children := getChildren(t, l, "/")
+		assert.Equal(t, 2, len(children))
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a", Dir: true, Commited: fsync.CommitedNo}, children["/a"])
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/c", Commited: fsync.CommitedNo}, children["/c"])
+	})
+
+	require.NoError(t, l.Commit("/a", ""))
+	require.NoError(t, l.Commit("/a/b", "v1"))
+	require.NoError(t, l.Commit("/c", "v1"))
+	require.NoError(t, l.Close())
+
+	l, err = localfs.New(root, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	t.Run("Commit status is persisted", func(t *testing.T) {
+		children := getChildren(t, l, "/a")
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a/b", Etag: "v1", Commited: fsync.CommitedYes}, children["/a/b"])
+	})
+
+	t.Run("Modified files are not commited", func(t *testing.T) {
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(root, "c"), later, later))
+
+		li := stat(t, l, "/c")
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/c", Etag: "v1", Commited: fsync.CommitedNo}, li)
+
+		require.NoError(t, l.Commit("/c", "v2"))
+		require.NoError(t, l.MarkNotCommited("/c"))
+		li = stat(t, l, "/c")
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/c", Etag: "v2", Commited: fsync.CommitedNo}, li)
+	})
+
+	t.Run("Deleted commited items are awaiting remote deletion", func(t *testing.T) {
+		require.NoError(t, os.RemoveAll(filepath.Join(root, "a")))
+
+		children := getChildren(t, l, "/")
+		assert.Equal(t, fsync.CommitedAwaitingRemoteDeletion, children["/a"].Commited)
+		children = getChildren(t, l, "/a")
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a/b", Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion}, children["/a/b"])
+
+		require.NoError(t, l.Remove("/a"))
+		assert.Equal(t, 0, len(getChildren(t, l, "/a")))
+		_, ok := getChildren(t, l, "/")["/a"]
+		assert.Equal(t, false, ok)
+	})
+
+	t.Run("Mark awaiting remote deletion", func(t *testing.T) {
+		writeFile(t, l, "/d", "d")
+		require.NoError(t, os.Remove(filepath.Join(root, "c")))
+		require.NoError(t, os.Remove(filepath.Join(root, "d")))
+		require.NoError(t, l.MarkAwaitingRemoteDeletion("/c"))
+		require.NoError(t, l.MarkAwaitingRemoteDeletion("/d"))
+
+		children := getChildren(t, l, "/")
+		assert.Equal(t, 1, len(children))
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/c", Etag: "v2", Commited: fsync.CommitedAwaitingRemoteDeletion}, children["/c"])
+	})
+
+	t.Run("Aborted writes are not published", func(t *testing.T) {
+		w, err := l.Create("/e")
+		require.NoError(t, err)
+		io.WriteString(w, "partial")
+		require.NoError(t, w.(fsync.WriteAborter).Abort())
+		_, err = os.Stat(filepath.Join(root, "e"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Root cannot be removed", func(t *testing.T) {
+		require.ErrorIs(t, l.Remove("/"), localfs.ErrRemoveRoot)
+	})
+}
+
+func TestLocalFSJournal(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := localfs.New(root, nil)
+	require.NoError(t, err)
+	writeFile(t, l, "/a", "a")
+	writeFile(t, l, "/b", "b")
+	require.NoError(t, l.Commit("/a", "v1"))
+
+	t.Run("Commits are on disk before Close", func(t *testing.T) {
+		reopened, err := localfs.New(root, nil)
+		require.NoError(t, err)
+		defer reopened.Close()
+		assert.Equal(t, fsync.CommitedYes, stat(t, reopened, "/a").Commited)
+	})
+
+	t.Run("A failed write is not applied", func(t *testing.T) {
+		require.NoError(t, localfs.CloseJournalFile(l))
+		require.Error(t, l.Commit("/b", "v1"))
+		assert.Equal(t, fsync.CommitedNo, stat(t, l, "/b").Commited)
+	})
+}
+
+func TestLocalFSMissingRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+
+	l, err := localfs.New(root, &localfs.Options{JournalPath: filepath.Join(t.TempDir(), "journal")})
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "b")
+	require.NoError(t, l.Commit("/a", "d1"))
+	require.NoError(t, l.Commit("/a/b", "v1"))
+
+	// A missing sub-dir has no children but a missing root is an error
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "a")))
+	assert.Equal(t, 1, len(getChildren(t, l, "/a")))
+	require.NoError(t, os.RemoveAll(root))
+	_, err = l.GetChildren("/")
+	assert.Equal(t, true, os.IsNotExist(err))
+}
+
+func TestLocalFSMove(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := localfs.New(root, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "b")
+	require.NoError(t, l.Commit("/a", "d1"))
+	require.NoError(t, l.Commit("/a/b", "v1"))
+
+	t.Run("Renamed items keep their identity", func(t *testing.T) {
+		a, err := l.Stat("/a")
+		require.NoError(t, err)
+		require.NoError(t, os.Rename(filepath.Join(root, "a"), filepath.Join(root, "c")))
+
+		lis, err := l.GetChildren("/")
+		require.NoError(t, err)
+		require.Equal(t, 2, len(lis))
+		lis[1].ModTime = time.Time{}
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a", Dir: true, Etag: "d1", Commited: fsync.CommitedAwaitingRemoteDeletion, FileID: a.FileID}, lis[0])
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/c", Dir: true, Commited: fsync.CommitedNo, FileID: a.FileID}, lis[1])
+
+		// The renamed file is compared with the commited one
+		b, err := l.Stat("/a/b")
+		require.NoError(t, err)
+		c, err := l.Stat("/c/b")
+		require.NoError(t, err)
+		assert.Equal(t, fsync.CommitedAwaitingRemoteDeletion, b.Commited)
+		assert.Equal(t, int64(1), b.Size)
+		assert.Equal(t, true, b.ModTime.Equal(c.ModTime))
+	})
+
+	t.Run("Moving the commit status of a renamed item", func(t *testing.T) {
+		require.NoError(t, l.Move("/a", "/c"))
+		require.NoError(t, l.Commit("/c", "d2"))
+
+		assert.Equal(t, 1, len(getChildren(t, l, "/")))
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/c/b", Etag: "v1", Commited: fsync.CommitedYes}, stat(t, l, "/c/b"))
+	})
+
+	t.Run("Moving an item", func(t *testing.T) {
+		require.NoError(t, l.Move("/c", "/d/e"))
+
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/d/e/b", Etag: "v1", Commited: fsync.CommitedYes}, stat(t, l, "/d/e/b"))
+		_, err := os.Stat(filepath.Join(root, "c"))
+		assert.Equal(t, true, os.IsNotExist(err))
+	})
+
+	t.Run("Existing items are not replaced", func(t *testing.T) {
+		writeFile(t, l, "/f", "f")
+		writeFile(t, l, "/g", "g")
+
+		err := l.Move("/f", "/g")
+		assert.Equal(t, true, errors.Is(err, fs.ErrExist))
+		data, err := os.ReadFile(filepath.Join(root, "g"))
+		require.NoError(t, err)
+		assert.Equal(t, "g", string(data))
+		_, err = os.Stat(filepath.Join(root, "f"))
+		require.NoError(t, err)
+	})
+}
+
+func TestLocalFSTreeHash(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := localfs.New(root, &localfs.Options{CacheTreeHash: true})
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "b")
+	require.NoError(t, l.Commit("/a", "d1"))
+	require.NoError(t, l.Commit("/a/b", "v1"))
+
+	t.Run("Commited tree hash is reported", func(t *testing.T) {
+		require.NoError(t, l.CommitTreeHash("/a", "t1"))
+		assert.Equal(t, "t1", stat(t, l, "/a").TreeHash)
+		assert.Equal(t, "t1", getChildren(t, l, "/")["/a"].TreeHash)
+	})
+
+	t.Run("Local changes invalidate the tree hash", func(t *testing.T) {
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(root, "a", "b"), later, later))
+		// The hash is cached until the change is reported
+		assert.Equal(t, "t1", stat(t, l, "/a").TreeHash)
+		l.InvalidateTreeHash("/a/b")
+		assert.Equal(t, "", stat(t, l, "/a").TreeHash)
+
+		require.NoError(t, l.Commit("/a/b", "v2"))
+		require.NoError(t, l.CommitTreeHash("/a", "t2"))
+		assert.Equal(t, "t2", stat(t, l, "/a").TreeHash)
+
+		writeFile(t, l, "/a/c", "c")
+		assert.Equal(t, "", stat(t, l, "/a").TreeHash)
+	})
+
+	t.Run("Changes made while closed invalidate the tree hash", func(t *testing.T) {
+		require.NoError(t, l.Commit("/a/c", "v1"))
+		require.NoError(t, l.CommitTreeHash("/a", "t3"))
+		require.NoError(t, l.Close())
+
+		l, err = localfs.New(root, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "t3", stat(t, l, "/a").TreeHash)
+		require.NoError(t, l.Close())
+
+		require.NoError(t, os.WriteFile(filepath.Join(root, "a", "d"), []byte("d"), 0o644))
+		l, err = localfs.New(root, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "", stat(t, l, "/a").TreeHash)
+		require.NoError(t, l.Close())
+	})
+}
+
+func TestLocalFSTreeHashNotCached(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := localfs.New(root, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "b")
+	require.NoError(t, l.Commit("/a", "d1"))
+	require.NoError(t, l.Commit("/a/b", "v1"))
+	require.NoError(t, l.CommitTreeHash("/a", "t1"))
+	assert.Equal(t, "t1", stat(t, l, "/a").TreeHash)
+
+	// Without the cache, the changes made by other programs are found without InvalidateTreeHash
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "a", "b"), later, later))
+	assert.Equal(t, "", stat(t, l, "/a").TreeHash)
+}
+
+func TestLocalFSContentHash(t *testing.T) {
+	root := t.TempDir()
+
+	_, err := localfs.New(root, &localfs.Options{HashAlgorithm: "crc32"})
+	require.ErrorIs(t, err, localfs.ErrHashAlgorithm)
+
+	l, err := localfs.New(root, &localfs.Options{HashAlgorithm: "sha256"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "b")
+
+	t.Run("Files are hashed", func(t *testing.T) {
+		li := stat(t, l, "/a/b")
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("b"))), li.ContentHash)
+		assert.Equal(t, "sha256", li.HashAlgorithm)
+		assert.DeepEqual(t, li, getChildren(t, l, "/a")["/a/b"])
+
+		li = stat(t, l, "/a")
+		assert.Equal(t, "", li.ContentHash)
+		assert.Equal(t, "", li.HashAlgorithm)
+	})
+
+	t.Run("Hashes are cached until the file changes", func(t *testing.T) {
+		li, err := l.Stat("/a/b")
+		require.NoError(t, err)
+
+		// Same size and modification time: the cached hash is reported
+		require.NoError(t, os.WriteFile(filepath.Join(root, "a", "b"), []byte("c"), 0o644))
+		require.NoError(t, os.Chtimes(filepath.Join(root, "a", "b"), li.ModTime, li.ModTime))
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("b"))), stat(t, l, "/a/b").ContentHash)
+
+		later := li.ModTime.Add(time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(root, "a", "b"), later, later))
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("c"))), stat(t, l, "/a/b").ContentHash)
+
+		writeFile(t, l, "/a/b", "d")
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("d"))), stat(t, l, "/a/b").ContentHash)
+	})
+
+	t.Run("Hashing is disabled by default", func(t *testing.T) {
+		l, err := localfs.New(t.TempDir(), nil)
+		require.NoError(t, err)
+		defer l.Close()
+
+		writeFile(t, l, "/b", "b")
+		assert.Equal(t, "", stat(t, l, "/b").ContentHash)
+	})
+}
+
+func TestLocalFSTrash(t *testing.T) {
+	root := t.TempDir()
+
+	l, err := localfs.New(root, &localfs.Options{UseTrash: true})
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Mkdir("/a"))
+	writeFile(t, l, "/a/b", "bb")
+	writeFile(t, l, "/c", "c")
+	require.NoError(t, l.Commit("/a", ""))
+	require.NoError(t, l.Commit("/a/b", "v1"))
+	require.NoError(t, l.Commit("/c", "v1"))
+
+	d := fsync.Decision{
+		RelativePath: "/a",
+		Flag:         fsync.DecisionDeleteLocal,
+		RemoteIsDir:  true,
+		Why:          fsync.DecisionWhy{LocalItemPresent: true, LocalItemDir: true, LocalItemCommited: fsync.CommitedYes.ToString()},
+	}
+
+	t.Run("Deleted items are moved to the hidden trash", func(t *testing.T) {
+		require.NoError(t, l.MoveToTrash("/a", d))
+		require.NoError(t, l.MoveToTrash("/c", fsync.Decision{RelativePath: "/c", Flag: fsync.DecisionDeleteLocalAndDownloadRemote, RemoteValidEtag: "v2"}))
+
+		children := getChildren(t, l, "/")
+		assert.Equal(t, 0, len(children))
+
+		entries, err := l.ListTrash()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(entries))
+		assert.Equal(t, "/a", entries[0].OriginalPath)
+		assert.Equal(t, true, entries[0].Dir)
+		assert.Equal(t, int64(2), entries[0].Size)
+		assert.DeepEqual(t, d.Why, entries[0].Why)
+		assert.Equal(t, "/c", entries[1].OriginalPath)
+		assert.Equal(t, "v2", entries[1].RemoteEtag)
+		assert.Equal(t, fsync.DecisionDeleteLocalAndDownloadRemote, entries[1].Flag)
+	})
+
+	t.Run("Restored items are not commited", func(t *testing.T) {
+		entries, err := l.ListTrash()
+		require.NoError(t, err)
+		require.NoError(t, l.RestoreTrash(entries[0].ID))
+
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a/b", Commited: fsync.CommitedNo}, stat(t, l, "/a/b"))
+		require.ErrorIs(t, l.RestoreTrash(entries[0].ID), localfs.ErrTrashEntryNotFound)
+
+		writeFile(t, l, "/c", "new c")
+		require.ErrorIs(t, l.RestoreTrash(entries[1].ID), localfs.ErrRestoreExists)
+	})
+
+	t.Run("Purging by size", func(t *testing.T) {
+		require.NoError(t, l.MoveToTrash("/a", d))
+
+		purged, err := l.PurgeTrash(time.Hour, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+
+		entries, err := l.ListTrash()
+		require.NoError(t, err)
+		require.Equal(t, 1, len(entries))
+		assert.Equal(t, "/a", entries[0].OriginalPath)
+	})
+
+	t.Run("Purging by age", func(t *testing.T) {
+		purged, err := l.PurgeTrash(time.Nanosecond, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+
+		des, err := os.ReadDir(filepath.Join(root, localfs.DefaultJournalDir, localfs.DefaultTrashDir))
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(des))
+	})
+}
+
+func TestLocalFSTrashDevice(t *testing.T) {
+	root := t.TempDir()
+
+	// A tmpfs is usually mounted on /dev/shm
+	trashDir, err := os.MkdirTemp("/dev/shm", "trash")
+	if err != nil {
+		t.Skip("no tmpfs available:", err)
+	}
+	defer os.RemoveAll(trashDir)
+
+	rootInfo, err := os.Stat(root)
+	require.NoError(t, err)
+	trashInfo, err := os.Stat(trashDir)
+	require.NoError(t, err)
+	if localfs.SameDevice(rootInfo, trashInfo) {
+		t.Skip("the temporary dirs are on the same file system")
+	}
+
+	_, err = localfs.New(root, &localfs.Options{UseTrash: true, TrashDir: trashDir})
+	require.ErrorIs(t, err, localfs.ErrTrashDevice)
+}
@@ -0,0 +1,242 @@
+package localfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// TrashEntry is a local item deleted by a decision
+	TrashEntry struct {
+		ID           string             `json:"id"`
+		OriginalPath string             `json:"original_path"`
+		Dir          bool               `json:"dir"`
+		Size         int64              `json:"size"`
+		RemoteEtag   string             `json:"remote_etag"`
+		Flag         fsync.DecisionFlag `json:"flag"`
+		Why          fsync.DecisionWhy  `json:"why"`
+		DeletedAt    time.Time          `json:"deleted_at"`
+	}
+)
+
+var (
+	ErrTrashEntryNotFound = errors.New("localfs: trash entry not found")
+	ErrRestoreExists      = errors.New("localfs: an item already exists at the original path")
+)
+
+const (
+	DefaultTrashDir = "trash"
+
+	trashDateLayout = "2006-01-02"
+	trashMetaName   = "meta.json"
+	trashItemName   = "item"
+)
+
+// MoveToTrash moves the item to a dated trash directory with the decision metadata.
+// Without a trash the item is removed
+func (l *localFS) MoveToTrash(itemPath string, d fsync.Decision) error {
+	itemPath = path.Clean("/" + itemPath)
+	if l.trashDir == "" {
+		return l.Remove(itemPath)
+	}
+	if itemPath == "/" {
+		return ErrRemoveRoot
+	}
+
+	fi, err := os.Lstat(l.osPath(itemPath))
+	if os.IsNotExist(err) {
+		// Already deleted, forgetting the commit status
+		return l.Remove(itemPath)
+	} else if err != nil {
+		return err
+	}
+
+	size, err := treeSize(l.osPath(itemPath))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	l.trashMu.Lock()
+	l.trashSeq++
+	id := fmt.Sprintf("%s/%d-%d", now.UTC().Format(trashDateLayout), now.UnixNano(), l.trashSeq)
+	l.trashMu.Unlock()
+
+	entryDir := filepath.Join(l.trashDir, filepath.FromSlash(id))
+	if err := os.MkdirAll(entryDir, 0o755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(l.osPath(itemPath), filepath.Join(entryDir, trashItemName)); err != nil {
+		os.Remove(entryDir)
+		return err
+	}
+
+	// Writing the meta once the item is in the trash so that no entry is listed without its item
+	data, err := json.Marshal(TrashEntry{
+		ID:           id,
+		OriginalPath: itemPath,
+		Dir:          fi.IsDir(),
+		Size:         size,
+		RemoteEtag:   d.RemoteValidEtag,
+		Flag:         d.Flag,
+		Why:          d.Why,
+		DeletedAt:    now,
+	})
+	if err == nil {
+		err = os.WriteFile(filepath.Join(entryDir, trashMetaName), data, 0o644)
+	}
+	if err != nil {
+		// Putting the item back
+		if rErr := os.Rename(filepath.Join(entryDir, trashItemName), l.osPath(itemPath)); rErr == nil {
+			os.RemoveAll(entryDir)
+		}
+		return err
+	}
+
+	return l.Remove(itemPath)
+}
+
+// ListTrash returns the trash entries from the oldest to the newest
+func (l *localFS) ListTrash() ([]TrashEntry, error) {
+	if l.trashDir == "" {
+		return []TrashEntry{}, nil
+	}
+
+	metas, err := filepath.Glob(filepath.Join(l.trashDir, "*", "*", trashMetaName))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]TrashEntry, 0, len(metas))
+	for _, m := range metas {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			return nil, err
+		}
+		te := TrashEntry{}
+		if err := json.Unmarshal(data, &te); err != nil {
+			// Ignoring an entry interrupted while being written
+			continue
+		}
+		ret = append(ret, te)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].DeletedAt.Before(ret[j].DeletedAt) })
+
+	return ret, nil
+}
+
+// RestoreTrash moves the item of a trash entry back to its original path.
+// The restored item is not commited and is uploaded by the next sync
+func (l *localFS) RestoreTrash(id string) error {
+	te, err := l.getTrashEntry(id)
+	if err != nil {
+		return err
+	}
+
+	target := l.osPath(te.OriginalPath)
+	if _, err := os.Lstat(target); err == nil {
+		return ErrRestoreExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	entryDir := filepath.Join(l.trashDir, filepath.FromSlash(te.ID))
+	defer l.invalidate(te.OriginalPath, true)
+	if err := os.Rename(filepath.Join(entryDir, trashItemName), target); err != nil {
+		return err
+	}
+
+	return l.removeTrashEntry(te)
+}
+
+// PurgeTrash deletes the entries older than maxAge, then the oldest entries
+// until the trash is smaller than maxSize. A zero limit is not applied
+func (l *localFS) PurgeTrash(maxAge time.Duration, maxSize int64) (purged int, err error) {
+	entries, err := l.ListTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	total := int64(0)
+	for _, te := range entries {
+		total += te.Size
+	}
+
+	now := time.Now()
+	for _, te := range entries {
+		tooOld := maxAge > 0 && now.Sub(te.DeletedAt) > maxAge
+		tooBig := maxSize > 0 && total > maxSize
+		if !tooOld && !tooBig {
+			// Entries are sorted from the oldest
+			break
+		}
+		if err := l.removeTrashEntry(te); err != nil {
+			return purged, err
+		}
+		total -= te.Size
+		purged++
+	}
+
+	return purged, nil
+}
+
+func (l *localFS) getTrashEntry(id string) (TrashEntry, error) {
+	te := TrashEntry{}
+	if l.trashDir == "" || path.Clean("/"+id) != "/"+id {
+		return te, ErrTrashEntryNotFound
+	}
+
+	data, err := os.ReadFile(filepath.Join(l.trashDir, filepath.FromSlash(id), trashMetaName))
+	if os.IsNotExist(err) {
+		return te, ErrTrashEntryNotFound
+	} else if err != nil {
+		return te, err
+	}
+
+	err = json.Unmarshal(data, &te)
+	return te, err
+}
+
+func (l *localFS) removeTrashEntry(te TrashEntry) error {
+	entryDir := filepath.Join(l.trashDir, filepath.FromSlash(te.ID))
+	if err := os.RemoveAll(entryDir); err != nil {
+		return err
+	}
+
+	// Removing the dated directory once empty
+	os.Remove(filepath.Dir(entryDir))
+	return nil
+}
+
+func treeSize(osPath string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(osPath, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.Type().IsRegular() {
+			fi, err := de.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,140 @@
+package localfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fenritec/go-fsync"
+)
+
+// CommitTreeHash stores the remote TreeHash of a dir found in sync with the local Merkle hash of its subtree.
+// The TreeHash is reported by GetChildren and Stat as long as the local subtree is unchanged
+func (l *localFS) CommitTreeHash(itemPath string, treeHash string) error {
+	itemPath = path.Clean("/" + itemPath)
+
+	e, ok := l.journal.get(itemPath)
+	if !ok || !e.Dir || e.Commited != fsync.CommitedYes {
+		return nil
+	}
+
+	localTreeHash, err := l.TreeHash(itemPath)
+	if err != nil {
+		return err
+	}
+
+	e.TreeHash = treeHash
+	e.LocalTreeHash = localTreeHash
+	return l.journal.set(e)
+}
+
+// TreeHash computes the Merkle hash of the local subtree from the OS status of the items and their commit status.
+// With Options.CacheTreeHash, the hashes of the dirs are cached until InvalidateTreeHash or a change made through the FS
+func (l *localFS) TreeHash(itemPath string) (string, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	l.hashMu.Lock()
+	localTreeHash, ok := l.hashes[itemPath]
+	gen := l.hashGen
+	l.hashMu.Unlock()
+	if ok {
+		return localTreeHash, nil
+	}
+
+	des, err := os.ReadDir(l.osPath(itemPath))
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, de := range des {
+		childPath := path.Join(itemPath, de.Name())
+		if l.IsIgnored(childPath) || (!de.IsDir() && !de.Type().IsRegular()) {
+			continue
+		}
+
+		e, _ := l.journal.get(childPath)
+
+		var childHash string
+		if de.IsDir() {
+			if childHash, err = l.TreeHash(childPath); err != nil {
+				return "", err
+			}
+		} else {
+			fi, err := de.Info()
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return "", err
+			}
+			childHash = fmt.Sprintf("%d %d", fi.Size(), fi.ModTime().UnixNano())
+		}
+
+		fmt.Fprintf(h, "%q %v %d %q %s\n", de.Name(), de.IsDir(), e.Commited, e.Etag, childHash)
+	}
+	localTreeHash = hex.EncodeToString(h.Sum(nil))
+
+	// Not caching a hash computed during a change
+	l.hashMu.Lock()
+	if l.hashes != nil && gen == l.hashGen {
+		l.hashes[itemPath] = localTreeHash
+	}
+	l.hashMu.Unlock()
+
+	return localTreeHash, nil
+}
+
+// InvalidateTreeHash drops the cached hashes of the item and of its parent dirs
+func (l *localFS) InvalidateTreeHash(itemPath string) {
+	l.invalidate(path.Clean("/"+itemPath), false)
+}
+
+// invalidate drops the cached hashes of the item and of its parent dirs, and of its sub-items with subtree
+func (l *localFS) invalidate(itemPath string, subtree bool) {
+	prefix := strings.TrimSuffix(itemPath, "/") + "/"
+
+	l.contentMu.Lock()
+	delete(l.contentHashes, itemPath)
+	if subtree {
+		for p := range l.contentHashes {
+			if strings.HasPrefix(p, prefix) {
+				delete(l.contentHashes, p)
+			}
+		}
+	}
+	l.contentMu.Unlock()
+
+	l.hashMu.Lock()
+	defer l.hashMu.Unlock()
+
+	l.hashGen++
+	if subtree {
+		for p := range l.hashes {
+			if strings.HasPrefix(p, prefix) {
+				delete(l.hashes, p)
+			}
+		}
+	}
+	for {
+		delete(l.hashes, itemPath)
+		if itemPath == "/" {
+			return
+		}
+		itemPath = path.Dir(itemPath)
+	}
+}
+
+// withTreeHash reports the commited TreeHash of a dir when its subtree is unchanged
+func (l *localFS) withTreeHash(li fsync.LocalItem, e journalEntry) fsync.LocalItem {
+	if !li.Dir || li.Commited != fsync.CommitedYes || e.TreeHash == "" {
+		return li
+	}
+
+	if localTreeHash, err := l.TreeHash(li.RelativePath); err == nil && localTreeHash == e.LocalTreeHash {
+		li.TreeHash = e.TreeHash
+	}
+	return li
+}
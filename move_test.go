@@ -0,0 +1,201 @@
+package fsync_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func testScenarioMoves(t *testing.T, lst fsync.LocalItems, rst fsync.RemoteItems, expectedDecisions []fsync.Decision) {
+	testScenarioWithOptions(t, lst, rst, expectedDecisions, &fsync.Options{
+		DetectMoves: true,
+	})
+}
+
+func TestProviderMoves(t *testing.T) {
+	t.Run("File renamed remotely", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/b", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/b", Flag: fsync.DecisionMoveLocal},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("Dir renamed remotely", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Etag: "d1", Commited: fsync.CommitedYes},
+			{RelativePath: "/a/c", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/b", Dir: true, Etag: "d1"},
+			{RelativePath: "/b/c", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/b", Flag: fsync.DecisionMoveLocal},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("File renamed locally", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion, FileID: "1"},
+			{RelativePath: "/b", Dir: false, Commited: fsync.CommitedNo, FileID: "1"},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/b", Flag: fsync.DecisionMoveRemote},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("Dir renamed locally", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedAwaitingRemoteDeletion, FileID: "1"},
+			{RelativePath: "/a/c", Dir: false, Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion, FileID: "2"},
+			{RelativePath: "/b", Dir: true, Commited: fsync.CommitedNo, FileID: "1"},
+			{RelativePath: "/b/c", Dir: false, Commited: fsync.CommitedNo, FileID: "2"},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: true},
+			{RelativePath: "/a/c", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/b", Flag: fsync.DecisionMoveRemote},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("File renamed locally and modified remotely", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion, FileID: "1"},
+			{RelativePath: "/b", Dir: false, Commited: fsync.CommitedNo, FileID: "1"},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: false, Etag: "v2"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionDownloadRemote},
+			{RelativePath: "/b", Flag: fsync.DecisionUploadLocal},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("File renamed and modified locally", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion, FileID: "1", Size: 2, ModTime: time.Unix(1, 0)},
+			{RelativePath: "/b", Dir: false, Commited: fsync.CommitedNo, FileID: "1", Size: 3, ModTime: time.Unix(2, 0)},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionDeleteRemote},
+			{RelativePath: "/b", Flag: fsync.DecisionUploadLocal},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("Ambiguous copies are not moves", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/b", Dir: false, Etag: "v1"},
+			{RelativePath: "/c", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionDeleteLocal},
+			{RelativePath: "/b", Flag: fsync.DecisionDownloadRemote},
+			{RelativePath: "/c", Flag: fsync.DecisionDownloadRemote},
+		}
+
+		testScenarioMoves(t, localStatus, remoteStatus, expectedDecisions)
+	})
+
+	t.Run("Moves are not detected by default", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/b", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionDeleteLocal},
+			{RelativePath: "/b", Flag: fsync.DecisionDownloadRemote},
+		}
+
+		testScenario(t, localStatus, remoteStatus, expectedDecisions)
+	})
+}
+
+func TestExecutorMoves(t *testing.T) {
+	opts := &fsync.Options{DetectMoves: true}
+
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	rFS.Write("/a/b", "b")
+	rFS.Write("/c", "c")
+	syncWithExecutor(t, lFS, rFS, opts)
+
+	t.Run("Renamed remotely", func(t *testing.T) {
+		require.NoError(t, rFS.Move("/a", "/d"))
+		require.NoError(t, rFS.Move("/c", "/e"))
+
+		results := syncWithExecutor(t, lFS, rFS, opts)
+		require.Equal(t, 2, len(results))
+		for _, r := range results {
+			assert.Equal(t, fsync.DecisionMoveLocal, r.Decision.Flag)
+		}
+
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+	})
+
+	t.Run("Renamed locally", func(t *testing.T) {
+		lFS.Rename("/d", "/f")
+		lFS.Rename("/e", "/g")
+
+		results := syncWithExecutor(t, lFS, rFS, opts)
+		require.Equal(t, 2, len(results))
+		for _, r := range results {
+			assert.Equal(t, fsync.DecisionMoveRemote, r.Decision.Flag)
+		}
+
+		fsynctest.AssertConverged(t, lFS, rFS, opts)
+		_, ok := rFS.Data("/f/b")
+		assert.Equal(t, true, ok)
+	})
+}
@@ -0,0 +1,65 @@
+package fsync
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+type (
+	// Plan is the ordered list of decisions needed to sync a relative path
+	Plan struct {
+		RelativePath string     `json:"relative_path"`
+		Decisions    []Decision `json:"decisions"`
+	}
+)
+
+// Plan collects every decision needed to sync the requested relative path
+// and sorts them so that creations precede children and deletions follow children
+func (p *provider) Plan(ctx context.Context, rPath string) (Plan, error) {
+	decisions := []Decision{}
+	err := p.guardDeletions(ctx, rPath, func(ctx context.Context, d Decision) error {
+		decisions = append(decisions, d)
+		return ctx.Err()
+	}, func(ctx context.Context, takeDecision DecisionCallback) error {
+		_, _, err := p.checkChanges(ctx, rPath, false, false, nil, p.resolveConflicts(takeDecision))
+		return err
+	})
+	if err != nil {
+		return Plan{}, err
+	}
+
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return Less(decisions[i], decisions[j])
+	})
+
+	return Plan{
+		RelativePath: rPath,
+		Decisions:    decisions,
+	}, nil
+}
+
+// Apply sends the decisions of the plan in order to the callback
+func (pl Plan) Apply(ctx context.Context, takeDecision DecisionCallback) error {
+	for _, d := range pl.Decisions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := takeDecision(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pl Plan) ToJSONString() string {
+	data, _ := json.Marshal(pl)
+	return string(data)
+}
+
+// ParsePlan reads a plan serialised with ToJSONString
+func ParsePlan(data string) (Plan, error) {
+	pl := Plan{}
+	err := json.Unmarshal([]byte(data), &pl)
+	return pl, err
+}
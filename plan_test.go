@@ -0,0 +1,146 @@
+package fsync_test
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestLess(t *testing.T) {
+	decisions := []fsync.Decision{
+		{RelativePath: "/a-b", Flag: fsync.DecisionDownloadRemote},
+		{RelativePath: "/a/b/c", Flag: fsync.DecisionDeleteLocal},
+		{RelativePath: "/a", Flag: fsync.DecisionDeleteLocal},
+		{RelativePath: "/d/e", Flag: fsync.DecisionUploadLocal},
+		{RelativePath: "/a/b", Flag: fsync.DecisionDeleteLocal},
+		{RelativePath: "/d", Flag: fsync.DecisionCreateDirRemote},
+	}
+
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return fsync.Less(decisions[i], decisions[j])
+	})
+
+	paths := []string{}
+	for _, d := range decisions {
+		paths = append(paths, d.RelativePath)
+	}
+	assert.DeepEqual(t, []string{"/a/b/c", "/a/b", "/a", "/a-b", "/d", "/d/e"}, paths)
+
+	for _, d := range decisions {
+		assert.Assert(t, !fsync.Less(d, d), "%s on %s", d.Flag.ToString(), d.RelativePath)
+	}
+}
+
+func TestLessShuffled(t *testing.T) {
+	expected := []fsync.Decision{
+		{RelativePath: "/a (conflict copy)", FromRelativePath: "/a", Flag: fsync.DecisionRenameLocal},
+		{RelativePath: "/a", Flag: fsync.DecisionDownloadRemote},
+		{RelativePath: "/a (b)", Flag: fsync.DecisionUploadLocal},
+		{RelativePath: "/d/x", Flag: fsync.DecisionDeleteLocal},
+		{RelativePath: "/d", Flag: fsync.DecisionDeleteLocal, RemoteIsDir: true},
+		{RelativePath: "/e", Flag: fsync.DecisionDeleteLocalAndCreateDirLocal, RemoteIsDir: true},
+		{RelativePath: "/e/x", Flag: fsync.DecisionDownloadRemote},
+		{RelativePath: "/f", Flag: fsync.DecisionDeleteRemote},
+		{RelativePath: "/f", Flag: fsync.DecisionCreateDirRemote},
+		{RelativePath: "/f/y", Flag: fsync.DecisionUploadLocal},
+		{RelativePath: "/g/z", Flag: fsync.DecisionDeleteRemote},
+		{RelativePath: "/g", Flag: fsync.DecisionDeleteRemote, RemoteIsDir: true},
+		{RelativePath: "/g", Flag: fsync.DecisionUploadLocal},
+	}
+
+	for _, i := range expected {
+		assert.Assert(t, !fsync.Less(i, i))
+		for _, j := range expected {
+			for _, k := range expected {
+				if fsync.Less(i, j) && fsync.Less(j, k) {
+					assert.Assert(t, fsync.Less(i, k), "%s %s < %s %s < %s %s",
+						i.Flag.ToString(), i.RelativePath, j.Flag.ToString(), j.RelativePath, k.Flag.ToString(), k.RelativePath)
+				}
+			}
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		decisions := append([]fsync.Decision{}, expected...)
+		rnd.Shuffle(len(decisions), func(i, j int) {
+			decisions[i], decisions[j] = decisions[j], decisions[i]
+		})
+		sort.SliceStable(decisions, func(i, j int) bool {
+			return fsync.Less(decisions[i], decisions[j])
+		})
+		require.Equal(t, expected, decisions)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	require.NoError(t, rFS.Mkdir("/a/b"))
+	rFS.Write("/a/b/c", "c")
+	require.NoError(t, rFS.Mkdir("/d"))
+	rFS.Write("/d/e", "e")
+	syncWithExecutor(t, lFS, rFS, nil)
+
+	// Remote deletion of /a and new local files in /d
+	require.NoError(t, rFS.Remove("/a"))
+	require.NoError(t, lFS.Mkdir("/d/f"))
+	lFS.Write("/d/f/g", "g")
+
+	p := fsync.NewProvider(lFS, rFS, func(ctx context.Context, d fsync.Decision) error {
+		t.Fatalf("unexpected decision %s on %s", d.Flag.ToString(), d.RelativePath)
+		return nil
+	}, nil)
+
+	plan, err := p.Plan(ctx, "/")
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, d := range plan.Decisions {
+		paths = append(paths, d.RelativePath)
+	}
+	assert.DeepEqual(t, []string{"/a/b/c", "/a/b", "/a", "/d/f", "/d/f/g"}, paths)
+
+	t.Run("JSON round trip", func(t *testing.T) {
+		parsed, err := fsync.ParsePlan(plan.ToJSONString())
+		require.NoError(t, err)
+		assert.DeepEqual(t, plan, parsed)
+		assert.Equal(t, fsync.DecisionDeleteLocal, parsed.Decisions[0].Flag)
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		e := fsync.NewExecutor(lFS, rFS, nil, nil)
+		require.NoError(t, plan.Apply(ctx, e.Execute))
+
+		fsynctest.AssertConverged(t, lFS, rFS, nil)
+	})
+}
+
+func TestPlanFileReplacedByDir(t *testing.T) {
+	ctx := context.Background()
+
+	l := fsynctest.NewLocalFS(fsync.LocalItem{RelativePath: "/d", Etag: "d", Commited: fsync.CommitedYes})
+	r := fsynctest.NewRemoteFS(
+		fsync.RemoteItem{RelativePath: "/d", Dir: true},
+		fsync.RemoteItem{RelativePath: "/d/x", Etag: "x"},
+	)
+
+	plan, err := fsync.NewProvider(l, r, nil, nil).Plan(ctx, "/")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(plan.Decisions))
+	assert.Equal(t, fsync.DecisionDeleteLocalAndCreateDirLocal, plan.Decisions[0].Flag)
+	assert.Equal(t, "/d/x", plan.Decisions[1].RelativePath)
+
+	require.NoError(t, plan.Apply(ctx, fsync.NewExecutor(l, r, nil, nil).Execute))
+	fsynctest.AssertConverged(t, l, r, nil)
+}
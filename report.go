@@ -0,0 +1,105 @@
+package fsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+type (
+	// Report groups the decisions of a dry run by DecisionFlag
+	Report struct {
+		RelativePath string        `json:"relative_path"`
+		Total        int           `json:"total"`
+		Groups       []ReportGroup `json:"groups"`
+	}
+
+	ReportGroup struct {
+		Flag    DecisionFlag  `json:"flag"`
+		Count   int           `json:"count"`
+		Entries []ReportEntry `json:"entries"`
+	}
+
+	ReportEntry struct {
+		RelativePath     string `json:"relative_path"`
+		FromRelativePath string `json:"from_relative_path,omitempty"`
+		// Why is the DecisionWhy.ToJSONString payload
+		Why json.RawMessage `json:"why"`
+	}
+)
+
+// NewReport creates an empty report. Its Add method can be used as the DecisionCallback of a provider
+// to record the decisions without applying them:
+//
+//	r := fsync.NewReport("/")
+//	p := fsync.NewProvider(l, rm, r.Add, nil)
+func NewReport(relativePath string) *Report {
+	return &Report{
+		RelativePath: relativePath,
+		Groups:       []ReportGroup{},
+	}
+}
+
+// Report returns the dry-run report of the plan
+func (pl Plan) Report() *Report {
+	r := NewReport(pl.RelativePath)
+	for _, d := range pl.Decisions {
+		r.add(d)
+	}
+	return r
+}
+
+// Add records the decision in its group
+func (r *Report) Add(ctx context.Context, d Decision) error {
+	r.add(d)
+	return ctx.Err()
+}
+
+func (r *Report) add(d Decision) {
+	r.Total++
+	i := sort.Search(len(r.Groups), func(i int) bool { return r.Groups[i].Flag >= d.Flag })
+	if i == len(r.Groups) || r.Groups[i].Flag != d.Flag {
+		r.Groups = append(r.Groups, ReportGroup{})
+		copy(r.Groups[i+1:], r.Groups[i:])
+		r.Groups[i] = ReportGroup{Flag: d.Flag, Entries: []ReportEntry{}}
+	}
+
+	g := &r.Groups[i]
+	g.Count++
+	g.Entries = append(g.Entries, ReportEntry{
+		RelativePath:     d.RelativePath,
+		FromRelativePath: d.FromRelativePath,
+		Why:              json.RawMessage(d.Why.ToJSONString()),
+	})
+}
+
+// WriteTable renders the decisions as a terminal table followed by the totals
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLAG\tPATH\tFROM")
+	for _, g := range r.Groups {
+		for _, e := range g.Entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", g.Flag.ToString(), e.RelativePath, e.FromRelativePath)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLAG\tCOUNT")
+	for _, g := range r.Groups {
+		fmt.Fprintf(tw, "%s\t%d\n", g.Flag.ToString(), g.Count)
+	}
+	fmt.Fprintf(tw, "Total\t%d\n", r.Total)
+	return tw.Flush()
+}
+
+func (r *Report) ToJSONString() string {
+	data, _ := json.Marshal(r)
+	return string(data)
+}
@@ -0,0 +1,72 @@
+package fsync_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestReport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	rFS.Write("/a/b", "b")
+	syncWithExecutor(t, lFS, rFS, nil)
+
+	require.NoError(t, rFS.Remove("/a"))
+	lFS.Write("/c", "c")
+	lFS.Write("/d", "d")
+
+	r := fsync.NewReport("/")
+	p := fsync.NewProvider(lFS, rFS, r.Add, nil)
+	require.NoError(t, p.DoInitialSync(ctx))
+
+	assert.Equal(t, 4, r.Total)
+	assert.Equal(t, 2, len(r.Groups))
+	assert.Equal(t, fsync.DecisionUploadLocal, r.Groups[0].Flag)
+	assert.Equal(t, 2, r.Groups[0].Count)
+	assert.Equal(t, fsync.DecisionDeleteLocal, r.Groups[1].Flag)
+	assert.Equal(t, 2, r.Groups[1].Count)
+
+	// Nothing was applied
+	_, ok := lFS.Data("/a/b")
+	assert.Equal(t, true, ok)
+
+	t.Run("Plan report", func(t *testing.T) {
+		plan, err := p.Plan(ctx, "/")
+		require.NoError(t, err)
+		assert.DeepEqual(t, r.Groups, plan.Report().Groups)
+	})
+
+	t.Run("Table", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		require.NoError(t, r.WriteTable(&buf))
+
+		out := buf.String()
+		t.Log(out)
+		assert.Equal(t, true, strings.Contains(out, "DecisionDeleteLocal  /a/b"))
+		assert.Equal(t, true, strings.Contains(out, "DecisionUploadLocal  2"))
+		assert.Equal(t, true, strings.Contains(out, "Total                4"))
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		parsed := fsync.Report{}
+		require.NoError(t, json.Unmarshal([]byte(r.ToJSONString()), &parsed))
+		assert.DeepEqual(t, *r, parsed)
+
+		why := fsync.DecisionWhy{}
+		require.NoError(t, json.Unmarshal(parsed.Groups[1].Entries[0].Why, &why))
+		assert.Equal(t, true, why.LocalItemPresent)
+		assert.Equal(t, false, why.RemoteItemPresent)
+	})
+}
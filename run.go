@@ -0,0 +1,150 @@
+package fsync
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = 5 * time.Minute
+)
+
+// Run consumes the items sent through LocalChange and RemoteChange until the context is done.
+// Changes are coalesced per parent directory during ChangeDelay and only the changed
+// children are checked. The changes are still consumed while a check runs.
+// A failed check is reported to Options.OnRunError and its changes are checked again after RetryDelay,
+// doubled at each consecutive failure. With ContinueOnError only the paths of the *SyncError
+// are checked again. Run only returns when the context is done.
+// Run must not be called concurrently
+func (p *provider) Run(ctx context.Context) error {
+	pending := map[string]bool{}
+	var timer <-chan time.Time
+	var done chan error
+	var checking map[string]bool
+	retryDelay := time.Duration(0)
+
+	for {
+		select {
+		case <-ctx.Done():
+			if done != nil {
+				<-done
+			}
+			return ctx.Err()
+		case li := <-p.localChange:
+			pending[cleanChangePath(li.RelativePath)] = true
+		case ri := <-p.remoteChange:
+			pending[cleanChangePath(ri.RelativePath)] = true
+		case <-timer:
+			timer = nil
+			checking, pending = pending, map[string]bool{}
+			done = make(chan error, 1)
+			go func(checking map[string]bool) {
+				done <- p.checkPendingChanges(ctx, checking)
+			}(checking)
+			continue
+		case err := <-done:
+			done = nil
+			if err != nil && ctx.Err() == nil {
+				if p.onRunError != nil {
+					p.onRunError(ctx, err)
+				}
+				// The changes of the failed check are kept for the retry.
+				// With ContinueOnError only the failed paths are checked again
+				var sErr *SyncError
+				if errors.As(err, &sErr) {
+					for _, rPath := range sErr.failedPaths() {
+						pending[cleanChangePath(rPath)] = true
+					}
+				} else {
+					for rPath := range checking {
+						pending[rPath] = true
+					}
+				}
+				retryDelay = p.nextRetryDelay(retryDelay)
+				timer = time.After(retryDelay)
+				continue
+			}
+			retryDelay = 0
+			if len(pending) == 0 {
+				continue
+			}
+		}
+
+		if timer == nil && done == nil {
+			timer = time.After(p.changeDelay)
+		}
+	}
+}
+
+// nextRetryDelay doubles the delay before checking the changes of a failed check again
+func (p *provider) nextRetryDelay(retryDelay time.Duration) time.Duration {
+	switch {
+	case retryDelay == 0 && p.retryDelay > 0:
+		return p.retryDelay
+	case retryDelay == 0:
+		return defaultRetryDelay
+	case 2*retryDelay > maxRetryDelay:
+		return maxRetryDelay
+	}
+	return 2 * retryDelay
+}
+
+func cleanChangePath(rPath string) string {
+	return path.Clean("/" + rPath)
+}
+
+func (p *provider) checkPendingChanges(ctx context.Context, pending map[string]bool) error {
+	if pending["/"] {
+		return p.CheckChanges(ctx, "/")
+	}
+
+	paths := make([]string, 0, len(pending))
+	for rPath := range pending {
+		paths = append(paths, rPath)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return comparePaths(paths[i], paths[j]) < 0
+	})
+
+	// Grouping the changed children by parent directory
+	// skipping the paths already covered by a changed ancestor
+	parents := []string{}
+	children := map[string]map[string]bool{}
+	lastKept := ""
+	for _, rPath := range paths {
+		if lastKept != "" && isChildPath(rPath, lastKept) {
+			continue
+		}
+		lastKept = rPath
+
+		parent := path.Dir(rPath)
+		if _, ok := children[parent]; !ok {
+			parents = append(parents, parent)
+			children[parent] = map[string]bool{}
+		}
+		children[parent][rPath] = true
+	}
+
+	if len(parents) == 0 {
+		return nil
+	}
+
+	// The changes are guarded as a whole
+	ctx, takeDecision := p.withFailures(ctx, p.takeDecision)
+	err := p.guardDeletions(ctx, parents[0], takeDecision, func(ctx context.Context, takeDecision DecisionCallback) error {
+		for _, parent := range parents {
+			if _, _, err := p.checkChanges(ctx, parent, false, false, children[parent], p.resolveConflicts(takeDecision)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return failuresFrom(ctx).failed(parents[0])
+}
@@ -0,0 +1,281 @@
+package fsync_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	rFS.Write("/a/b", "b")
+	require.NoError(t, rFS.Mkdir("/c"))
+	syncWithExecutor(t, lFS, rFS, nil)
+
+	decisions := make(chan fsync.Decision, 100)
+	e := fsync.NewExecutor(lFS, rFS, nil, nil)
+	p := fsync.NewProvider(lFS, rFS, func(ctx context.Context, d fsync.Decision) error {
+		if err := e.Execute(ctx, d); err != nil {
+			return err
+		}
+		decisions <- d
+		return nil
+	}, &fsync.Options{ChangeDelay: 10 * time.Millisecond})
+
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	waitDecisions := func(n int) []fsync.Decision {
+		ret := []fsync.Decision{}
+		for len(ret) < n {
+			select {
+			case d := <-decisions:
+				ret = append(ret, d)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout waiting for %d decisions, got %d", n, len(ret))
+			}
+		}
+		return ret
+	}
+
+	// Changes are notified after the file systems are updated
+	rFS.Write("/a/b", "b2")
+	rFS.Write("/a/d", "d")
+	lFS.Write("/c/e", "e")
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a/b"})
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a/d"})
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a/b"})
+	p.LocalChange(fsync.LocalItem{RelativePath: "/c/e"})
+
+	ds := waitDecisions(3)
+	for _, d := range ds {
+		switch d.RelativePath {
+		case "/a/b", "/a/d":
+			assert.Equal(t, fsync.DecisionDownloadRemote, d.Flag)
+		case "/c/e":
+			assert.Equal(t, fsync.DecisionUploadLocal, d.Flag)
+		default:
+			t.Fatalf("unexpected decision on %s", d.RelativePath)
+		}
+	}
+
+	// A change of a dir covers the changes of its children
+	require.NoError(t, rFS.Remove("/a"))
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a/b"})
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a"})
+
+	ds = waitDecisions(3)
+	assert.Equal(t, "/a", ds[2].RelativePath)
+	assert.Equal(t, fsync.DecisionDeleteLocal, ds[2].Flag)
+
+	cancel()
+	require.True(t, errors.Is(<-done, context.Canceled))
+	assert.Equal(t, 0, len(decisions))
+
+	fsynctest.AssertConverged(t, lFS, rFS, nil)
+}
+
+func TestRunRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := fsynctest.NewLocalFS()
+	r := fsynctest.NewRemoteFS()
+	require.NoError(t, r.Mkdir("/a"))
+	require.NoError(t, fsync.NewProvider(l, r, fsync.NewExecutor(l, r, nil, nil).Execute, nil).DoInitialSync(ctx))
+
+	errBroken := errors.New("broken")
+	r.InjectError(fsynctest.OpGetChildren, "/a", errBroken)
+
+	runErrors := make(chan error, 100)
+	e := fsync.NewExecutor(l, r, nil, nil)
+	p := fsync.NewProvider(l, r, e.Execute, &fsync.Options{
+		ChangeDelay: 10 * time.Millisecond,
+		RetryDelay:  10 * time.Millisecond,
+		OnRunError: func(ctx context.Context, err error) {
+			runErrors <- err
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	r.Write("/a/b", "b")
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a/b"})
+	for k := 0; k < 2; k++ {
+		select {
+		case err := <-runErrors:
+			require.ErrorIs(t, err, errBroken)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the failed check")
+		}
+	}
+
+	// The changes are consumed while the checks fail
+	for k := 0; k < 300; k++ {
+		p.LocalChange(fsync.LocalItem{RelativePath: "/a/b"})
+	}
+
+	r.ClearErrors()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, ok := l.Data("/a/b"); ok {
+			assert.Equal(t, "b", data)
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "timeout waiting for the retry")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	fsynctest.AssertConverged(t, l, r, nil)
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRunRetryFailedPaths(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := fsynctest.NewLocalFS(
+		fsync.LocalItem{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+		fsync.LocalItem{RelativePath: "/x", Dir: true, Commited: fsync.CommitedYes},
+		fsync.LocalItem{RelativePath: "/x/c", Etag: "v1", Commited: fsync.CommitedNo},
+	)
+	r := fsynctest.NewRemoteFS(
+		fsync.RemoteItem{RelativePath: "/a", Dir: true},
+		fsync.RemoteItem{RelativePath: "/x", Dir: true},
+		fsync.RemoteItem{RelativePath: "/x/c", Etag: "v2"},
+		fsync.RemoteItem{RelativePath: "/a/b", Etag: "b"},
+	)
+	errBroken := errors.New("broken")
+	r.InjectError(fsynctest.OpGetChildren, "/a", errBroken)
+
+	var mu sync.Mutex
+	conflicts := 0
+	downloaded := make(chan struct{})
+	runErrors := make(chan error, 100)
+	p := fsync.NewProvider(l, r, func(ctx context.Context, d fsync.Decision) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if d.RelativePath == "/x/c" && d.Flag == fsync.DecisionConflict {
+			conflicts++
+		}
+		if d.RelativePath == "/a/b" && d.Flag == fsync.DecisionDownloadRemote && !isClosed(downloaded) {
+			close(downloaded)
+		}
+		return nil
+	}, &fsync.Options{
+		ChangeDelay:     10 * time.Millisecond,
+		RetryDelay:      time.Millisecond,
+		ContinueOnError: true,
+		OnRunError: func(ctx context.Context, err error) {
+			runErrors <- err
+		},
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/a/b"})
+	p.RemoteChange(fsync.RemoteItem{RelativePath: "/x/c"})
+	for k := 0; k < 3; k++ {
+		select {
+		case err := <-runErrors:
+			require.ErrorIs(t, err, errBroken)
+			sErr := &fsync.SyncError{}
+			require.True(t, errors.As(err, &sErr))
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the failed check")
+		}
+	}
+
+	// The failed dir is checked again, but not the conflict checked with it
+	r.ClearErrors()
+	select {
+	case <-downloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the retry")
+	}
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, conflicts)
+}
+
+func TestRunMassDeletionGuard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := fsynctest.NewLocalFS()
+	r := fsynctest.NewRemoteFS()
+	for k := 0; k < 20; k++ {
+		r.Write(fmt.Sprintf("/f%d", k), "f")
+	}
+	opts := &fsync.Options{
+		ChangeDelay:       10 * time.Millisecond,
+		MassDeletionGuard: &fsync.MassDeletionGuard{MaxDeletionPercent: 50},
+	}
+	e := fsync.NewExecutor(l, r, nil, nil)
+	require.NoError(t, fsync.NewProvider(l, r, e.Execute, opts).DoInitialSync(ctx))
+
+	runErrors := make(chan error, 100)
+	opts.OnRunError = func(ctx context.Context, err error) {
+		runErrors <- err
+	}
+	p := fsync.NewProvider(l, r, e.Execute, opts)
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx)
+	}()
+
+	// The percentage is computed on the whole dir, not on the changed items
+	l.Delete("/f3")
+	p.LocalChange(fsync.LocalItem{RelativePath: "/f3"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := r.Data("/f3"); !ok {
+			break
+		}
+		select {
+		case err := <-runErrors:
+			t.Fatal(err)
+		default:
+		}
+		require.True(t, time.Now().Before(deadline), "timeout waiting for the deletion")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	fsynctest.AssertConverged(t, l, r, nil)
+}
@@ -0,0 +1,3 @@
+package s3fs
+
+var SignV4 = signV4
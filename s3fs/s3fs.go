@@ -0,0 +1,692 @@
+// Package s3fs implements fsync.RemoteWriteFS on top of an S3-compatible bucket.
+// Keys are split on "/": the common prefixes of a listing are the dirs
+// and the object ETags are the etags of the files. With Options.ETagIsMD5 the ETags of the single part
+// uploads are also reported as the MD5 ContentHash of the files.
+//
+// S3 has no real directories. Mkdir writes an empty marker object whose key ends with "/"
+// so that empty dirs are kept, and a dir exists as long as one key starts with its prefix.
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// FS is a remote file system usable by a provider and an executor
+	FS interface {
+		fsync.RemoteWriteFS
+		fsync.RemoteFSPager
+	}
+
+	s3FS struct {
+		endpoint *url.URL
+		bucket   string
+		prefix   string
+		client   *http.Client
+		ctx      context.Context
+
+		region          string
+		accessKeyID     string
+		secretAccessKey string
+		sessionToken    string
+
+		virtualHosted bool
+		pageSize      int
+		tempDir       string
+		etagIsMD5     bool
+		partSize      int64
+	}
+
+	Options struct {
+		// Region defaults to us-east-1
+		Region          string
+		AccessKeyID     string
+		SecretAccessKey string
+		SessionToken    string
+		// Prefix is the key prefix of the synced tree, e.g. "backups/alice"
+		Prefix string
+		// VirtualHostedStyle addresses the bucket as a sub-domain of the endpoint instead of the first path element
+		VirtualHostedStyle bool
+		// PageSize is the max-keys of the listings. Defaults to the server limit (1000 on AWS)
+		PageSize int
+		// Client defaults to http.DefaultClient
+		Client *http.Client
+		// Context is used by the requests without context. Defaults to context.Background()
+		Context context.Context
+		// TempDir is where Create spools the uploads. Defaults to os.TempDir()
+		TempDir string
+		// ETagIsMD5 reports the ETags of the single part uploads as their MD5 ContentHash.
+		// It must not be set on buckets encrypted with SSE-KMS or SSE-C, whose ETags are not MD5s
+		ETagIsMD5 bool
+		// PartSize is the size of the parts of the multipart uploads, used by Create for the files larger than it.
+		// Defaults to 64 MiB. S3 requires at least 5 MiB
+		PartSize int64
+	}
+
+	listBucketResult struct {
+		IsTruncated           bool           `xml:"IsTruncated"`
+		Contents              []object       `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+		NextContinuationToken string         `xml:"NextContinuationToken"`
+	}
+
+	object struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	}
+
+	commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+
+	s3Error struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	initiateMultipartUploadResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+
+	completeMultipartUpload struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+
+	completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+
+	uploader struct {
+		s       *s3FS
+		key     string
+		f       *os.File
+		sha     hash.Hash
+		written int64
+	}
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("s3fs: unexpected status")
+	ErrErrorResponse    = errors.New("s3fs: error in a successful response")
+	ErrRemoveRoot       = errors.New("s3fs: cannot remove or move the root directory")
+)
+
+const (
+	defaultPartSize = 64 << 20
+	// maxParts is the S3 limit of parts per upload
+	maxParts = 10000
+)
+
+// New creates the remote file system of the bucket, e.g. New("https://s3.eu-west-3.amazonaws.com", "my-bucket", opts)
+func New(endpoint, bucket string, opts *Options) (FS, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("s3fs: unsupported endpoint scheme %q", u.Scheme)
+	}
+	if bucket == "" {
+		return nil, errors.New("s3fs: missing bucket")
+	}
+
+	s := &s3FS{
+		endpoint: u,
+		bucket:   bucket,
+		client:   http.DefaultClient,
+		ctx:      context.Background(),
+		region:   "us-east-1",
+		partSize: defaultPartSize,
+	}
+
+	if opts != nil {
+		if opts.Region != "" {
+			s.region = opts.Region
+		}
+		s.accessKeyID = opts.AccessKeyID
+		s.secretAccessKey = opts.SecretAccessKey
+		s.sessionToken = opts.SessionToken
+		if p := strings.Trim(opts.Prefix, "/"); p != "" {
+			s.prefix = p + "/"
+		}
+		s.virtualHosted = opts.VirtualHostedStyle
+		s.pageSize = opts.PageSize
+		if opts.Client != nil {
+			s.client = opts.Client
+		}
+		if opts.Context != nil {
+			s.ctx = opts.Context
+		}
+		s.tempDir = opts.TempDir
+		s.etagIsMD5 = opts.ETagIsMD5
+		if opts.PartSize > 0 {
+			s.partSize = opts.PartSize
+		}
+	}
+
+	return s, nil
+}
+
+// key returns the object key of an item
+func (s *s3FS) key(itemPath string) string {
+	return s.prefix + strings.TrimPrefix(path.Clean("/"+itemPath), "/")
+}
+
+// dirPrefix returns the prefix of the keys of the sub-items of a dir
+func (s *s3FS) dirPrefix(itemPath string) string {
+	itemPath = path.Clean("/" + itemPath)
+	if itemPath == "/" {
+		return s.prefix
+	}
+	return s.key(itemPath) + "/"
+}
+
+// relativePath converts a key or a common prefix to the path of an item
+func (s *s3FS) relativePath(key string) string {
+	return path.Clean("/" + strings.TrimPrefix(key, s.prefix))
+}
+
+func (s *s3FS) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.virtualHosted {
+		u.Host = s.bucket + "." + u.Host
+	} else {
+		objectPath = "/" + s.bucket + objectPath
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = awsEscape(u.Path, false)
+
+	// Encoding the query like the canonical request
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	u.RawQuery = strings.Join(parts, "&")
+
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs and sends the request, and fails on a status missing from expected.
+// A 404 status matches fs.ErrNotExist
+func (s *s3FS) do(req *http.Request, payloadHash string, expected ...int) (*http.Response, error) {
+	if s.accessKeyID != "" {
+		signV4(req, s.accessKeyID, s.secretAccessKey, s.sessionToken, s.region, payloadHash, time.Now())
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range expected {
+		if res.StatusCode == e {
+			return res, nil
+		}
+	}
+	defer res.Body.Close()
+
+	key, _ := url.PathUnescape(req.URL.EscapedPath())
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3fs: %s %s: %w", req.Method, key, fs.ErrNotExist)
+	}
+
+	e := s3Error{}
+	xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&e)
+	return nil, fmt.Errorf("%w %q on %s %s: %s %s", ErrUnexpectedStatus, res.Status, req.Method, key, e.Code, e.Message)
+}
+
+// decodeBody reads the XML document of a successful response into v when v is not nil.
+// CopyObject and CompleteMultipartUpload report the failures found after sending the 200 status in an <Error> document
+func decodeBody(req *http.Request, res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	e := s3Error{}
+	if xml.Unmarshal(data, &e) == nil && e.XMLName.Local == "Error" {
+		key, _ := url.PathUnescape(req.URL.EscapedPath())
+		return fmt.Errorf("%w on %s %s: %s %s", ErrErrorResponse, req.Method, key, e.Code, e.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// list reads a page of ListObjectsV2
+func (s *s3FS) list(ctx context.Context, prefix, delimiter, pageToken string, maxKeys int) (listBucketResult, error) {
+	r := listBucketResult{}
+
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if pageToken != "" {
+		query.Set("continuation-token", pageToken)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+
+	req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+	if err != nil {
+		return r, err
+	}
+	res, err := s.do(req, emptyPayloadSHA, http.StatusOK)
+	if err != nil {
+		return r, err
+	}
+	defer res.Body.Close()
+
+	if err := xml.NewDecoder(res.Body).Decode(&r); err != nil {
+		return r, fmt.Errorf("s3fs: listing %s: %w", prefix, err)
+	}
+	if !r.IsTruncated {
+		r.NextContinuationToken = ""
+	}
+	return r, nil
+}
+
+// GetChildrenPage lists a page of the children: the common prefixes are the dirs
+// and the objects the files. The marker object of the dir is skipped
+func (s *s3FS) GetChildrenPage(ctx context.Context, itemPath string, pageToken string) (fsync.RemoteItems, string, error) {
+	prefix := s.dirPrefix(itemPath)
+	r, err := s.list(ctx, prefix, "/", pageToken, s.pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ret := make(fsync.RemoteItems, 0, len(r.CommonPrefixes)+len(r.Contents))
+	dirs := map[string]bool{}
+	for _, cp := range r.CommonPrefixes {
+		p := s.relativePath(cp.Prefix)
+		dirs[p] = true
+		ret = append(ret, fsync.RemoteItem{RelativePath: p, Dir: true})
+	}
+	for _, o := range r.Contents {
+		p := s.relativePath(o.Key)
+		if o.Key == prefix || dirs[p] {
+			// Marker of the listed dir, or an object shadowed by a dir of the same name
+			continue
+		}
+		ret = append(ret, s.withContentHash(fsync.RemoteItem{
+			RelativePath: p,
+			Etag:         strings.Trim(o.ETag, `"`),
+			ModTime:      o.LastModified,
+			Size:         o.Size,
+		}))
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+
+	return ret, r.NextContinuationToken, nil
+}
+
+// withContentHash reports the ETag as the MD5 of the content with ETagIsMD5.
+// The ETags of the multipart uploads end with "-<parts>" and are not MD5s
+func (s *s3FS) withContentHash(ri fsync.RemoteItem) fsync.RemoteItem {
+	if !s.etagIsMD5 || len(ri.Etag) != 2*md5.Size {
+		return ri
+	}
+	if _, err := hex.DecodeString(ri.Etag); err != nil {
+		return ri
+	}
+	ri.ContentHash = strings.ToLower(ri.Etag)
+	ri.HashAlgorithm = "md5"
+	return ri
+}
+
+func (s *s3FS) GetChildren(itemPath string) (fsync.RemoteItems, error) {
+	ret := fsync.RemoteItems{}
+	pageToken := ""
+	for {
+		ris, nextPageToken, err := s.GetChildrenPage(s.ctx, itemPath, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ris...)
+
+		if nextPageToken == "" {
+			sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+			return ret, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// keys lists the keys starting with prefix
+func (s *s3FS) keys(prefix string) ([]string, error) {
+	ret := []string{}
+	pageToken := ""
+	for {
+		r, err := s.list(s.ctx, prefix, "", pageToken, s.pageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range r.Contents {
+			ret = append(ret, o.Key)
+		}
+
+		if r.NextContinuationToken == "" {
+			return ret, nil
+		}
+		pageToken = r.NextContinuationToken
+	}
+}
+
+// Stat returns the object of the item, or a dir when a key starts with its prefix
+func (s *s3FS) Stat(itemPath string) (fsync.RemoteItem, error) {
+	itemPath = path.Clean("/" + itemPath)
+	if itemPath == "/" {
+		return fsync.RemoteItem{RelativePath: "/", Dir: true}, nil
+	}
+
+	req, err := s.newRequest(s.ctx, http.MethodHead, s.key(itemPath), nil, nil)
+	if err != nil {
+		return fsync.RemoteItem{}, err
+	}
+	res, err := s.do(req, emptyPayloadSHA, http.StatusOK)
+	if err == nil {
+		res.Body.Close()
+		ri := fsync.RemoteItem{
+			RelativePath: itemPath,
+			Etag:         strings.Trim(res.Header.Get("ETag"), `"`),
+			Size:         res.ContentLength,
+		}
+		if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+			ri.ModTime = t
+		}
+		return s.withContentHash(ri), nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fsync.RemoteItem{}, err
+	}
+
+	r, err := s.list(s.ctx, s.dirPrefix(itemPath), "/", "", 1)
+	if err != nil {
+		return fsync.RemoteItem{}, err
+	}
+	if len(r.Contents) == 0 && len(r.CommonPrefixes) == 0 {
+		return fsync.RemoteItem{}, fmt.Errorf("s3fs: stat %s: %w", itemPath, fs.ErrNotExist)
+	}
+	return fsync.RemoteItem{RelativePath: itemPath, Dir: true}, nil
+}
+
+func (s *s3FS) Open(itemPath string) (io.ReadCloser, error) {
+	req, err := s.newRequest(s.ctx, http.MethodGet, s.key(itemPath), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, emptyPayloadSHA, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Create spools the data to a temporary file which is uploaded on Close,
+// as a PUT request needs the length and the hash of the payload.
+// The files larger than Options.PartSize are sent with a multipart upload
+func (s *s3FS) Create(itemPath string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp(s.tempDir, "s3fs-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &uploader{
+		s:   s,
+		key: s.key(itemPath),
+		f:   f,
+		sha: sha256.New(),
+	}, nil
+}
+
+func (u *uploader) Write(p []byte) (int, error) {
+	n, err := u.f.Write(p)
+	u.sha.Write(p[:n])
+	u.written += int64(n)
+	return n, err
+}
+
+func (u *uploader) Close() error {
+	defer os.Remove(u.f.Name())
+	defer u.f.Close()
+
+	if u.written > u.s.partSize {
+		return u.s.putMultipart(u.key, u.f, u.written)
+	}
+
+	if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return u.s.put(u.key, io.NopCloser(u.f), u.written, hex.EncodeToString(u.sha.Sum(nil)), nil)
+}
+
+// Abort drops the spooled data without uploading it
+func (u *uploader) Abort() error {
+	defer os.Remove(u.f.Name())
+	return u.f.Close()
+}
+
+func (s *s3FS) put(key string, body io.ReadCloser, size int64, payloadHash string, header http.Header) error {
+	req, err := s.newRequest(s.ctx, http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+
+	res, err := s.do(req, payloadHash, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return decodeBody(req, res, nil)
+}
+
+// putMultipart uploads the file in parts, as a single PUT is limited to 5 GB.
+// The upload is aborted when it fails, so that the parts are not kept
+func (s *s3FS) putMultipart(key string, f *os.File, size int64) (err error) {
+	partSize := s.partSize
+	if partSize*maxParts < size {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+
+	req, err := s.newRequest(s.ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, emptyPayloadSHA, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	initiated := initiateMultipartUploadResult{}
+	if err := decodeBody(req, res, &initiated); err != nil {
+		return err
+	}
+	uploadID := initiated.UploadID
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		if aErr := s.abortMultipartUpload(key, uploadID); aErr != nil {
+			err = fmt.Errorf("%w (aborting the upload: %v)", err, aErr)
+		}
+	}()
+
+	completed := completeMultipartUpload{}
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+partSize {
+		length := size - offset
+		if length > partSize {
+			length = partSize
+		}
+		etag, err := s.uploadPart(key, uploadID, n, io.NewSectionReader(f, offset, length))
+		if err != nil {
+			return err
+		}
+		completed.Parts = append(completed.Parts, completedPart{PartNumber: n, ETag: etag})
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	req, err = s.newRequest(s.ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err = s.do(req, hex.EncodeToString(sum[:]), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return decodeBody(req, res, nil)
+}
+
+// uploadPart sends a part of a multipart upload and returns its ETag
+func (s *s3FS) uploadPart(key, uploadID string, partNumber int, part *io.SectionReader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, part); err != nil {
+		return "", err
+	}
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+	req, err := s.newRequest(s.ctx, http.MethodPut, key, query, part)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = part.Size()
+
+	res, err := s.do(req, hex.EncodeToString(h.Sum(nil)), http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+func (s *s3FS) abortMultipartUpload(key, uploadID string) error {
+	req, err := s.newRequest(s.ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, emptyPayloadSHA, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Mkdir writes the marker object of the dir
+func (s *s3FS) Mkdir(itemPath string) error {
+	if path.Clean("/"+itemPath) == "/" {
+		return nil
+	}
+	return s.put(s.dirPrefix(itemPath), http.NoBody, 0, emptyPayloadSHA, nil)
+}
+
+func (s *s3FS) deleteKey(key string) error {
+	req, err := s.newRequest(s.ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, emptyPayloadSHA, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Remove deletes the object of the item and every key starting with its prefix
+func (s *s3FS) Remove(itemPath string) error {
+	if path.Clean("/"+itemPath) == "/" {
+		return ErrRemoveRoot
+	}
+
+	keys, err := s.keys(s.dirPrefix(itemPath))
+	if err != nil {
+		return err
+	}
+	for _, k := range append(keys, s.key(itemPath)) {
+		if err := s.deleteKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move copies the object of the item and the keys starting with its prefix, then deletes them.
+// The keys are only deleted when every copy succeeded
+func (s *s3FS) Move(fromPath, toPath string) error {
+	if path.Clean("/"+fromPath) == "/" || path.Clean("/"+toPath) == "/" {
+		return ErrRemoveRoot
+	}
+
+	keys, err := s.keys(s.dirPrefix(fromPath))
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(fromPath); err == nil && len(keys) == 0 {
+		keys = append(keys, s.key(fromPath))
+	} else if err != nil {
+		return err
+	}
+
+	from, to := s.key(fromPath), s.key(toPath)
+	for _, k := range keys {
+		header := http.Header{"X-Amz-Copy-Source": {awsEscape("/"+s.bucket+"/"+k, false)}}
+		if err := s.put(to+strings.TrimPrefix(k, from), http.NoBody, 0, emptyPayloadSHA, header); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if err := s.deleteKey(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package fsync
+
+import (
+	"context"
+	"path"
+)
+
+// SetExcludedPaths replaces the remote subtrees which are not synced locally (selective sync).
+// The next checks delete the local items of the newly excluded subtrees
+// and download the items of the subtrees included again
+func (p *provider) SetExcludedPaths(excludedPaths []string) {
+	cleaned := make([]string, 0, len(excludedPaths))
+	for _, e := range excludedPaths {
+		cleaned = append(cleaned, path.Clean("/"+e))
+	}
+
+	p.excludedMu.Lock()
+	defer p.excludedMu.Unlock()
+	p.excludedPaths = cleaned
+}
+
+// isExcluded returns true when the item is located in an excluded subtree
+func (p *provider) isExcluded(relativePath string) bool {
+	p.excludedMu.RLock()
+	defer p.excludedMu.RUnlock()
+
+	for _, e := range p.excludedPaths {
+		if isChildPath(relativePath, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeSubtrees drops the items of the excluded subtrees.
+// The local ones are returned to be cleaned up
+func (p *provider) excludeSubtrees(lis LocalItems, ris RemoteItems) (LocalItems, RemoteItems, LocalItems) {
+	p.excludedMu.RLock()
+	enabled := len(p.excludedPaths) > 0
+	p.excludedMu.RUnlock()
+	if !enabled {
+		return lis, ris, nil
+	}
+
+	keptLis := make(LocalItems, 0, len(lis))
+	excluded := LocalItems{}
+	for _, li := range lis {
+		if p.isExcluded(li.RelativePath) {
+			excluded = append(excluded, li)
+		} else {
+			keptLis = append(keptLis, li)
+		}
+	}
+
+	keptRis := make(RemoteItems, 0, len(ris))
+	for _, ri := range ris {
+		if !p.isExcluded(ri.RelativePath) {
+			keptRis = append(keptRis, ri)
+		}
+	}
+
+	return keptLis, keptRis, excluded
+}
+
+// cleanupExcluded returns the deletions of the local items of excluded subtrees.
+// Items which were never uploaded and ignored items are kept, as well as their parent dirs.
+// Items awaiting their remote deletion are kept too: the deletion is synced when the subtree is included again
+func (p *provider) cleanupExcluded(ctx context.Context, lis LocalItems) (kept bool, deleteLocals []Decision, err error) {
+	for _, li := range lis {
+		d := Decision{
+			Flag:            DecisionDeleteLocal,
+			RelativePath:    li.RelativePath,
+			RemoteValidEtag: li.Etag,
+			RemoteIsDir:     li.Dir,
+			Why:             newDecisionWhy(&li, nil),
+		}
+
+		pending := li.Commited == CommitedNo || li.Commited == CommitedAwaitingRemoteDeletion
+		if !li.Dir {
+			if pending {
+				kept = true
+			} else {
+				deleteLocals = append(deleteLocals, d)
+			}
+			continue
+		}
+
+		children, listed, err := p.listLocal(ctx, li.RelativePath, nil)
+		if err != nil {
+			return false, nil, err
+		}
+		deletionTallyFrom(ctx).count(li.RelativePath, listed, 0)
+		ign, err := p.ignoreMatcherFor(ctx, li.RelativePath)
+		if err != nil {
+			return false, nil, err
+		}
+		notIgnored, _ := ign.filter(children, nil)
+		childrenKept, childrenDeletions, err := p.cleanupExcluded(ctx, notIgnored)
+		if err != nil {
+			return false, nil, err
+		}
+		childrenKept = childrenKept || len(notIgnored) < len(children)
+
+		if childrenKept || pending {
+			kept = true
+			deleteLocals = append(deleteLocals, childrenDeletions...)
+		} else if p.localFSDeleteNonEmptyFolder {
+			deleteLocals = append(deleteLocals, d)
+		} else {
+			deleteLocals = append(deleteLocals, childrenDeletions...)
+			deleteLocals = append(deleteLocals, d)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,141 @@
+package fsync_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/fsynctest"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+func TestSelectiveSync(t *testing.T) {
+	t.Run("Excluded subtrees are not downloaded", func(t *testing.T) {
+		localStatus := fsync.LocalItems{}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: true},
+			{RelativePath: "/a/b", Dir: true},
+			{RelativePath: "/a/b/c", Dir: false, Etag: "v1"},
+			{RelativePath: "/a/d", Dir: false, Etag: "v1"},
+			{RelativePath: "/e", Dir: false, Etag: "v1"},
+		}
+
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a", Flag: fsync.DecisionCreateDirLocal},
+			{RelativePath: "/a/d", Flag: fsync.DecisionDownloadRemote},
+		}
+
+		testScenarioWithOptions(t, localStatus, remoteStatus, expectedDecisions, &fsync.Options{
+			ExcludedPaths: []string{"/a/b", "/e"},
+		})
+	})
+
+	t.Run("Excluded subtrees are cleaned up locally", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+			{RelativePath: "/a/b", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+			{RelativePath: "/a/c", Dir: false, Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion},
+			{RelativePath: "/d", Dir: true, Commited: fsync.CommitedYes},
+			{RelativePath: "/d/e", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+			{RelativePath: "/d/f", Dir: false, Commited: fsync.CommitedNo},
+		}
+
+		remoteStatus := fsync.RemoteItems{
+			{RelativePath: "/a", Dir: true},
+			{RelativePath: "/a/b", Dir: false, Etag: "v1"},
+			{RelativePath: "/a/c", Dir: false, Etag: "v1"},
+			{RelativePath: "/d", Dir: true},
+			{RelativePath: "/d/e", Dir: false, Etag: "v1"},
+		}
+
+		// The local changes of /d/f and the pending remote deletion of /a/c are kept
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a/b", Flag: fsync.DecisionDeleteLocal},
+			{RelativePath: "/d/e", Flag: fsync.DecisionDeleteLocal},
+		}
+
+		testScenarioWithOptions(t, localStatus, remoteStatus, expectedDecisions, &fsync.Options{
+			ExcludedPaths: []string{"/a", "/d"},
+		})
+	})
+
+	t.Run("Ignored items of excluded subtrees are kept", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+			{RelativePath: "/a/b", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+			{RelativePath: "/a/tmp", Dir: true, Commited: fsync.CommitedYes},
+			{RelativePath: "/a/tmp/c", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		remoteStatus := fsync.RemoteItems{}
+
+		// /a is kept for /a/tmp
+		expectedDecisions := []fsync.Decision{
+			{RelativePath: "/a/b", Flag: fsync.DecisionDeleteLocal},
+		}
+
+		testScenarioWithOptions(t, localStatus, remoteStatus, expectedDecisions, &fsync.Options{
+			ExcludedPaths: []string{"/a"},
+			Ignore:        &fsync.IgnoreRules{Patterns: []string{"tmp"}},
+		})
+	})
+}
+
+func TestExecutorSelectiveSync(t *testing.T) {
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	rFS.Write("/a/b", "b")
+	rFS.Write("/c", "c")
+	syncWithExecutor(t, lFS, rFS, nil)
+
+	e := fsync.NewExecutor(lFS, rFS, nil, nil)
+	p := fsync.NewProvider(lFS, rFS, e.Execute, nil)
+
+	t.Run("Excluding a subtree", func(t *testing.T) {
+		p.SetExcludedPaths([]string{"/a"})
+		require.NoError(t, p.DoInitialSync(context.Background()))
+
+		require.Equal(t, 1, len(lFS.Items()))
+		assert.Equal(t, fsync.CommitedYes, lFS.Items()[0].Commited)
+		assert.Equal(t, "/c", lFS.Items()[0].RelativePath)
+		_, ok := rFS.Data("/a/b")
+		assert.Equal(t, true, ok)
+	})
+
+	t.Run("Including a subtree again", func(t *testing.T) {
+		p.SetExcludedPaths(nil)
+		require.NoError(t, p.DoInitialSync(context.Background()))
+
+		fsynctest.AssertConverged(t, lFS, rFS, nil)
+	})
+}
+
+func TestExecutorSelectiveSyncPendingDeletion(t *testing.T) {
+	lFS := fsynctest.NewLocalFS()
+	rFS := fsynctest.NewRemoteFS()
+	require.NoError(t, rFS.Mkdir("/a"))
+	rFS.Write("/a/b", "b")
+	rFS.Write("/a/c", "c")
+	syncWithExecutor(t, lFS, rFS, nil)
+
+	e := fsync.NewExecutor(lFS, rFS, nil, nil)
+	p := fsync.NewProvider(lFS, rFS, e.Execute, nil)
+
+	// /a/c is deleted locally before the subtree is excluded
+	lFS.Delete("/a/c")
+	p.SetExcludedPaths([]string{"/a"})
+	require.NoError(t, p.DoInitialSync(context.Background()))
+	_, ok := rFS.Data("/a/c")
+	assert.Equal(t, true, ok)
+
+	// The deletion is synced when the subtree is included again
+	p.SetExcludedPaths(nil)
+	require.NoError(t, p.DoInitialSync(context.Background()))
+	_, ok = rFS.Data("/a/c")
+	assert.Equal(t, false, ok)
+	assert.Equal(t, "b", content(lFS, "/a/b"))
+	fsynctest.AssertConverged(t, lFS, rFS, nil)
+}
@@ -0,0 +1,8 @@
+package sftpfs
+
+// SetMaxChecksumCommandLength changes the length of the checksum command lines and returns the previous one
+func SetMaxChecksumCommandLength(n int) int {
+	prev := maxChecksumCommandLength
+	maxChecksumCommandLength = n
+	return prev
+}
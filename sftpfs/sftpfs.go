@@ -0,0 +1,372 @@
+// Package sftpfs implements fsync.RemoteWriteFS on top of an SFTP server.
+// SFTP has no etags: they are synthesised from the size and the modification time of the files,
+// or computed by a checksum command (e.g. sha256sum) run over SSH when one is configured.
+// The checksums are also reported as the ContentHash of the files.
+package sftpfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// FS is a remote file system usable by a provider and an executor
+	FS interface {
+		fsync.RemoteWriteFS
+		// Close closes the SFTP session. The SSH connection is left open
+		Close() error
+	}
+
+	sftpFS struct {
+		ssh    *ssh.Client
+		client *sftp.Client
+		root   string
+
+		checksumCommand string
+		hashAlgorithm   string
+	}
+
+	Options struct {
+		// ChecksumCommand is run over SSH with the paths of the files to compute their etags.
+		// It must print "<checksum> <path>" lines like sha256sum or md5sum.
+		// Without it the etags are derived from the size and the modification time
+		ChecksumCommand string
+		// HashAlgorithm is the HashAlgorithm of the checksums reported as ContentHash.
+		// Defaults to the name of the command without the "sum" suffix (e.g. "sha256" for sha256sum)
+		HashAlgorithm string
+		// ClientOptions are passed to the SFTP client
+		ClientOptions []sftp.ClientOption
+	}
+
+	atomicFile struct {
+		*sftp.File
+		fs     *sftpFS
+		target string
+	}
+)
+
+var (
+	ErrRemoveRoot = errors.New("sftpfs: cannot remove or move the root directory")
+)
+
+const (
+	tmpSuffix = ".fsync.tmp"
+)
+
+var (
+	// maxChecksumCommandLength bounds the command lines of the checksum command,
+	// the shell receiving the whole command as a single argument
+	maxChecksumCommandLength = 64 * 1024
+)
+
+// New opens an SFTP session on the SSH connection. The synced tree is the remote directory root
+func New(conn *ssh.Client, root string, opts *Options) (FS, error) {
+	var clientOpts []sftp.ClientOption
+	if opts != nil {
+		clientOpts = opts.ClientOptions
+	}
+
+	client, err := sftp.NewClient(conn, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sftpFS{
+		ssh:    conn,
+		client: client,
+		root:   path.Clean(root),
+	}
+	if opts != nil {
+		s.checksumCommand = opts.ChecksumCommand
+		s.hashAlgorithm = strings.ToLower(opts.HashAlgorithm)
+		if fields := strings.Fields(s.checksumCommand); s.hashAlgorithm == "" && len(fields) > 0 {
+			s.hashAlgorithm = strings.TrimSuffix(path.Base(fields[0]), "sum")
+		}
+	}
+
+	// A missing root is not created: syncing with an empty remote would delete the local items
+	fi, err := client.Stat(s.root)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("sftpfs: %s is not a directory", s.root)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *sftpFS) Close() error {
+	return s.client.Close()
+}
+
+func (s *sftpFS) remotePath(itemPath string) string {
+	return path.Join(s.root, path.Clean("/"+itemPath))
+}
+
+func isTemporary(name string) bool {
+	return strings.HasSuffix(name, tmpSuffix)
+}
+
+func toRemoteItem(itemPath string, fi os.FileInfo) fsync.RemoteItem {
+	ri := fsync.RemoteItem{
+		RelativePath: itemPath,
+		Dir:          fi.IsDir(),
+		ModTime:      fi.ModTime(),
+	}
+	if !ri.Dir {
+		ri.Size = fi.Size()
+		ri.Etag = fmt.Sprintf("%x-%x", fi.Size(), fi.ModTime().Unix())
+	}
+	return ri
+}
+
+// checksums runs the checksum command on batches of files and returns their checksums by remote path
+func (s *sftpFS) checksums(remotePaths []string) (map[string]string, error) {
+	ret := map[string]string{}
+	for len(remotePaths) > 0 {
+		cmd := strings.Builder{}
+		cmd.WriteString(s.checksumCommand + " --")
+		n := 0
+		for ; n < len(remotePaths); n++ {
+			arg := " " + shellQuote(remotePaths[n])
+			if n > 0 && cmd.Len()+len(arg) > maxChecksumCommandLength {
+				break
+			}
+			cmd.WriteString(arg)
+		}
+		remotePaths = remotePaths[n:]
+
+		if err := s.runChecksums(cmd.String(), ret); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// runChecksums runs a checksum command line and adds the checksums to sums
+func (s *sftpFS) runChecksums(cmd string, sums map[string]string) error {
+	session, err := s.ssh.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stderr := bytes.Buffer{}
+	session.Stderr = &stderr
+	out, err := session.Output(cmd)
+	if err != nil {
+		return fmt.Errorf("sftpfs: running %s: %w: %s", s.checksumCommand, err, strings.TrimSpace(stderr.String()))
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// "<sum>  <path>" in text mode, "<sum> *<path>" in binary mode.
+		// The lines of the paths with special characters are escaped and start with a backslash
+		sum, p, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || strings.HasPrefix(sum, "\\") {
+			continue
+		}
+		sums[strings.TrimPrefix(strings.TrimPrefix(p, " "), "*")] = sum
+	}
+	return scanner.Err()
+}
+
+// withChecksums replaces the etags of the files by their checksums and reports them as ContentHash
+func (s *sftpFS) withChecksums(ris fsync.RemoteItems) error {
+	if s.checksumCommand == "" {
+		return nil
+	}
+
+	remotePaths := []string{}
+	for _, ri := range ris {
+		if !ri.Dir {
+			remotePaths = append(remotePaths, s.remotePath(ri.RelativePath))
+		}
+	}
+	if len(remotePaths) == 0 {
+		return nil
+	}
+
+	sums, err := s.checksums(remotePaths)
+	if err != nil {
+		return err
+	}
+	for k := range ris {
+		if sum, ok := sums[s.remotePath(ris[k].RelativePath)]; ok && !ris[k].Dir {
+			ris[k].Etag = sum
+			ris[k].ContentHash = sum
+			ris[k].HashAlgorithm = s.hashAlgorithm
+		}
+	}
+	return nil
+}
+
+func (s *sftpFS) GetChildren(itemPath string) (fsync.RemoteItems, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	fis, err := s.client.ReadDir(s.remotePath(itemPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return fsync.RemoteItems{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := make(fsync.RemoteItems, 0, len(fis))
+	for _, fi := range fis {
+		if isTemporary(fi.Name()) || (!fi.IsDir() && !fi.Mode().IsRegular()) {
+			// Skipping the uploads in progress, symlinks, sockets, devices...
+			continue
+		}
+		ret = append(ret, toRemoteItem(path.Join(itemPath, fi.Name()), fi))
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+
+	return ret, s.withChecksums(ret)
+}
+
+func (s *sftpFS) Stat(itemPath string) (fsync.RemoteItem, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	fi, err := s.client.Stat(s.remotePath(itemPath))
+	if err != nil {
+		return fsync.RemoteItem{}, err
+	}
+
+	ris := fsync.RemoteItems{toRemoteItem(itemPath, fi)}
+	return ris[0], s.withChecksums(ris)
+}
+
+func (s *sftpFS) Open(itemPath string) (io.ReadCloser, error) {
+	return s.client.Open(s.remotePath(itemPath))
+}
+
+// Create returns a writer on a temporary file which is renamed to the item path on Close
+func (s *sftpFS) Create(itemPath string) (io.WriteCloser, error) {
+	target := s.remotePath(itemPath)
+	if err := s.client.MkdirAll(path.Dir(target)); err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	tmp := path.Join(path.Dir(target), "."+path.Base(target)+"."+hex.EncodeToString(suffix)+tmpSuffix)
+
+	f, err := s.client.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &atomicFile{File: f, fs: s, target: target}, nil
+}
+
+func (f *atomicFile) Close() error {
+	tmp := f.File.Name()
+	if err := f.File.Close(); err != nil {
+		f.fs.client.Remove(tmp)
+		return err
+	}
+
+	// Replacing a dir by a file
+	if fi, err := f.fs.client.Lstat(f.target); err == nil && fi.IsDir() {
+		if err := f.fs.removeAll(f.target); err != nil {
+			f.fs.client.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := f.fs.rename(tmp, f.target); err != nil {
+		f.fs.client.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Abort removes the temporary file without replacing the target
+func (f *atomicFile) Abort() error {
+	defer f.fs.client.Remove(f.File.Name())
+	return f.File.Close()
+}
+
+// rename replaces the target atomically when the server supports posix-rename@openssh.com
+func (s *sftpFS) rename(from, to string) error {
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.client.PosixRename(from, to)
+	}
+
+	if err := s.client.Remove(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.client.Rename(from, to)
+}
+
+func (s *sftpFS) Mkdir(itemPath string) error {
+	return s.client.MkdirAll(s.remotePath(itemPath))
+}
+
+// removeAll deletes the item and its sub-items without following the symlinks
+func (s *sftpFS) removeAll(remotePath string) error {
+	fi, err := s.client.Lstat(remotePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return s.client.Remove(remotePath)
+	}
+
+	fis, err := s.client.ReadDir(remotePath)
+	if err != nil {
+		return err
+	}
+	for _, child := range fis {
+		if err := s.removeAll(path.Join(remotePath, child.Name())); err != nil {
+			return err
+		}
+	}
+	return s.client.RemoveDirectory(remotePath)
+}
+
+func (s *sftpFS) Remove(itemPath string) error {
+	if path.Clean("/"+itemPath) == "/" {
+		return ErrRemoveRoot
+	}
+	return s.removeAll(s.remotePath(itemPath))
+}
+
+func (s *sftpFS) Move(fromPath, toPath string) error {
+	if path.Clean("/"+fromPath) == "/" || path.Clean("/"+toPath) == "/" {
+		return ErrRemoveRoot
+	}
+
+	to := s.remotePath(toPath)
+	if err := s.client.MkdirAll(path.Dir(to)); err != nil {
+		return err
+	}
+	return s.rename(s.remotePath(fromPath), to)
+}
+
+// shellQuote quotes the argument for a POSIX shell
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,395 @@
+package sftpfs_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/localfs"
+	"github.com/fenritec/go-fsync/sftpfs"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"gotest.tools/assert"
+)
+
+// newServer starts an SSH server on localhost serving the sftp subsystem
+// and a sha256sum command, and returns a client connected to it
+func newServer(t *testing.T) *ssh.Client {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", c.User())
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+		Timeout:         5 * time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(channel, requests)
+	}
+}
+
+// execs counts the commands run by the test servers
+var execs int32
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	for req := range requests {
+		switch req.Type {
+		case "subsystem":
+			if len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				defer channel.Close()
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				server.Serve()
+			}()
+		case "exec":
+			atomic.AddInt32(&execs, 1)
+			req.Reply(true, nil)
+			cmd := string(req.Payload[4:])
+			go func() {
+				defer channel.Close()
+				status := sha256sum(cmd, channel, channel.Stderr())
+				exitStatus := make([]byte, 4)
+				binary.BigEndian.PutUint32(exitStatus, status)
+				channel.SendRequest("exit-status", false, exitStatus)
+			}()
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// sha256sum runs `sha256sum -- 'path'...` like coreutils
+func sha256sum(cmd string, stdout, stderr io.Writer) uint32 {
+	args := strings.SplitN(cmd, " -- ", 2)
+	if args[0] != "sha256sum" || len(args) != 2 {
+		fmt.Fprintf(stderr, "%s: command not found\n", cmd)
+		return 127
+	}
+
+	status := uint32(0)
+	for _, p := range splitQuoted(args[1]) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			fmt.Fprintf(stderr, "sha256sum: %v\n", err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%x  %s\n", sha256.Sum256(data), p)
+	}
+	return status
+}
+
+// splitQuoted splits the single-quoted arguments of a shell command
+func splitQuoted(s string) []string {
+	ret := []string{}
+	for _, arg := range strings.Split(s, "' '") {
+		arg = strings.TrimSuffix(strings.TrimPrefix(arg, "'"), "'")
+		ret = append(ret, strings.ReplaceAll(arg, `'\''`, "'"))
+	}
+	return ret
+}
+
+func write(t *testing.T, s sftpfs.FS, itemPath, data string) {
+	wc, err := s.Create(itemPath)
+	require.NoError(t, err)
+	_, err = io.WriteString(wc, data)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+}
+
+func read(t *testing.T, s sftpfs.FS, itemPath string) string {
+	rc, err := s.Open(itemPath)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestSFTPFS(t *testing.T) {
+	client := newServer(t)
+	root := filepath.Join(t.TempDir(), "remote")
+	_, err := sftpfs.New(client, root, nil)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, os.Mkdir(root, 0o755))
+	s, err := sftpfs.New(client, root, nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Mkdir("/a"))
+	require.NoError(t, s.Mkdir("/a"))
+	write(t, s, "/a/b c", "b")
+	write(t, s, "/d", "dd")
+	require.NoError(t, os.Symlink(filepath.Join(root, "d"), filepath.Join(root, "link")))
+
+	t.Run("Listing", func(t *testing.T) {
+		ris, err := s.GetChildren("/")
+		require.NoError(t, err)
+		require.Equal(t, 2, len(ris))
+		assert.Equal(t, "/a", ris[0].RelativePath)
+		assert.Equal(t, true, ris[0].Dir)
+		assert.Equal(t, "", ris[0].Etag)
+		assert.Equal(t, "/d", ris[1].RelativePath)
+		assert.Equal(t, false, ris[1].Dir)
+		assert.Equal(t, int64(2), ris[1].Size)
+		assert.Equal(t, false, ris[1].Etag == "")
+
+		ris, err = s.GetChildren("/a")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(ris))
+		assert.Equal(t, "/a/b c", ris[0].RelativePath)
+
+		ris, err = s.GetChildren("/missing")
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(ris))
+	})
+
+	t.Run("Etags change with the content", func(t *testing.T) {
+		before, err := s.Stat("/d")
+		require.NoError(t, err)
+		write(t, s, "/d", "ddd")
+		after, err := s.Stat("/d")
+		require.NoError(t, err)
+		assert.Equal(t, false, before.Etag == after.Etag)
+		assert.Equal(t, "ddd", read(t, s, "/d"))
+	})
+
+	t.Run("Create over a dir", func(t *testing.T) {
+		require.NoError(t, s.Mkdir("/f/g"))
+		write(t, s, "/f", "f")
+		ri, err := s.Stat("/f")
+		require.NoError(t, err)
+		assert.Equal(t, false, ri.Dir)
+		assert.Equal(t, "f", read(t, s, "/f"))
+	})
+
+	t.Run("Move and remove", func(t *testing.T) {
+		require.NoError(t, s.Move("/a", "/e/a"))
+		assert.Equal(t, "b", read(t, s, "/e/a/b c"))
+
+		require.NoError(t, s.Remove("/e"))
+		require.NoError(t, s.Remove("/e"))
+		_, err := s.Stat("/e")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.ErrorIs(t, s.Remove("/"), sftpfs.ErrRemoveRoot)
+
+		// The symlink is removed, not its target
+		require.NoError(t, s.Remove("/link"))
+		assert.Equal(t, "ddd", read(t, s, "/d"))
+	})
+
+	t.Run("Aborted writes are not published", func(t *testing.T) {
+		wc, err := s.Create("/d")
+		require.NoError(t, err)
+		io.WriteString(wc, "partial")
+		require.NoError(t, wc.(fsync.WriteAborter).Abort())
+		assert.Equal(t, "ddd", read(t, s, "/d"))
+	})
+
+	t.Run("No temporary file left", func(t *testing.T) {
+		entries, err := os.ReadDir(root)
+		require.NoError(t, err)
+		for _, e := range entries {
+			assert.Equal(t, false, strings.HasSuffix(e.Name(), ".fsync.tmp"), e.Name())
+		}
+	})
+}
+
+func TestSFTPFSChecksum(t *testing.T) {
+	client := newServer(t)
+	root := t.TempDir()
+	s, err := sftpfs.New(client, root, &sftpfs.Options{ChecksumCommand: "sha256sum"})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Mkdir("/a"))
+	write(t, s, "/it's b", "b")
+	write(t, s, "/c", "c")
+
+	ris, err := s.GetChildren("/")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(ris))
+	assert.Equal(t, "", ris[0].Etag)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("c"))), ris[1].Etag)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("b"))), ris[2].Etag)
+
+	// The checksums are the content hashes of the files too
+	assert.Equal(t, ris[1].Etag, ris[1].ContentHash)
+	assert.Equal(t, "sha256", ris[1].HashAlgorithm)
+	assert.Equal(t, "", ris[0].HashAlgorithm)
+
+	ri, err := s.Stat("/c")
+	require.NoError(t, err)
+	assert.Equal(t, ris[1].Etag, ri.Etag)
+	assert.Equal(t, ris[1].ContentHash, ri.ContentHash)
+
+	// The etags do not depend on the modification time
+	require.NoError(t, os.Chtimes(filepath.Join(root, "c"), time.Now(), time.Now().Add(-time.Hour)))
+	ri, err = s.Stat("/c")
+	require.NoError(t, err)
+	assert.Equal(t, ris[1].Etag, ri.Etag)
+
+	// The paths are split in several command lines
+	defer sftpfs.SetMaxChecksumCommandLength(sftpfs.SetMaxChecksumCommandLength(len(root) + 30))
+	for k := 0; k < 10; k++ {
+		write(t, s, fmt.Sprintf("/a/f%d", k), fmt.Sprintf("f%d", k))
+	}
+	before := atomic.LoadInt32(&execs)
+	ris, err = s.GetChildren("/a")
+	require.NoError(t, err)
+	require.Equal(t, 10, len(ris))
+	for k, ri := range ris {
+		assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("f%d", k)))), ri.Etag)
+	}
+	assert.Equal(t, true, atomic.LoadInt32(&execs)-before > 1)
+
+	s, err = sftpfs.New(client, root, &sftpfs.Options{ChecksumCommand: "md5sum"})
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.GetChildren("/")
+	require.Error(t, err)
+}
+
+func TestSFTPSync(t *testing.T) {
+	client := newServer(t)
+	s, err := sftpfs.New(client, t.TempDir(), nil)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Mkdir("/a"))
+	write(t, s, "/a/b", "remote b")
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "c"), []byte("local c"), 0o644))
+	l, err := localfs.New(root, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	runSync := func() int {
+		applied := 0
+		e := fsync.NewExecutor(l, s, func(ctx context.Context, r fsync.ExecutionResult) error {
+			require.NoError(t, r.Err)
+			applied++
+			return nil
+		}, nil)
+		require.NoError(t, fsync.NewProvider(l, s, e.Execute, nil).DoInitialSync(context.Background()))
+		return applied
+	}
+
+	assert.Equal(t, 3, runSync())
+	assert.Equal(t, 0, runSync())
+
+	data, err := os.ReadFile(filepath.Join(root, "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "remote b", string(data))
+	assert.Equal(t, "local c", read(t, s, "/c"))
+
+	write(t, s, "/a/b", "remote b2")
+	require.NoError(t, os.Remove(filepath.Join(root, "c")))
+	assert.Equal(t, 2, runSync())
+	assert.Equal(t, 0, runSync())
+
+	data, err = os.ReadFile(filepath.Join(root, "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "remote b2", string(data))
+	_, err = s.Stat("/c")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestSFTPSyncContentHash(t *testing.T) {
+	client := newServer(t)
+	s, err := sftpfs.New(client, t.TempDir(), &sftpfs.Options{ChecksumCommand: "sha256sum"})
+	require.NoError(t, err)
+	defer s.Close()
+	write(t, s, "/same", "same")
+	write(t, s, "/other", "remote")
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "same"), []byte("same"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "other"), []byte("local"), 0o644))
+	l, err := localfs.New(root, &localfs.Options{HashAlgorithm: "sha256"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The local copy of a remote file is not a conflict
+	flags := map[string]fsync.DecisionFlag{}
+	opts := &fsync.Options{Comparison: fsync.CompareContentHash}
+	e := fsync.NewExecutor(l, s, func(ctx context.Context, r fsync.ExecutionResult) error {
+		require.NoError(t, r.Err)
+		flags[r.Decision.RelativePath] = r.Decision.Flag
+		return nil
+	}, &fsync.ExecutorOptions{Comparison: opts.Comparison})
+	require.NoError(t, fsync.NewProvider(l, s, e.Execute, opts).DoInitialSync(context.Background()))
+
+	assert.Equal(t, fsync.DecisionDownloadRemote, flags["/same"])
+	assert.Equal(t, fsync.DecisionConflict, flags["/other"])
+}
@@ -0,0 +1,216 @@
+package fsync
+
+import (
+	"context"
+)
+
+type (
+	// childPairing pairs the children of both sides of a dir listed by pages.
+	// The children waiting for their counterpart are indexed by path
+	childPairing struct {
+		lis      LocalItems
+		ris      RemoteItems
+		localAt  map[string]int
+		remoteAt map[string]int
+
+		// The paired children and the children unpaired for good, ready to be checked
+		readyLis LocalItems
+		readyRis RemoteItems
+	}
+)
+
+func newChildPairing() *childPairing {
+	return &childPairing{
+		localAt:  map[string]int{},
+		remoteAt: map[string]int{},
+	}
+}
+
+// addLocals pairs the local items with the remote items waiting for them.
+// A path listed twice on a side is only kept once while it waits
+func (c *childPairing) addLocals(lis LocalItems) {
+	for _, li := range lis {
+		if k, ok := c.remoteAt[li.RelativePath]; ok {
+			c.readyLis = append(c.readyLis, li)
+			c.readyRis = append(c.readyRis, c.takeRemote(k))
+		} else if _, ok := c.localAt[li.RelativePath]; !ok {
+			c.localAt[li.RelativePath] = len(c.lis)
+			c.lis = append(c.lis, li)
+		}
+	}
+}
+
+// addRemotes pairs the remote items with the local items waiting for them.
+// A path listed twice on a side is only kept once while it waits
+func (c *childPairing) addRemotes(ris RemoteItems) {
+	for _, ri := range ris {
+		if k, ok := c.localAt[ri.RelativePath]; ok {
+			c.readyLis = append(c.readyLis, c.takeLocal(k))
+			c.readyRis = append(c.readyRis, ri)
+		} else if _, ok := c.remoteAt[ri.RelativePath]; !ok {
+			c.remoteAt[ri.RelativePath] = len(c.ris)
+			c.ris = append(c.ris, ri)
+		}
+	}
+}
+
+// takeLocal removes a waiting local item, replacing it with the last one
+func (c *childPairing) takeLocal(k int) LocalItem {
+	li := c.lis[k]
+	last := len(c.lis) - 1
+	c.lis[k] = c.lis[last]
+	c.localAt[c.lis[k].RelativePath] = k
+	c.lis = c.lis[:last]
+	delete(c.localAt, li.RelativePath)
+	return li
+}
+
+// takeRemote removes a waiting remote item, replacing it with the last one
+func (c *childPairing) takeRemote(k int) RemoteItem {
+	ri := c.ris[k]
+	last := len(c.ris) - 1
+	c.ris[k] = c.ris[last]
+	c.remoteAt[c.ris[k].RelativePath] = k
+	c.ris = c.ris[:last]
+	delete(c.remoteAt, ri.RelativePath)
+	return ri
+}
+
+// ready returns the children ready to be checked. The waiting items of a side
+// are unpaired for good once the other side is fully listed
+func (c *childPairing) ready(localListed, remoteListed bool) (LocalItems, RemoteItems) {
+	if remoteListed {
+		c.readyLis = append(c.readyLis, c.lis...)
+		c.lis = nil
+		c.localAt = map[string]int{}
+	}
+	if localListed {
+		c.readyRis = append(c.readyRis, c.ris...)
+		c.ris = nil
+		c.remoteAt = map[string]int{}
+	}
+
+	lis, ris := c.readyLis, c.readyRis
+	c.readyLis, c.readyRis = nil, nil
+	return lis, ris
+}
+
+// checkChangesStreamed checks the children of a dir whose listing was stopped after maxBufferedChildren children.
+// The children present on both sides are checked as soon as they are paired, and the children of a side
+// as soon as the other side is fully listed. The next page is read from the side with the fewest waiting children.
+// Only the waiting children, the deletions and the move candidates of DetectMoves are kept until the end of the listing
+func (p *provider) checkChangesStreamed(
+	ctx context.Context,
+	relativePath string,
+	tryLocalDeletion,
+	tryRemoteDeletion bool,
+	lis LocalItems,
+	ris RemoteItems,
+	cont continuation,
+	ign *ignoreMatcher,
+	takeDecision DecisionCallback) (deletedLocally, deletedRemotely bool, err error) {
+	pf := prefetcherFrom(ctx)
+	pairing := newChildPairing()
+
+	excludedKept := false
+	notDeleted := 0
+	deleteLocals, deleteRemotes := []Decision{}, []Decision{}
+	check := func(exp LocalItems, imp RemoteItems, con Conflicts, mov Moves) error {
+		if pf != nil {
+			plis, pris := append(LocalItems{}, exp...), append(RemoteItems{}, imp...)
+			for _, c := range con {
+				plis = append(plis, c.li)
+				pris = append(pris, c.ri)
+			}
+			pf.prefetch(relativePath, plis, pris)
+		}
+
+		dls, drs, err := p.checkGroups(ctx, exp, imp, con, mov, takeDecision)
+		if err != nil {
+			return err
+		}
+		// Like in checkChanges, the dir can only be deleted when every child is deleted
+		notDeleted += len(exp) - len(dls) + len(imp) + len(con) - len(drs) + len(mov)
+		deleteLocals = append(deleteLocals, dls...)
+		deleteRemotes = append(deleteRemotes, drs...)
+		return nil
+	}
+
+	// The move candidates of DetectMoves are the unpaired children
+	// and the paired children deleted locally
+	heldExp, heldImp, heldCon := LocalItems{}, RemoteItems{}, Conflicts{}
+
+	for {
+		// Selective sync: the excluded subtrees are only cleaned up locally
+		var kept bool
+		var cleanups []Decision
+		lis, ris, kept, cleanups, err = p.excludeChildren(ctx, lis, ris, ign)
+		if err != nil {
+			return false, false, skipSubtree(ctx, relativePath, err)
+		}
+		excludedKept = excludedKept || kept
+		for _, d := range cleanups {
+			if err := takeDecision(ctx, d); err != nil {
+				return false, false, err
+			}
+		}
+
+		pairing.addLocals(lis)
+		pairing.addRemotes(ris)
+		readyLis, readyRis := pairing.ready(cont.localPageToken == "", cont.remotePageToken == "")
+		exp, imp, con := groupChildren(readyLis, readyRis, ign)
+		if p.detectMoves {
+			heldExp = append(heldExp, exp...)
+			heldImp = append(heldImp, imp...)
+			exp, imp = LocalItems{}, RemoteItems{}
+
+			paired := Conflicts{}
+			for _, c := range con {
+				if c.li.Commited == CommitedAwaitingRemoteDeletion {
+					heldCon = append(heldCon, c)
+				} else {
+					paired = append(paired, c)
+				}
+			}
+			con = paired
+		}
+		if err := check(exp, imp, con, Moves{}); err != nil {
+			return false, false, err
+		}
+
+		if cont.localPageToken == "" && cont.remotePageToken == "" {
+			break
+		}
+
+		lis, ris = nil, nil
+		listed := 0
+		if cont.remotePageToken == "" || (cont.localPageToken != "" && len(pairing.lis) <= len(pairing.ris)) {
+			lis, listed, cont.localPageToken, err = p.listLocalPages(ctx, relativePath, cont.localPageToken, nil, 1)
+			cont.localListed += listed
+		} else {
+			ris, listed, cont.remotePageToken, err = p.listRemotePages(ctx, relativePath, cont.remotePageToken, nil, 1)
+			cont.remoteListed += listed
+		}
+		if err != nil {
+			return false, false, skipSubtree(ctx, relativePath, err)
+		}
+	}
+
+	if p.detectMoves {
+		if err := check(classifyMoves(heldExp, heldImp, heldCon)); err != nil {
+			return false, false, err
+		}
+	}
+
+	deletionTallyFrom(ctx).count(relativePath, cont.localListed, cont.remoteListed)
+
+	if notDeleted == 0 && !excludedKept {
+		deletedLocally = tryLocalDeletion
+		deletedRemotely = tryRemoteDeletion
+	}
+
+	if err := p.takeDeletions(ctx, deletedLocally, deletedRemotely, deleteLocals, deleteRemotes, takeDecision); err != nil {
+		return false, false, err
+	}
+	return
+}
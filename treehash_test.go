@@ -0,0 +1,75 @@
+package fsync_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+// treeHashLocalFS records the commited tree hashes
+type treeHashLocalFS struct {
+	localFS
+	treeHashes map[string]string
+}
+
+func (l *treeHashLocalFS) CommitTreeHash(itemPath string, treeHash string) error {
+	l.treeHashes[itemPath] = treeHash
+	return nil
+}
+
+func TestTreeHash(t *testing.T) {
+	remoteStatus := fsync.RemoteItems{
+		{RelativePath: "/a", Dir: true, TreeHash: "t2"},
+		{RelativePath: "/a/b", Dir: false, Etag: "v2"},
+		{RelativePath: "/c", Dir: true, TreeHash: "t1"},
+		{RelativePath: "/c/d", Dir: false, Etag: "v1"},
+	}
+
+	t.Run("Unchanged subtrees are skipped", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			// The local item would be downloaded if /a was inspected
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes, TreeHash: "t2"},
+			{RelativePath: "/a/b", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+			{RelativePath: "/c", Dir: true, Commited: fsync.CommitedYes, TreeHash: "t1"},
+			{RelativePath: "/c/d", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		testScenario(t, localStatus, remoteStatus, []fsync.Decision{})
+	})
+
+	t.Run("Changed subtrees are inspected", func(t *testing.T) {
+		localStatus := fsync.LocalItems{
+			{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes, TreeHash: "t1"},
+			{RelativePath: "/a/b", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+			{RelativePath: "/c", Dir: true, Commited: fsync.CommitedYes},
+			{RelativePath: "/c/d", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+		}
+
+		testScenario(t, localStatus, remoteStatus, []fsync.Decision{
+			{RelativePath: "/a/b", Flag: fsync.DecisionDownloadRemote},
+		})
+	})
+
+	t.Run("Tree hashes of subtrees in sync are commited", func(t *testing.T) {
+		lFS := treeHashLocalFS{
+			localFS: localFS{status: fsync.LocalItems{
+				{RelativePath: "/a", Dir: true, Commited: fsync.CommitedYes},
+				{RelativePath: "/a/b", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+				{RelativePath: "/c", Dir: true, Commited: fsync.CommitedYes},
+				{RelativePath: "/c/d", Dir: false, Etag: "v1", Commited: fsync.CommitedYes},
+			}},
+			treeHashes: map[string]string{},
+		}
+		rFS := remoteFS{status: remoteStatus}
+
+		p := fsync.NewProvider(&lFS, &rFS, func(ctx context.Context, d fsync.Decision) error {
+			return nil
+		}, nil)
+		require.NoError(t, p.DoInitialSync(context.Background()))
+
+		assert.DeepEqual(t, map[string]string{"/c": "t1"}, lFS.treeHashes)
+	})
+}
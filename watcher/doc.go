@@ -0,0 +1,6 @@
+// Package watcher observes a local directory with inotify and notifies
+// a provider of the changed items through LocalChange.
+//
+// Subtrees that cannot be watched because the inotify watch limit is reached
+// are scanned periodically instead.
+package watcher
@@ -0,0 +1,408 @@
+//go:build linux
+
+package watcher
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	Watcher interface {
+		// Run reads the inotify events until the context is done
+		Run(ctx context.Context) error
+		// Unwatched returns the subtrees scanned periodically
+		Unwatched() []string
+		Close() error
+	}
+
+	// Notifier is implemented by fsync.Provider
+	Notifier interface {
+		LocalChange(item fsync.LocalItem)
+	}
+
+	// LocalFS is implemented by localfs.FS
+	LocalFS interface {
+		Stat(itemPath string) (fsync.LocalItem, error)
+		IsIgnored(itemPath string) bool
+		InvalidateTreeHash(itemPath string)
+	}
+
+	watcher struct {
+		root     string
+		local    LocalFS
+		notifier Notifier
+
+		fd    int
+		file  *os.File
+		wds   map[int]string
+		paths map[string]int
+
+		maxWatches   int
+		scanInterval time.Duration
+		// unwatched contains the snapshots of the subtrees that could not be watched.
+		// It is written by Run and read by Unwatched
+		unwatchedMu sync.Mutex
+		unwatched   map[string]snapshot
+	}
+
+	Options struct {
+		// ScanInterval is the period of the scans of the unwatched subtrees. Defaults to 30s
+		ScanInterval time.Duration
+		// MaxWatches limits the number of watches below the system limit when > 0
+		MaxWatches int
+	}
+
+	fileState struct {
+		dir     bool
+		size    int64
+		modTime int64
+	}
+
+	snapshot map[string]fileState
+)
+
+const (
+	DefaultScanInterval = 30 * time.Second
+
+	watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+		syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW
+)
+
+var (
+	errWatchLimit = errors.New("watcher: watch limit reached")
+)
+
+// New watches root recursively. The items are resolved with l and sent to n
+func New(root string, l LocalFS, n Notifier, opts *Options) (Watcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &watcher{
+		root:     root,
+		local:    l,
+		notifier: n,
+
+		fd: fd,
+		// Using the runtime poller so that Close unblocks Read
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		wds:   map[int]string{},
+		paths: map[string]int{},
+
+		scanInterval: DefaultScanInterval,
+		unwatched:    map[string]snapshot{},
+	}
+
+	if opts != nil {
+		w.maxWatches = opts.MaxWatches
+		if opts.ScanInterval > 0 {
+			w.scanInterval = opts.ScanInterval
+		}
+	}
+
+	if err := w.watchTree("/"); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *watcher) Close() error {
+	return w.file.Close()
+}
+
+func (w *watcher) Unwatched() []string {
+	w.unwatchedMu.Lock()
+	defer w.unwatchedMu.Unlock()
+
+	ret := []string{}
+	for p := range w.unwatched {
+		ret = append(ret, p)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (w *watcher) osPath(itemPath string) string {
+	return filepath.Join(w.root, filepath.FromSlash(itemPath))
+}
+
+// watchTree adds a watch on every dir of the subtree.
+// When the watch limit is reached the remaining subtrees are scanned periodically instead
+func (w *watcher) watchTree(itemPath string) error {
+	return filepath.WalkDir(w.osPath(itemPath), func(osPath string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !de.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(w.root, osPath)
+		if err != nil {
+			return err
+		}
+		childPath := path.Clean("/" + filepath.ToSlash(rel))
+		if w.local.IsIgnored(childPath) {
+			return filepath.SkipDir
+		}
+
+		err = w.addWatch(childPath)
+		if errors.Is(err, errWatchLimit) || errors.Is(err, syscall.ENOSPC) {
+			if _, ok := w.getUnwatched(childPath); !ok {
+				w.setUnwatched(childPath, w.snapshot(childPath))
+			}
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+
+		w.unwatchedMu.Lock()
+		delete(w.unwatched, childPath)
+		w.unwatchedMu.Unlock()
+		return nil
+	})
+}
+
+func (w *watcher) getUnwatched(itemPath string) (snapshot, bool) {
+	w.unwatchedMu.Lock()
+	defer w.unwatchedMu.Unlock()
+
+	s, ok := w.unwatched[itemPath]
+	return s, ok
+}
+
+func (w *watcher) setUnwatched(itemPath string, s snapshot) {
+	w.unwatchedMu.Lock()
+	defer w.unwatchedMu.Unlock()
+
+	w.unwatched[itemPath] = s
+}
+
+func (w *watcher) addWatch(itemPath string) error {
+	if _, ok := w.paths[itemPath]; !ok && w.maxWatches > 0 && len(w.wds) >= w.maxWatches {
+		return errWatchLimit
+	}
+
+	wd, err := syscall.InotifyAddWatch(w.fd, w.osPath(itemPath), watchMask)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+			return nil
+		}
+		return err
+	}
+
+	w.wds[wd] = itemPath
+	w.paths[itemPath] = wd
+	return nil
+}
+
+func (w *watcher) unwatchTree(itemPath string) {
+	for p, wd := range w.paths {
+		if p == itemPath || strings.HasPrefix(p, itemPath+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, p)
+			delete(w.wds, wd)
+		}
+	}
+}
+
+func (w *watcher) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	events := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			buf := make([]byte, 64*1024)
+			n, err := w.file.Read(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case events <- buf[:n]:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(w.scanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.file.Close()
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case buf := <-events:
+			if err := w.handleEvents(buf); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := w.scan(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (w *watcher) handleEvents(buf []byte) error {
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+		offset = nameStart + int(raw.Len)
+
+		if err := w.handleEvent(int(raw.Wd), raw.Mask, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *watcher) handleEvent(wd int, mask uint32, name string) error {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		// Events were lost
+		w.notify("/", true)
+		return nil
+	}
+
+	if mask&syscall.IN_IGNORED != 0 {
+		if p, ok := w.wds[wd]; ok {
+			delete(w.paths, p)
+			delete(w.wds, wd)
+		}
+		return nil
+	}
+
+	parent, ok := w.wds[wd]
+	if !ok {
+		return nil
+	}
+
+	itemPath := parent
+	if name != "" {
+		itemPath = path.Join(parent, name)
+	}
+	if w.local.IsIgnored(itemPath) {
+		return nil
+	}
+
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case mask&syscall.IN_DELETE_SELF != 0:
+		// Reported with the IN_DELETE event of the parent
+		return nil
+	case isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		// Items created before the watch is added are checked with the dir
+		if err := w.watchTree(itemPath); err != nil {
+			return err
+		}
+	case isDir && mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		w.unwatchTree(itemPath)
+	}
+
+	w.notify(itemPath, isDir)
+	return nil
+}
+
+// notify invalidates the tree hashes of the item and sends its status to the notifier.
+// Missing items are sent as awaiting remote deletion
+func (w *watcher) notify(itemPath string, isDir bool) {
+	w.local.InvalidateTreeHash(itemPath)
+	li, err := w.local.Stat(itemPath)
+	if err != nil {
+		li = fsync.LocalItem{
+			RelativePath: itemPath,
+			Dir:          isDir,
+			Commited:     fsync.CommitedAwaitingRemoteDeletion,
+		}
+	}
+	w.notifier.LocalChange(li)
+}
+
+func (w *watcher) snapshot(itemPath string) snapshot {
+	s := snapshot{}
+	filepath.WalkDir(w.osPath(itemPath), func(osPath string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(w.root, osPath)
+		if err != nil {
+			return nil
+		}
+		childPath := path.Clean("/" + filepath.ToSlash(rel))
+		if w.local.IsIgnored(childPath) {
+			if de.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil {
+			return nil
+		}
+		s[childPath] = fileState{dir: fi.IsDir(), size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+		return nil
+	})
+	return s
+}
+
+// scan notifies the changes of the unwatched subtrees since the previous scan
+// and tries to watch them again
+func (w *watcher) scan() error {
+	for _, itemPath := range w.Unwatched() {
+		previous, ok := w.getUnwatched(itemPath)
+		if !ok {
+			// Watched by a previous iteration
+			continue
+		}
+		current := w.snapshot(itemPath)
+		for p, cs := range current {
+			ps, ok := previous[p]
+			if !ok || (!cs.dir && ps != cs) || ps.dir != cs.dir {
+				w.notify(p, cs.dir)
+			}
+		}
+		for p, ps := range previous {
+			if _, ok := current[p]; !ok {
+				w.notify(p, ps.dir)
+			}
+		}
+		w.setUnwatched(itemPath, current)
+
+		if err := w.watchTree(itemPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
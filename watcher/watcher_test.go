@@ -0,0 +1,149 @@
+//go:build linux
+
+package watcher_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/localfs"
+	"github.com/fenritec/go-fsync/watcher"
+	"github.com/stretchr/testify/require"
+	"gotest.tools/assert"
+)
+
+type notifier chan fsync.LocalItem
+
+func (n notifier) LocalChange(item fsync.LocalItem) {
+	n <- item
+}
+
+// waitItem waits for a notification of itemPath with the commited flag ignoring the others
+func (n notifier) waitItem(t *testing.T, itemPath string, commited fsync.CommitedFlag) fsync.LocalItem {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case li := <-n:
+			if li.RelativePath == itemPath && li.Commited == commited {
+				li.FileID = ""
+				li.ModTime = time.Time{}
+				li.Size = 0
+				return li
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", itemPath)
+		}
+	}
+}
+
+func startWatcher(t *testing.T, opts *watcher.Options) (string, localfs.FS, watcher.Watcher, notifier) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0o755))
+
+	l, err := localfs.New(root, &localfs.Options{CacheTreeHash: true})
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	n := make(notifier, 100)
+	w, err := watcher.New(root, l, n, opts)
+	require.NoError(t, err)
+
+	return root, l, w, n
+}
+
+func runWatcher(t *testing.T, w watcher.Watcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- w.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	root, l, w, n := startWatcher(t, nil)
+	assert.Equal(t, 0, len(w.Unwatched()))
+	runWatcher(t, w)
+
+	t.Run("File creation", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(root, "a", "b", "c"), []byte("c"), 0o644))
+		li := n.waitItem(t, "/a/b/c", fsync.CommitedNo)
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a/b/c", Commited: fsync.CommitedNo}, li)
+	})
+
+	t.Run("File deletion", func(t *testing.T) {
+		require.NoError(t, l.Commit("/a/b/c", "v1"))
+		require.NoError(t, os.Remove(filepath.Join(root, "a", "b", "c")))
+		li := n.waitItem(t, "/a/b/c", fsync.CommitedAwaitingRemoteDeletion)
+		assert.DeepEqual(t, fsync.LocalItem{RelativePath: "/a/b/c", Etag: "v1", Commited: fsync.CommitedAwaitingRemoteDeletion}, li)
+	})
+
+	t.Run("New dirs are watched", func(t *testing.T) {
+		require.NoError(t, os.Mkdir(filepath.Join(root, "d"), 0o755))
+		li := n.waitItem(t, "/d", fsync.CommitedNo)
+		assert.Equal(t, true, li.Dir)
+
+		require.NoError(t, os.WriteFile(filepath.Join(root, "d", "e"), []byte("e"), 0o644))
+		n.waitItem(t, "/d/e", fsync.CommitedNo)
+	})
+
+	t.Run("Move", func(t *testing.T) {
+		require.NoError(t, os.Rename(filepath.Join(root, "d"), filepath.Join(root, "f")))
+		n.waitItem(t, "/d", fsync.CommitedAwaitingRemoteDeletion)
+		n.waitItem(t, "/f", fsync.CommitedNo)
+
+		require.NoError(t, os.WriteFile(filepath.Join(root, "f", "g"), []byte("g"), 0o644))
+		n.waitItem(t, "/f/g", fsync.CommitedNo)
+	})
+
+	t.Run("Journal and temporary files are ignored", func(t *testing.T) {
+		w, err := l.Create("/h")
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		n.waitItem(t, "/h", fsync.CommitedNo)
+		require.NoError(t, l.Commit("/h", "v1"))
+
+		time.Sleep(50 * time.Millisecond)
+		for len(n) > 0 {
+			li := <-n
+			assert.Equal(t, false, l.IsIgnored(li.RelativePath), li.RelativePath)
+		}
+	})
+}
+
+func TestWatcherLimit(t *testing.T) {
+	root, _, w, n := startWatcher(t, &watcher.Options{
+		MaxWatches:   2,
+		ScanInterval: 20 * time.Millisecond,
+	})
+	assert.DeepEqual(t, []string{"/a/b"}, w.Unwatched())
+	runWatcher(t, w)
+
+	// Unwatched is safe during the scans
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				w.Unwatched()
+			}
+		}
+	}()
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a", "b", "c"), []byte("c"), 0o644))
+	li := n.waitItem(t, "/a/b/c", fsync.CommitedNo)
+	assert.Equal(t, fsync.CommitedNo, li.Commited)
+
+	require.NoError(t, os.Remove(filepath.Join(root, "a", "b", "c")))
+	n.waitItem(t, "/a/b/c", fsync.CommitedAwaitingRemoteDeletion)
+}
@@ -0,0 +1,455 @@
+// Package webdavfs implements fsync.RemoteWriteFS on top of a WebDAV server (e.g. Nextcloud).
+// The items are listed with PROPFIND and their etags are the getetag properties.
+// The checksums of ownCloud and Nextcloud can be used as the content hashes of the files
+package webdavfs
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fenritec/go-fsync"
+)
+
+type (
+	// FS is a remote file system usable by a provider and an executor
+	FS interface {
+		fsync.RemoteWriteFS
+	}
+
+	webdavFS struct {
+		base    *url.URL
+		client  *http.Client
+		ctx     context.Context
+		header  http.Header
+		dirEtag bool
+		// hashAlgorithm enables the checksums property when not empty
+		hashAlgorithm string
+
+		username string
+		password string
+	}
+
+	Options struct {
+		// Client defaults to http.DefaultClient
+		Client *http.Client
+		// Context is used by every request. Defaults to context.Background()
+		Context context.Context
+		// Username and Password enable the basic authentication
+		Username string
+		Password string
+		// Header is added to every request
+		Header http.Header
+		// DirEtagIsTreeHash uses the etag of the collections as their fsync.RemoteItem.TreeHash.
+		// Only enable it when the server changes the etag of a collection
+		// whenever an item of its subtree changes (e.g. Nextcloud)
+		DirEtagIsTreeHash bool
+		// HashAlgorithm is the checksum of the oc:checksums property (ownCloud, Nextcloud)
+		// used as the fsync.RemoteItem.ContentHash of the files, e.g. "sha1" or "md5".
+		// The property is not requested when empty
+		HashAlgorithm string
+	}
+
+	multistatus struct {
+		Responses []response `xml:"DAV: response"`
+	}
+
+	response struct {
+		Href      string     `xml:"DAV: href"`
+		Propstats []propstat `xml:"DAV: propstat"`
+	}
+
+	propstat struct {
+		Status string `xml:"DAV: status"`
+		Prop   prop   `xml:"DAV: prop"`
+	}
+
+	prop struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		Etag          string `xml:"DAV: getetag"`
+		ContentLength string `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+		// Checksums is a list of "ALGORITHM:hex" separated by spaces
+		Checksums string `xml:"http://owncloud.org/ns checksums>checksum"`
+	}
+
+	uploader struct {
+		pw   *io.PipeWriter
+		done chan error
+	}
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("webdavfs: unexpected status")
+	ErrRemoveRoot       = errors.New("webdavfs: cannot remove or move the root collection")
+	ErrInvalidResponse  = errors.New("webdavfs: invalid multistatus response")
+	errAborted          = errors.New("webdavfs: upload aborted")
+)
+
+const (
+	propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getetag/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+  </d:prop>
+</d:propfind>`
+
+	propfindChecksumsBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <d:resourcetype/>
+    <d:getetag/>
+    <d:getcontentlength/>
+    <d:getlastmodified/>
+    <oc:checksums/>
+  </d:prop>
+</d:propfind>`
+)
+
+// New creates the remote file system of the collection at endpoint
+func New(endpoint string, opts *Options) (FS, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("webdavfs: unsupported endpoint scheme %q", base.Scheme)
+	}
+	base.Path = path.Clean("/" + base.Path)
+	base.RawPath = ""
+
+	w := &webdavFS{
+		base:   base,
+		client: http.DefaultClient,
+		ctx:    context.Background(),
+	}
+
+	if opts != nil {
+		if opts.Client != nil {
+			w.client = opts.Client
+		}
+		if opts.Context != nil {
+			w.ctx = opts.Context
+		}
+		w.username = opts.Username
+		w.password = opts.Password
+		w.header = opts.Header
+		w.dirEtag = opts.DirEtagIsTreeHash
+		w.hashAlgorithm = strings.ToLower(opts.HashAlgorithm)
+	}
+
+	return w, nil
+}
+
+func (w *webdavFS) itemURL(itemPath string) string {
+	u := *w.base
+	u.Path = path.Join(w.base.Path, path.Clean("/"+itemPath))
+	return u.String()
+}
+
+// relativePath converts the href of a response to the path of an item
+func (w *webdavFS) relativePath(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+
+	p := path.Clean("/" + u.Path)
+	if p == w.base.Path {
+		return "/", true
+	}
+	prefix := strings.TrimSuffix(w.base.Path, "/") + "/"
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+	return "/" + strings.TrimPrefix(p, prefix), true
+}
+
+func (w *webdavFS) newRequest(method, itemPath string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(w.ctx, method, w.itemURL(itemPath), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range w.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if w.username != "" || w.password != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	return req, nil
+}
+
+// do sends the request and fails on a status missing from expected.
+// A 404 status matches fs.ErrNotExist
+func (w *webdavFS) do(req *http.Request, expected ...int) (*http.Response, error) {
+	res, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range expected {
+		if res.StatusCode == s {
+			return res, nil
+		}
+	}
+
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	itemPath, _ := w.relativePath(req.URL.String())
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("webdavfs: %s %s: %w", req.Method, itemPath, fs.ErrNotExist)
+	}
+	return nil, fmt.Errorf("%w %q on %s %s", ErrUnexpectedStatus, res.Status, req.Method, itemPath)
+}
+
+func (w *webdavFS) propfind(itemPath string, depth string) ([]fsync.RemoteItem, error) {
+	body := propfindBody
+	if w.hashAlgorithm != "" {
+		body = propfindChecksumsBody
+	}
+	req, err := w.newRequest("PROPFIND", itemPath, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	res, err := w.do(req, http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	ms := multistatus{}
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdavfs: PROPFIND %s: %w", itemPath, err)
+	}
+
+	// An href outside of the endpoint means that the paths are rewritten (e.g. by a proxy):
+	// dropping it would make the items look deleted
+	ret := make([]fsync.RemoteItem, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		p, ok := w.relativePath(r.Href)
+		if !ok {
+			return nil, fmt.Errorf("%w: PROPFIND %s: href %q outside of the endpoint", ErrInvalidResponse, itemPath, r.Href)
+		}
+		ri := fsync.RemoteItem{RelativePath: p}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			w.setProps(&ri, ps.Prop)
+		}
+		ret = append(ret, ri)
+	}
+	return ret, nil
+}
+
+func (w *webdavFS) setProps(ri *fsync.RemoteItem, pr prop) {
+	if pr.ResourceType.Collection != nil {
+		ri.Dir = true
+	}
+	if etag := strings.Trim(strings.TrimPrefix(pr.Etag, "W/"), `"`); etag != "" {
+		if ri.Dir {
+			if w.dirEtag {
+				ri.TreeHash = etag
+			}
+		} else {
+			ri.Etag = etag
+		}
+	}
+	if size, err := strconv.ParseInt(pr.ContentLength, 10, 64); err == nil && !ri.Dir {
+		ri.Size = size
+	}
+	if t, err := http.ParseTime(pr.LastModified); err == nil {
+		ri.ModTime = t
+	}
+	if w.hashAlgorithm != "" && !ri.Dir {
+		for _, c := range strings.Fields(pr.Checksums) {
+			alg, sum, ok := strings.Cut(c, ":")
+			if ok && strings.EqualFold(alg, w.hashAlgorithm) && sum != "" {
+				ri.ContentHash = strings.ToLower(sum)
+				ri.HashAlgorithm = w.hashAlgorithm
+			}
+		}
+	}
+}
+
+func (w *webdavFS) GetChildren(itemPath string) (fsync.RemoteItems, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	// A dir deleted since its parent was listed has no children, but the root must exist
+	ris, err := w.propfind(itemPath, "1")
+	if errors.Is(err, fs.ErrNotExist) && itemPath != "/" {
+		return fsync.RemoteItems{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	found := false
+	ret := make(fsync.RemoteItems, 0, len(ris))
+	for _, ri := range ris {
+		if ri.RelativePath == itemPath {
+			found = true
+		}
+		if ri.RelativePath == itemPath || path.Dir(ri.RelativePath) != itemPath {
+			continue
+		}
+		ret = append(ret, ri)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: PROPFIND %s: the collection is missing", ErrInvalidResponse, itemPath)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].RelativePath < ret[j].RelativePath })
+
+	return ret, nil
+}
+
+func (w *webdavFS) Stat(itemPath string) (fsync.RemoteItem, error) {
+	itemPath = path.Clean("/" + itemPath)
+
+	ris, err := w.propfind(itemPath, "0")
+	if err != nil {
+		return fsync.RemoteItem{}, err
+	}
+	for _, ri := range ris {
+		if ri.RelativePath == itemPath {
+			return ri, nil
+		}
+	}
+	return fsync.RemoteItem{}, fmt.Errorf("webdavfs: PROPFIND %s: %w", itemPath, fs.ErrNotExist)
+}
+
+func (w *webdavFS) Open(itemPath string) (io.ReadCloser, error) {
+	req, err := w.newRequest(http.MethodGet, itemPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := w.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Create streams the written data with a PUT request which completes on Close
+func (w *webdavFS) Create(itemPath string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	req, err := w.newRequest(http.MethodPut, itemPath, pr)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &uploader{pw: pw, done: make(chan error, 1)}
+	go func() {
+		res, err := w.do(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err == nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+		// Unblocking the writer when the request fails early
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+
+	return u, nil
+}
+
+func (u *uploader) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+func (u *uploader) Close() error {
+	u.pw.Close()
+	return <-u.done
+}
+
+// Abort fails the body of the PUT request so that the server drops the partial upload
+func (u *uploader) Abort() error {
+	u.pw.CloseWithError(errAborted)
+	<-u.done
+	return nil
+}
+
+// Mkdir creates the collection. An existing collection is not an error
+func (w *webdavFS) Mkdir(itemPath string) error {
+	req, err := w.newRequest("MKCOL", itemPath, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := w.do(req, http.StatusCreated, http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusMethodNotAllowed {
+		// 405 is returned when the item exists
+		ri, err := w.Stat(itemPath)
+		if err != nil {
+			return err
+		}
+		if !ri.Dir {
+			return fmt.Errorf("webdavfs: MKCOL %s: %w", itemPath, fs.ErrExist)
+		}
+	}
+	return nil
+}
+
+func (w *webdavFS) Remove(itemPath string) error {
+	if path.Clean("/"+itemPath) == "/" {
+		return ErrRemoveRoot
+	}
+
+	req, err := w.newRequest(http.MethodDelete, itemPath, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := w.do(req, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (w *webdavFS) Move(fromPath, toPath string) error {
+	if path.Clean("/"+fromPath) == "/" || path.Clean("/"+toPath) == "/" {
+		return ErrRemoveRoot
+	}
+
+	req, err := w.newRequest("MOVE", fromPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", w.itemURL(toPath))
+	req.Header.Set("Overwrite", "T")
+
+	res, err := w.do(req, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,307 @@
+package webdavfs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fenritec/go-fsync"
+	"github.com/fenritec/go-fsync/localfs"
+	"github.com/fenritec/go-fsync/webdavfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+	"gotest.tools/assert"
+)
+
+// completeUploads only passes the PUT requests with a complete body to the handler,
+// like the servers which store the uploads in a temporary file
+func completeUploads(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			data, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.Body = io.NopCloser(bytes.NewReader(data))
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+func newServer(t *testing.T) (*httptest.Server, webdavfs.FS) {
+	srv := httptest.NewServer(completeUploads(&webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}))
+	t.Cleanup(srv.Close)
+
+	w, err := webdavfs.New(srv.URL+"/dav/", nil)
+	require.NoError(t, err)
+	return srv, w
+}
+
+func write(t *testing.T, w webdavfs.FS, itemPath, data string) {
+	wc, err := w.Create(itemPath)
+	require.NoError(t, err)
+	_, err = io.WriteString(wc, data)
+	require.NoError(t, err)
+	require.NoError(t, wc.Close())
+}
+
+func read(t *testing.T, w webdavfs.FS, itemPath string) string {
+	rc, err := w.Open(itemPath)
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestWebDAVFS(t *testing.T) {
+	_, w := newServer(t)
+
+	require.NoError(t, w.Mkdir("/a"))
+	require.NoError(t, w.Mkdir("/a"))
+	write(t, w, "/a/b c", "b")
+	write(t, w, "/d", "dd")
+
+	t.Run("Listing", func(t *testing.T) {
+		ris, err := w.GetChildren("/")
+		require.NoError(t, err)
+		require.Equal(t, 2, len(ris))
+		assert.Equal(t, "/a", ris[0].RelativePath)
+		assert.Equal(t, true, ris[0].Dir)
+		assert.Equal(t, "", ris[0].Etag)
+		assert.Equal(t, "/d", ris[1].RelativePath)
+		assert.Equal(t, false, ris[1].Dir)
+		assert.Equal(t, int64(2), ris[1].Size)
+		assert.Equal(t, false, ris[1].Etag == "")
+
+		ris, err = w.GetChildren("/a")
+		require.NoError(t, err)
+		require.Equal(t, 1, len(ris))
+		assert.Equal(t, "/a/b c", ris[0].RelativePath)
+
+		ris, err = w.GetChildren("/missing")
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(ris))
+	})
+
+	t.Run("Etags change with the content", func(t *testing.T) {
+		before, err := w.Stat("/d")
+		require.NoError(t, err)
+		write(t, w, "/d", "ddd")
+		after, err := w.Stat("/d")
+		require.NoError(t, err)
+		assert.Equal(t, false, before.Etag == after.Etag)
+		assert.Equal(t, "ddd", read(t, w, "/d"))
+	})
+
+	t.Run("Move and remove", func(t *testing.T) {
+		require.NoError(t, w.Move("/a", "/e"))
+		assert.Equal(t, "b", read(t, w, "/e/b c"))
+
+		require.NoError(t, w.Remove("/e"))
+		require.NoError(t, w.Remove("/e"))
+		_, err := w.Stat("/e")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+		require.ErrorIs(t, w.Remove("/"), webdavfs.ErrRemoveRoot)
+	})
+
+	t.Run("Mkdir over a file", func(t *testing.T) {
+		require.ErrorIs(t, w.Mkdir("/d"), fs.ErrExist)
+	})
+
+	t.Run("Aborted writes are not published", func(t *testing.T) {
+		wc, err := w.Create("/d")
+		require.NoError(t, err)
+		io.WriteString(wc, "partial")
+		require.NoError(t, wc.(fsync.WriteAborter).Abort())
+		assert.Equal(t, "ddd", read(t, w, "/d"))
+	})
+
+	t.Run("Write in a missing collection", func(t *testing.T) {
+		wc, err := w.Create("/missing/f")
+		require.NoError(t, err)
+		io.WriteString(wc, "f")
+		require.Error(t, wc.Close())
+	})
+}
+
+func TestWebDAVFSAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		rw.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(rw, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/remote.php/dav/files/user/</d:href>
+    <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype><d:getetag>"root"</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/remote.php/dav/files/user/Photos/</d:href>
+    <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype><d:getetag>"5f1a"</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+    <d:propstat><d:prop><d:getcontentlength/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/remote.php/dav/files/user/Notes%20%231.md</d:href>
+    <d:propstat><d:prop><d:resourcetype/><d:getetag>W/"7c2b"</d:getetag><d:getcontentlength>12</d:getcontentlength><d:getlastmodified>Tue, 06 Oct 2026 10:00:00 GMT</d:getlastmodified></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer srv.Close()
+
+	w, err := webdavfs.New(srv.URL+"/remote.php/dav/files/user", &webdavfs.Options{Username: "user", Password: "bad"})
+	require.NoError(t, err)
+	_, err = w.GetChildren("/")
+	require.ErrorIs(t, err, webdavfs.ErrUnexpectedStatus)
+
+	w, err = webdavfs.New(srv.URL+"/remote.php/dav/files/user", &webdavfs.Options{Username: "user", Password: "secret", DirEtagIsTreeHash: true})
+	require.NoError(t, err)
+	ris, err := w.GetChildren("/")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(ris))
+	assert.DeepEqual(t, fsync.RemoteItem{RelativePath: "/Notes #1.md", Etag: "7c2b", Size: 12, ModTime: ris[0].ModTime}, ris[0])
+	assert.Equal(t, 2026, ris[0].ModTime.Year())
+	assert.DeepEqual(t, fsync.RemoteItem{RelativePath: "/Photos", Dir: true, TreeHash: "5f1a"}, ris[1])
+}
+
+func TestWebDAVFSChecksums(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requested = bytes.Contains(body, []byte("checksums"))
+		rw.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(rw, `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:response>
+    <d:href>/dav/</d:href>
+    <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/dav/a.txt</d:href>
+    <d:propstat><d:prop><d:resourcetype/><d:getetag>"e1"</d:getetag><oc:checksums><oc:checksum>SHA1:A94A8FE5CCB19BA61C4C0873D391E987982FBBD3 MD5:098f6bcd4621d373cade4e832627b4f6</oc:checksum></oc:checksums></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+  </d:response>
+  <d:response>
+    <d:href>/dav/b.txt</d:href>
+    <d:propstat><d:prop><d:resourcetype/></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+    <d:propstat><d:prop><d:getetag/><oc:checksums/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>
+  </d:response>
+</d:multistatus>`)
+	}))
+	defer srv.Close()
+
+	w, err := webdavfs.New(srv.URL+"/dav", nil)
+	require.NoError(t, err)
+	ris, err := w.GetChildren("/")
+	require.NoError(t, err)
+	assert.Assert(t, !requested)
+	assert.DeepEqual(t, fsync.RemoteItem{RelativePath: "/a.txt", Etag: "e1"}, ris[0])
+
+	w, err = webdavfs.New(srv.URL+"/dav", &webdavfs.Options{HashAlgorithm: "SHA1"})
+	require.NoError(t, err)
+	ris, err = w.GetChildren("/")
+	require.NoError(t, err)
+	assert.Assert(t, requested)
+	require.Equal(t, 2, len(ris))
+	assert.DeepEqual(t, fsync.RemoteItem{RelativePath: "/a.txt", Etag: "e1", ContentHash: "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", HashAlgorithm: "sha1"}, ris[0])
+	assert.DeepEqual(t, fsync.RemoteItem{RelativePath: "/b.txt"}, ris[1])
+
+	// Stat reads the checksums too
+	ri, err := w.Stat("/a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "sha1", ri.HashAlgorithm)
+}
+
+func TestWebDAVFSInvalidListings(t *testing.T) {
+	body := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(rw, body)
+	}))
+	defer srv.Close()
+
+	w, err := webdavfs.New(srv.URL+"/dav", nil)
+	require.NoError(t, err)
+
+	t.Run("Missing root", func(t *testing.T) {
+		_, err := w.GetChildren("/")
+		require.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("Missing collection", func(t *testing.T) {
+		body = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:"></d:multistatus>`
+		_, err := w.GetChildren("/")
+		require.ErrorIs(t, err, webdavfs.ErrInvalidResponse)
+	})
+
+	t.Run("Href outside of the endpoint", func(t *testing.T) {
+		body = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/other/</d:href>
+    <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+  </d:response>
+</d:multistatus>`
+		_, err := w.GetChildren("/")
+		require.ErrorIs(t, err, webdavfs.ErrInvalidResponse)
+	})
+}
+
+func TestWebDAVSync(t *testing.T) {
+	_, w := newServer(t)
+	require.NoError(t, w.Mkdir("/a"))
+	write(t, w, "/a/b", "remote b")
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "c"), []byte("local c"), 0o644))
+	l, err := localfs.New(root, nil)
+	require.NoError(t, err)
+	defer l.Close()
+
+	runSync := func() int {
+		applied := 0
+		e := fsync.NewExecutor(l, w, func(ctx context.Context, r fsync.ExecutionResult) error {
+			require.NoError(t, r.Err)
+			applied++
+			return nil
+		}, nil)
+		require.NoError(t, fsync.NewProvider(l, w, e.Execute, nil).DoInitialSync(context.Background()))
+		return applied
+	}
+
+	assert.Equal(t, 3, runSync())
+	assert.Equal(t, 0, runSync())
+
+	data, err := os.ReadFile(filepath.Join(root, "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "remote b", string(data))
+	assert.Equal(t, "local c", read(t, w, "/c"))
+
+	write(t, w, "/a/b", "remote b2")
+	require.NoError(t, os.Remove(filepath.Join(root, "c")))
+	assert.Equal(t, 2, runSync())
+	assert.Equal(t, 0, runSync())
+
+	data, err = os.ReadFile(filepath.Join(root, "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "remote b2", string(data))
+	_, err = w.Stat("/c")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}